@@ -1,23 +1,316 @@
 package usrv
 
-import "time"
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Configuration options for hedged requests.
+type HedgeConfig struct {
+	// Issue a hedged request if no reply has been received within this delay.
+	Delay time.Duration
+
+	// If set to a value in the (0, 100) range, the hedge delay is
+	// calculated as the specified percentile of the recently observed
+	// latencies for the target endpoint. Delay is used as a fallback
+	// until enough latency samples have been collected and as a floor
+	// for the calculated delay (default: 10ms).
+	Percentile float64
+
+	// The number of latency samples to keep per endpoint (default: 100).
+	WindowSize int
+}
+
+// The default floor for percentile-based hedge delays.
+const defaultHedgeDelay = 10 * time.Millisecond
+
+// Client options are passed to NewClient to customize the client behavior.
+type ClientOption func(c *Client)
+
+// Enable hedged requests. When enabled, the client will issue a duplicate
+// request if no reply is received within the configured delay and will
+// return the first successful reply. The outstanding request is then
+// cancelled if the transport implements the Canceler interface.
+//
+// If the original request fails with ErrServiceUnavailable before the hedge
+// delay expires, the hedged request is issued immediately. Other errors are
+// returned without hedging as the request may already have been processed.
+//
+// Hedged requests are tagged with the PropertyHedged property and have
+// their own correlation id; replies to hedged requests carry that id.
+//
+// WithHedging panics if the configured percentile is not in the [0, 100) range.
+func WithHedging(config HedgeConfig) ClientOption {
+	if config.Percentile < 0 || config.Percentile >= 100 {
+		panic("Percentile should be in the [0, 100) range")
+	}
+	if config.WindowSize <= 0 {
+		config.WindowSize = 100
+	}
+	if config.Percentile > 0 && config.Delay <= 0 {
+		config.Delay = defaultHedgeDelay
+	}
+
+	return func(c *Client) {
+		c.hedge = &config
+	}
+}
+
+// Client interceptors are invoked before a message is sent and may modify it
+// (e.g. to attach credentials). If an interceptor returns an error, the
+// message is not sent and the error is returned as the reply.
+type ClientInterceptor func(msg Message) error
+
+// Register interceptors to be invoked, in order, for each sent message.
+func WithInterceptors(interceptors ...ClientInterceptor) ClientOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
 
 type Client struct {
 	service   string
 	transport Transport
+
+	hedge        *HedgeConfig
+	interceptors []ClientInterceptor
+
+	// Recently observed latencies for each endpoint
+	latencyMutex sync.Mutex
+	latencies    map[string]*latencyWindow
 }
 
-func NewClient(service string, transport Transport) *Client {
-	return &Client{
+func NewClient(service string, transport Transport, options ...ClientOption) *Client {
+	c := &Client{
 		service:   service,
 		transport: transport,
+		latencies: make(map[string]*latencyWindow, 0),
+	}
+
+	for _, option := range options {
+		option(c)
 	}
+
+	return c
 }
 
+// A message created by a client with hedging enabled. It keeps track of the
+// target endpoint so that the client can create duplicates for hedged requests.
+type hedgedMessage struct {
+	Message
+	endpoint string
+}
+
+// Create a message to be delivered to an endpoint of the client's service.
+// If hedging is disabled, the returned message is created by the client's
+// transport. Otherwise, the transport message is wrapped so that hedged
+// duplicates can be created and the returned message must be sent using the
+// client's Send method.
 func (c *Client) NewMessage(from string, toEndpoint string) Message {
-	return c.transport.MessageTo(from, c.service, toEndpoint)
+	msg := c.transport.MessageTo(from, c.service, toEndpoint)
+	if c.hedge == nil {
+		return msg
+	}
+	return &hedgedMessage{Message: msg, endpoint: toEndpoint}
 }
 
 func (c *Client) Send(msg Message, timeout time.Duration) <-chan Message {
-	return c.transport.Send(msg, timeout, true)
+	var endpoint string
+	hm, hedge := msg.(*hedgedMessage)
+	if hedge {
+		msg, endpoint = hm.Message, hm.endpoint
+	}
+
+	for _, interceptor := range c.interceptors {
+		if err := interceptor(msg); err != nil {
+			resMsg := c.transport.ReplyTo(msg)
+			resMsg.SetContent(nil, err)
+
+			resChan := make(chan Message, 1)
+			resChan <- resMsg
+			close(resChan)
+			return resChan
+		}
+	}
+
+	if !hedge || c.hedge == nil {
+		return c.transport.Send(msg, timeout, true)
+	}
+
+	resChan := make(chan Message, 1)
+	go c.sendHedged(msg, endpoint, timeout, resChan)
+	return resChan
+}
+
+// Send a request and issue a hedged duplicate if no reply arrives within the
+// hedge delay or if the request fails with ErrServiceUnavailable before the
+// delay expires. The first
+// successful reply is piped to resChan. If all attempts fail, the last
+// received reply is piped instead.
+func (c *Client) sendHedged(msg Message, endpoint string, timeout time.Duration, resChan chan<- Message) {
+	defer close(resChan)
+
+	start := time.Now()
+	primaryChan := c.transport.Send(msg, timeout, true)
+
+	hedgeTimer := time.NewTimer(c.hedgeDelay(endpoint))
+	defer hedgeTimer.Stop()
+
+	var hedgeMsg Message
+	var hedgeChan <-chan Message
+	var hedgeStart time.Time
+	var lastRes Message
+
+	// Issue the hedged request using the remaining time budget
+	sendHedge := func() {
+		hedgeTimer.Stop()
+		hedgeTimeout := timeout
+		if timeout > 0 {
+			hedgeTimeout = timeout - time.Since(start)
+			if hedgeTimeout <= 0 {
+				hedgeTimeout = time.Nanosecond
+			}
+		}
+
+		hedgeStart = time.Now()
+		hedgeMsg = c.hedgeMessage(msg, endpoint)
+		hedgeChan = c.transport.Send(hedgeMsg, hedgeTimeout, true)
+	}
+
+	pending := 1
+	for pending > 0 {
+		var res, loser Message
+		var sentAt time.Time
+
+		select {
+		case <-hedgeTimer.C:
+			sendHedge()
+
+			// Wait for one more reply
+			pending++
+			continue
+		case res = <-primaryChan:
+			primaryChan = nil
+			loser = hedgeMsg
+			sentAt = start
+		case res = <-hedgeChan:
+			hedgeChan = nil
+			loser = msg
+			sentAt = hedgeStart
+		}
+		pending--
+
+		if _, err := res.Content(); err != nil {
+			lastRes = res
+
+			// Hedge immediately if the original request could not
+			// be delivered
+			if hedgeMsg == nil && err == ErrServiceUnavailable {
+				sendHedge()
+				pending++
+			}
+			continue
+		}
+
+		c.recordLatency(endpoint, time.Since(sentAt))
+		if loser != nil {
+			if canceler, ok := c.transport.(Canceler); ok {
+				canceler.Cancel(loser)
+			}
+		}
+
+		resChan <- res
+		return
+	}
+
+	resChan <- lastRes
+}
+
+// Create a duplicate of msg to be used as a hedged request.
+func (c *Client) hedgeMessage(msg Message, endpoint string) Message {
+	hedgeMsg := c.transport.MessageTo(msg.From(), c.service, endpoint)
+	for k, v := range msg.Property() {
+		hedgeMsg.Property().Set(k, v)
+	}
+	hedgeMsg.Property().Set(PropertyHedged, msg.CorrelationId())
+
+	content, _ := msg.Content()
+	hedgeMsg.SetContent(content, nil)
+
+	return hedgeMsg
+}
+
+// Get the hedge delay for an endpoint.
+func (c *Client) hedgeDelay(endpoint string) time.Duration {
+	if c.hedge.Percentile <= 0 {
+		return c.hedge.Delay
+	}
+
+	c.latencyMutex.Lock()
+	defer c.latencyMutex.Unlock()
+
+	window := c.latencies[endpoint]
+	if window == nil || len(window.samples) < window.minSamples() {
+		return c.hedge.Delay
+	}
+
+	delay := window.percentile(c.hedge.Percentile)
+	if delay < c.hedge.Delay {
+		return c.hedge.Delay
+	}
+	return delay
+}
+
+// Record the latency for a successful request to an endpoint.
+func (c *Client) recordLatency(endpoint string, latency time.Duration) {
+	c.latencyMutex.Lock()
+	defer c.latencyMutex.Unlock()
+
+	window := c.latencies[endpoint]
+	if window == nil {
+		window = &latencyWindow{
+			samples: make([]time.Duration, 0, c.hedge.WindowSize),
+		}
+		c.latencies[endpoint] = window
+	}
+
+	window.add(latency)
+}
+
+// A fixed-size ring buffer of latency samples.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, latency)
+		return
+	}
+
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % len(w.samples)
+}
+
+// The number of samples required before percentiles are considered reliable.
+func (w *latencyWindow) minSamples() int {
+	if cap(w.samples) < 10 {
+		return cap(w.samples)
+	}
+	return 10
+}
+
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
 }
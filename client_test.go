@@ -0,0 +1,236 @@
+package usrv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/transport"
+)
+
+func TestClientHedging(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only reply to hedged requests
+	hedgedChan := make(chan usrv.Message, 1)
+	go func() {
+		for reqMsg := range reqChan {
+			if reqMsg.Property().Get(usrv.PropertyHedged) == "" {
+				continue
+			}
+
+			hedgedChan <- reqMsg
+			resMsg := tr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte("OK"), nil)
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	client := usrv.NewClient("srv", tr, usrv.WithHedging(usrv.HedgeConfig{
+		Delay: 5 * time.Millisecond,
+	}))
+
+	reqMsg := client.NewMessage("test", "ep1")
+	reqMsg.Property().Set("foo", "bar")
+	resMsg := <-client.Send(reqMsg, time.Second)
+
+	content, err := resMsg.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "OK" {
+		t.Fatalf("Expected response to be OK; got %s", string(content))
+	}
+
+	hedgedMsg := <-hedgedChan
+	if hedgedMsg.Property().Get(usrv.PropertyHedged) != reqMsg.CorrelationId() {
+		t.Fatalf("Expected hedged request to reference correlation id %s; got %s", reqMsg.CorrelationId(), hedgedMsg.Property().Get(usrv.PropertyHedged))
+	}
+	if hedgedMsg.Property().Get("foo") != "bar" {
+		t.Fatalf("Expected hedged request to copy property 'foo'")
+	}
+}
+
+func TestClientHedgingFailure(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	// Do not bind any endpoint; all attempts should fail
+	client := usrv.NewClient("srv", tr, usrv.WithHedging(usrv.HedgeConfig{
+		Delay: time.Millisecond,
+	}))
+
+	reqMsg := client.NewMessage("test", "ep1")
+	resMsg := <-client.Send(reqMsg, time.Second)
+
+	_, err := resMsg.Content()
+	if err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestClientHedgingOnEarlyFailure(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the original request and reply to the hedged one
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := tr.ReplyTo(reqMsg)
+			if reqMsg.Property().Get(usrv.PropertyHedged) == "" {
+				resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			} else {
+				resMsg.SetContent([]byte("OK"), nil)
+			}
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	client := usrv.NewClient("srv", tr, usrv.WithHedging(usrv.HedgeConfig{
+		Delay: time.Hour,
+	}))
+
+	start := time.Now()
+	resMsg := <-client.Send(client.NewMessage("test", "ep1"), time.Second)
+	content, err := resMsg.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "OK" {
+		t.Fatalf("Expected response to be OK; got %s", string(content))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected hedged request to be sent without waiting for the hedge delay; took %v", elapsed)
+	}
+}
+
+func TestClientHedgingSkipsApplicationErrors(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail all requests with an application error
+	received := make(chan usrv.Message, 2)
+	go func() {
+		for reqMsg := range reqChan {
+			received <- reqMsg
+			resMsg := tr.ReplyTo(reqMsg)
+			resMsg.SetContent(nil, usrv.ErrPermissionDenied)
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	client := usrv.NewClient("srv", tr, usrv.WithHedging(usrv.HedgeConfig{
+		Delay: time.Hour,
+	}))
+
+	resMsg := <-client.Send(client.NewMessage("test", "ep1"), time.Second)
+	if _, err := resMsg.Content(); err != usrv.ErrPermissionDenied {
+		t.Fatalf("Expected to get ErrPermissionDenied; got %v", err)
+	}
+
+	<-received
+	select {
+	case reqMsg := <-received:
+		t.Fatalf("Expected request to be sent once; got hedged request %s", reqMsg.CorrelationId())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientHedgingInvalidPercentile(t *testing.T) {
+	for _, percentile := range []float64{-1, 100, 150} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("[percentile %v] Expected WithHedging to panic", percentile)
+				}
+			}()
+			usrv.WithHedging(usrv.HedgeConfig{Percentile: percentile})
+		}()
+	}
+}
+
+func TestClientMessageUsableWithTransport(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := tr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte("OK"), nil)
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	client := usrv.NewClient("srv", tr)
+
+	// Messages created by clients without hedging may be sent directly via
+	// the transport
+	resMsg := <-tr.Send(client.NewMessage("test", "ep1"), time.Second, true)
+	if _, err := resMsg.Content(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := tr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.Property().Get("token")), nil)
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	client := usrv.NewClient("srv", tr, usrv.WithInterceptors(func(msg usrv.Message) error {
+		msg.Property().Set("token", "secret")
+		return nil
+	}))
+
+	resMsg := <-client.Send(client.NewMessage("test", "ep1"), time.Second)
+	content, err := resMsg.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "secret" {
+		t.Fatalf("Expected interceptor to set property 'token'; got %s", string(content))
+	}
+
+	// Interceptor errors should be returned as replies
+	expErr := usrv.ErrUnauthorized
+	client = usrv.NewClient("srv", tr, usrv.WithInterceptors(func(msg usrv.Message) error {
+		return expErr
+	}))
+
+	resMsg = <-client.Send(client.NewMessage("test", "ep1"), time.Second)
+	_, err = resMsg.Content()
+	if err != expErr {
+		t.Fatalf("Expected to get error %v; got %v", expErr, err)
+	}
+}
@@ -0,0 +1,69 @@
+package usrv
+
+import "golang.org/x/net/context"
+
+// Messages that carry a request context implement this interface.
+type contextCarrier interface {
+	Context() context.Context
+}
+
+// A Message wrapper that associates a request context with the wrapped message.
+type contextMessage struct {
+	Message
+	ctx context.Context
+}
+
+func (m *contextMessage) Context() context.Context {
+	return m.ctx
+}
+
+// Associate a context with a message. The server uses this method to attach
+// a request context to incoming messages before passing them to the endpoint
+// handler.
+func WithContext(msg Message, ctx context.Context) Message {
+	if wrapped, ok := msg.(*contextMessage); ok {
+		msg = wrapped.Message
+	}
+
+	return &contextMessage{
+		Message: msg,
+		ctx:     ctx,
+	}
+}
+
+// Get the context associated with a message. If the message does not carry
+// a context, this method returns context.Background().
+func MessageContext(msg Message) context.Context {
+	if carrier, ok := msg.(contextCarrier); ok {
+		if ctx := carrier.Context(); ctx != nil {
+			return ctx
+		}
+	}
+
+	return context.Background()
+}
+
+// The context key for the request-scoped logger.
+type loggerContextKey struct{}
+
+// Associate a logger with a context.
+func ContextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// Get the logger associated with a context. If the context does not carry
+// a logger, this method returns NullLogger.
+func ContextLogger(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(Logger); ok {
+		return logger
+	}
+
+	return NullLogger
+}
+
+// Get the request-scoped logger for a message received by a server. The
+// logger includes the correlation id, sender, recipient and any trace ids
+// of the request in every entry.
+func RequestLogger(msg Message) Logger {
+	return ContextLogger(MessageContext(msg))
+}
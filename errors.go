@@ -7,4 +7,8 @@ var (
 	ErrNoEndpointsBound     = errors.New("No endpoints bound")
 	ErrServiceUnavailable   = errors.New("Service unavailable")
 	ErrTimeout              = errors.New("Request timeout")
+	ErrCancelled            = errors.New("Request cancelled")
+	ErrUnauthorized         = errors.New("Unauthorized")
+	ErrPermissionDenied     = errors.New("Permission denied")
+	ErrInternal             = errors.New("Internal server error")
 )
@@ -29,3 +29,45 @@ func (l nullLogger) Warn(msg string, args ...interface{}) error { return nil }
 func (l nullLogger) Error(msg string, args ...interface{}) error { return nil }
 
 func (l nullLogger) Fatal(msg string, args ...interface{}) {}
+
+// A Logger that includes a fixed set of key/value args in every entry.
+type contextLogger struct {
+	logger Logger
+	args   []interface{}
+}
+
+// Create a Logger that includes the supplied key/value args in every entry
+// before passing it to the wrapped logger.
+func LoggerWith(logger Logger, args ...interface{}) Logger {
+	if wrapped, ok := logger.(*contextLogger); ok {
+		logger = wrapped.logger
+		args = append(append([]interface{}{}, wrapped.args...), args...)
+	}
+
+	return &contextLogger{
+		logger: logger,
+		args:   args,
+	}
+}
+
+func (l *contextLogger) with(args []interface{}) []interface{} {
+	merged := make([]interface{}, 0, len(l.args)+len(args))
+	merged = append(merged, l.args...)
+	return append(merged, args...)
+}
+
+func (l *contextLogger) Trace(msg string, args ...interface{}) { l.logger.Trace(msg, l.with(args)...) }
+
+func (l *contextLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.with(args)...) }
+
+func (l *contextLogger) Info(msg string, args ...interface{}) { l.logger.Info(msg, l.with(args)...) }
+
+func (l *contextLogger) Warn(msg string, args ...interface{}) error {
+	return l.logger.Warn(msg, l.with(args)...)
+}
+
+func (l *contextLogger) Error(msg string, args ...interface{}) error {
+	return l.logger.Error(msg, l.with(args)...)
+}
+
+func (l *contextLogger) Fatal(msg string, args ...interface{}) { l.logger.Fatal(msg, l.with(args)...) }
@@ -3,6 +3,25 @@ package usrv
 // Common message property names
 const (
 	PropertyHasError = "error"
+
+	// Set on hedged requests; contains the correlation id of the original request.
+	PropertyHedged = "hedged"
+
+	// A client-supplied key that identifies retries of the same request.
+	PropertyIdempotencyKey = "idempotency_key"
+
+	// Set by handlers to specify for how many seconds a reply may be cached.
+	PropertyMaxAge = "max_age"
+
+	// Set by the response cache to "hit" or "miss".
+	PropertyCacheStatus = "cache"
+
+	// A signed token that authenticates the sender.
+	PropertyAuthToken = "auth_token"
+
+	// Distributed tracing ids propagated with requests.
+	PropertyTraceId = "trace_id"
+	PropertySpanId  = "span_id"
 )
 
 type Property map[string]string
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Log levels for the AccessLog middleware.
+type AccessLogLevel string
+
+const (
+	AccessLogTrace AccessLogLevel = "trace"
+	AccessLogDebug AccessLogLevel = "debug"
+	AccessLogInfo  AccessLogLevel = "info"
+	AccessLogWarn  AccessLogLevel = "warn"
+	AccessLogError AccessLogLevel = "error"
+)
+
+// The placeholder for redacted payload fields.
+const redactedValue = "[REDACTED]"
+
+// Configuration options for the AccessLog middleware.
+type AccessLogConfig struct {
+	// The log level for successful requests (default: info).
+	SuccessLevel AccessLogLevel
+
+	// The log level for failed requests (default: error).
+	ErrorLevel AccessLogLevel
+
+	// Only log a fraction of successful requests. Failed and slow requests
+	// are always logged.
+	EnableSampling bool
+
+	// The fraction of successful requests to log when sampling is enabled.
+	// A value of 0 disables logging of successful requests while values of
+	// 1 or more log all of them.
+	SampleRate float64
+
+	// Successful requests that take longer than this threshold are logged
+	// at warn level. A zero value disables slow request detection.
+	SlowThreshold time.Duration
+
+	// Include the request and response payloads in the log entry.
+	LogPayloads bool
+
+	// JSON payload fields whose values are replaced with a placeholder
+	// before logging. Field names are matched case-insensitively at any
+	// nesting level. If set, payloads that are not valid JSON are omitted.
+	RedactFields []string
+
+	// The message properties to include in the log entry. Request property
+	// values are logged as "req.<key>" and response property values as
+	// "res.<key>".
+	Properties []string
+}
+
+// Log processed requests according to the supplied configuration. Each entry
+// contains the processing time, sender, recipient, correlation id and
+// payload lengths in addition to any configured payloads and properties.
+// Requests whose handler panics are logged as failed with ErrInternal before
+// the panic is propagated.
+func AccessLog(logger usrv.Logger, config AccessLogConfig, handler usrv.Handler) usrv.Handler {
+	if config.SuccessLevel == "" {
+		config.SuccessLevel = AccessLogInfo
+	}
+	if config.ErrorLevel == "" {
+		config.ErrorLevel = AccessLogError
+	}
+
+	redactFields := make(map[string]bool, len(config.RedactFields))
+	for _, field := range config.RedactFields {
+		redactFields[strings.ToLower(field)] = true
+	}
+
+	return func(req, res usrv.Message) {
+		// Log the request even if the handler panics
+		completed := false
+		defer func(start time.Time) {
+			elapsed := time.Since(start)
+
+			reqContent, _ := req.Content()
+			resContent, err := res.Content()
+			if !completed && err == nil {
+				err = usrv.ErrInternal
+			}
+
+			var level AccessLogLevel
+			var msg string
+			switch {
+			case err != nil:
+				level, msg = config.ErrorLevel, "Request failed"
+			case config.SlowThreshold > 0 && elapsed > config.SlowThreshold:
+				level, msg = AccessLogWarn, "Slow request"
+			default:
+				if config.EnableSampling && rand.Float64() >= config.SampleRate {
+					return
+				}
+				level, msg = config.SuccessLevel, "Processed request"
+			}
+
+			args := []interface{}{
+				"time", elapsed.Nanoseconds(),
+				"from", req.From(),
+				"to", req.To(),
+				"correlation_id", req.CorrelationId(),
+				"req_len", len(reqContent),
+				"res_len", len(resContent),
+			}
+			if err != nil {
+				args = append(args, "error", err)
+			}
+
+			if config.LogPayloads {
+				if payload, ok := loggablePayload(reqContent, redactFields); ok {
+					args = append(args, "req", payload)
+				}
+				if payload, ok := loggablePayload(resContent, redactFields); ok {
+					args = append(args, "res", payload)
+				}
+			}
+
+			for _, key := range config.Properties {
+				if val := req.Property().Get(key); val != "" {
+					args = append(args, "req."+key, val)
+				}
+				if val := res.Property().Get(key); val != "" {
+					args = append(args, "res."+key, val)
+				}
+			}
+
+			logAt(logger, level, msg, args...)
+		}(time.Now())
+
+		handler(req, res)
+		completed = true
+	}
+}
+
+// Log a message using the logger method that corresponds to level.
+func logAt(logger usrv.Logger, level AccessLogLevel, msg string, args ...interface{}) {
+	switch level {
+	case AccessLogTrace:
+		logger.Trace(msg, args...)
+	case AccessLogDebug:
+		logger.Debug(msg, args...)
+	case AccessLogWarn:
+		logger.Warn(msg, args...)
+	case AccessLogError:
+		logger.Error(msg, args...)
+	default:
+		logger.Info(msg, args...)
+	}
+}
+
+// Convert a payload to a string suitable for logging, redacting any JSON
+// fields in redactFields. Returns false if the payload should be omitted.
+func loggablePayload(payload []byte, redactFields map[string]bool) (string, bool) {
+	if len(redactFields) == 0 {
+		return string(payload), true
+	}
+
+	// Decode numbers as json.Number so they are logged without loss of precision
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return "", false
+	}
+
+	redacted, err := json.Marshal(redact(doc, redactFields))
+	if err != nil {
+		return "", false
+	}
+	return string(redacted), true
+}
+
+// Recursively replace the values of the specified fields in a decoded JSON document.
+func redact(doc interface{}, redactFields map[string]bool) interface{} {
+	switch val := doc.(type) {
+	case map[string]interface{}:
+		for k, v := range val {
+			if redactFields[strings.ToLower(k)] {
+				val[k] = redactedValue
+			} else {
+				val[k] = redact(v, redactFields)
+			}
+		}
+	case []interface{}:
+		for idx, v := range val {
+			val[idx] = redact(v, redactFields)
+		}
+	}
+	return doc
+}
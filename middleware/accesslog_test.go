@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func TestAccessLogLevels(t *testing.T) {
+	var failWith error
+	var delay time.Duration
+	handler := func(req, res usrv.Message) {
+		<-time.After(delay)
+		res.SetContent([]byte("OK"), failWith)
+	}
+
+	logger := &usrvtest.Logger{}
+	logHandler := AccessLog(logger, AccessLogConfig{
+		SuccessLevel:  AccessLogDebug,
+		ErrorLevel:    AccessLogWarn,
+		SlowThreshold: 5 * time.Millisecond,
+	}, handler)
+
+	spec := []struct {
+		delay      time.Duration
+		err        error
+		expLevel   string
+		expMessage string
+	}{
+		{0, nil, "debug", "Processed request"},
+		{0, fmt.Errorf("Error"), "warn", "Request failed"},
+		{10 * time.Millisecond, nil, "warn", "Slow request"},
+	}
+
+	for idx, s := range spec {
+		delay, failWith = s.delay, s.err
+		logHandler(&usrvtest.Message{}, &usrvtest.Message{})
+
+		if len(logger.Entries) != idx+1 {
+			t.Fatalf("[spec %d] Expected to log %d entries; got %d", idx, idx+1, len(logger.Entries))
+		}
+		entry := logger.Entries[idx]
+		if entry.Level != s.expLevel || entry.Message != s.expMessage {
+			t.Fatalf("[spec %d] Expected log entry '%s: %s'; got '%s: %s'", idx, s.expLevel, s.expMessage, entry.Level, entry.Message)
+		}
+		if s.err != nil && entry.Context["error"] != s.err {
+			t.Fatalf("[spec %d] Expected logger key 'error' to contain value %v; got %v", idx, s.err, entry.Context["error"])
+		}
+	}
+}
+
+func TestAccessLogPanickingHandler(t *testing.T) {
+	handler := func(req, res usrv.Message) {
+		panic("oops")
+	}
+
+	logger := &usrvtest.Logger{}
+	logHandler := AccessLog(logger, AccessLogConfig{}, handler)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected panic to be propagated")
+			}
+		}()
+		logHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	}()
+
+	if len(logger.Entries) != 1 {
+		t.Fatalf("Expected to log 1 entry; got %d", len(logger.Entries))
+	}
+	entry := logger.Entries[0]
+	if entry.Level != "error" || entry.Message != "Request failed" {
+		t.Fatalf("Expected log entry 'error: Request failed'; got '%s: %s'", entry.Level, entry.Message)
+	}
+	if entry.Context["error"] != usrv.ErrInternal {
+		t.Fatalf("Expected logger key 'error' to contain value %v; got %v", usrv.ErrInternal, entry.Context["error"])
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var failWith error
+	handler := func(req, res usrv.Message) {
+		res.SetContent(nil, failWith)
+	}
+
+	logger := &usrvtest.Logger{}
+	logHandler := AccessLog(logger, AccessLogConfig{
+		EnableSampling: true,
+		SampleRate:     0.5,
+	}, handler)
+
+	for i := 0; i < 1000; i++ {
+		logHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	}
+	if count := len(logger.Entries); count < 350 || count > 650 {
+		t.Fatalf("Expected approximately half of the successful requests to be logged; got %d", count)
+	}
+
+	// Errors should never be sampled
+	logger.Entries = nil
+	failWith = fmt.Errorf("Error")
+	for i := 0; i < 100; i++ {
+		logHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	}
+	if count := len(logger.Entries); count != 100 {
+		t.Fatalf("Expected all failed requests to be logged; got %d", count)
+	}
+}
+
+func TestAccessLogZeroSampleRate(t *testing.T) {
+	var failWith error
+	handler := func(req, res usrv.Message) {
+		res.SetContent(nil, failWith)
+	}
+
+	logger := &usrvtest.Logger{}
+	logHandler := AccessLog(logger, AccessLogConfig{
+		EnableSampling: true,
+	}, handler)
+
+	for i := 0; i < 100; i++ {
+		logHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	}
+	if count := len(logger.Entries); count != 0 {
+		t.Fatalf("Expected successful requests not to be logged; got %d", count)
+	}
+
+	failWith = fmt.Errorf("Error")
+	logHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	if count := len(logger.Entries); count != 1 {
+		t.Fatalf("Expected failed request to be logged; got %d", count)
+	}
+}
+
+func TestAccessLogPayloadsAndProperties(t *testing.T) {
+	handler := func(req, res usrv.Message) {
+		res.Property().Set("status", "created")
+		res.SetContent([]byte(`{"id":12345678901234567890,"user":{"Password":"secret"}}`), nil)
+	}
+
+	logger := &usrvtest.Logger{}
+	logHandler := AccessLog(logger, AccessLogConfig{
+		LogPayloads:  true,
+		RedactFields: []string{"password", "token"},
+		Properties:   []string{"tenant", "status"},
+	}, handler)
+
+	req := &usrvtest.Message{
+		P:    usrv.Property{"tenant": "acme", "other": "ignored"},
+		Cont: []byte(`[{"token":"abc","name":"x"}]`),
+	}
+	logHandler(req, &usrvtest.Message{P: make(usrv.Property, 0)})
+
+	// Non-JSON payloads should be omitted when redaction is enabled
+	logHandler(&usrvtest.Message{Cont: []byte("binary")}, &usrvtest.Message{P: make(usrv.Property, 0)})
+
+	if len(logger.Entries) != 2 {
+		t.Fatalf("Expected to log 2 entries; got %d", len(logger.Entries))
+	}
+
+	exp := map[string]interface{}{
+		"req":        `[{"name":"x","token":"[REDACTED]"}]`,
+		"res":        `{"id":12345678901234567890,"user":{"Password":"[REDACTED]"}}`,
+		"req.tenant": "acme",
+		"res.status": "created",
+	}
+	entry := logger.Entries[0]
+	for k, v := range exp {
+		if entry.Context[k] != v {
+			t.Fatalf("Expected logger key '%s' to contain value %v; got %v", k, v, entry.Context[k])
+		}
+	}
+	if _, found := entry.Context["req.other"]; found {
+		t.Fatalf("Expected unselected property 'other' to be omitted")
+	}
+
+	if _, found := logger.Entries[1].Context["req"]; found {
+		t.Fatalf("Expected non-JSON payload to be omitted")
+	}
+}
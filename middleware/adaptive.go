@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Configuration options for the AdaptiveLimiter. Zero values are replaced
+// by the defaults listed next to each field.
+type AdaptiveLimitConfig struct {
+	// The initial in-flight request limit (default: 20).
+	InitialLimit int
+
+	// The lower bound for the in-flight request limit (default: 1).
+	MinLimit int
+
+	// The upper bound for the in-flight request limit (default: 1000).
+	MaxLimit int
+
+	// Requests that take longer than this threshold to complete are
+	// treated as a sign of overload (default: 1 second).
+	LatencyThreshold time.Duration
+
+	// The factor applied to the limit when overload is detected. It
+	// should be in the (0, 1) range (default: 0.9).
+	BackoffRatio float64
+}
+
+// Runtime statistics for an AdaptiveLimiter.
+type AdaptiveLimitStats struct {
+	// The current in-flight request limit.
+	Limit int
+
+	// Number of requests currently being executed.
+	InFlight int
+
+	// Number of requests rejected because the limit was reached.
+	Rejected uint64
+}
+
+// The AdaptiveLimiter limits the number of requests that can be executed
+// in parallel by the handlers it wraps. Unlike the Throttler, the limit
+// is not fixed but adjusted using an additive-increase/multiplicative-decrease
+// (AIMD) algorithm based on the observed handler latency and errors.
+//
+// Whenever a request completes within the configured latency threshold while
+// the limiter is at least half utilized, the limit is increased by one. When
+// a request exceeds the latency threshold or fails with ErrTimeout or
+// ErrServiceUnavailable, the limit is multiplied by the backoff ratio.
+//
+// Requests that arrive while the limit is reached are not queued but
+// immediately rejected with ErrServiceUnavailable.
+type AdaptiveLimiter struct {
+	config AdaptiveLimitConfig
+
+	// A mutex for synchronized access to the limiter state
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	rejected uint64
+}
+
+// Create a new AdaptiveLimiter using the supplied configuration.
+func NewAdaptiveLimiter(config AdaptiveLimitConfig) *AdaptiveLimiter {
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = 1000
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = 20
+	}
+	if config.LatencyThreshold <= 0 {
+		config.LatencyThreshold = time.Second
+	}
+	if config.BackoffRatio <= 0 || config.BackoffRatio >= 1 {
+		config.BackoffRatio = 0.9
+	}
+
+	if config.MinLimit > config.MaxLimit {
+		panic("MinLimit should be <= MaxLimit")
+	}
+
+	// Clamp initial limit
+	if config.InitialLimit < config.MinLimit {
+		config.InitialLimit = config.MinLimit
+	} else if config.InitialLimit > config.MaxLimit {
+		config.InitialLimit = config.MaxLimit
+	}
+
+	return &AdaptiveLimiter{
+		config: config,
+		limit:  float64(config.InitialLimit),
+	}
+}
+
+// Get a snapshot of the limiter statistics.
+func (l *AdaptiveLimiter) Stats() AdaptiveLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return AdaptiveLimitStats{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		Rejected: l.rejected,
+	}
+}
+
+// Wrap a handler so that its execution is subject to the adaptive limit.
+func (l *AdaptiveLimiter) Handler(handler usrv.Handler) usrv.Handler {
+	return func(req, res usrv.Message) {
+		if !l.acquire() {
+			res.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		start := time.Now()
+		defer func() {
+			_, err := res.Content()
+			l.release(time.Since(start), err)
+		}()
+
+		handler(req, res)
+	}
+}
+
+// Reserve an execution slot. Returns false if the limit has been reached.
+func (l *AdaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		l.rejected++
+		return false
+	}
+
+	l.inFlight++
+	return true
+}
+
+// Release an execution slot and adjust the limit based on the request outcome.
+func (l *AdaptiveLimiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Only grow the limit if it is actually being utilized; otherwise a
+	// lightly loaded service would grow its limit without bounds.
+	utilized := l.inFlight*2 >= int(l.limit)
+	l.inFlight--
+
+	switch {
+	case err == usrv.ErrTimeout, err == usrv.ErrServiceUnavailable, latency > l.config.LatencyThreshold:
+		l.limit *= l.config.BackoffRatio
+		if l.limit < float64(l.config.MinLimit) {
+			l.limit = float64(l.config.MinLimit)
+		}
+	case utilized:
+		l.limit++
+		if l.limit > float64(l.config.MaxLimit) {
+			l.limit = float64(l.config.MaxLimit)
+		}
+	}
+}
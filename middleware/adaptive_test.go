@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func TestAdaptiveLimiterShedsExcessRequests(t *testing.T) {
+	trigger := make(chan struct{})
+	handler := func(req, res usrv.Message) {
+		// Block till we are triggered
+		<-trigger
+		res.SetContent([]byte("OK"), nil)
+	}
+
+	limiter := NewAdaptiveLimiter(AdaptiveLimitConfig{
+		InitialLimit: 2,
+		MaxLimit:     2,
+	})
+	limitedHandler := limiter.Handler(handler)
+
+	done := make(chan *usrvtest.Message)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res := &usrvtest.Message{}
+			limitedHandler(&usrvtest.Message{}, res)
+			done <- res
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for limiter.Stats().InFlight != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected limiter to report 2 in-flight requests; got %d", limiter.Stats().InFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The limit is reached; the next request should be shed
+	res := &usrvtest.Message{}
+	limitedHandler(&usrvtest.Message{}, res)
+	if res.Err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected request to fail with ErrServiceUnavailable; got %v", res.Err)
+	}
+
+	for i := 0; i < 2; i++ {
+		trigger <- struct{}{}
+		res = <-done
+		if res.Err != nil {
+			t.Fatalf("Expected request to complete successfully; got error %v", res.Err)
+		}
+	}
+
+	stats := limiter.Stats()
+	if stats.Rejected != 1 {
+		t.Fatalf("Expected limiter to report 1 rejected request; got %d", stats.Rejected)
+	}
+	if stats.InFlight != 0 {
+		t.Fatalf("Expected limiter to report 0 in-flight requests; got %d", stats.InFlight)
+	}
+}
+
+func TestAdaptiveLimiterAdjustsLimit(t *testing.T) {
+	var failWith error
+	handler := func(req, res usrv.Message) {
+		res.SetContent(nil, failWith)
+	}
+
+	limiter := NewAdaptiveLimiter(AdaptiveLimitConfig{
+		InitialLimit: 1,
+		MinLimit:     1,
+		MaxLimit:     10,
+		BackoffRatio: 0.5,
+	})
+	limitedHandler := limiter.Handler(handler)
+
+	// Successful requests that utilize the limit should grow it
+	for i := 0; i < 3; i++ {
+		limitedHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	}
+	if limit := limiter.Stats().Limit; limit != 3 {
+		t.Fatalf("Expected limit to grow to 3; got %d", limit)
+	}
+
+	// Errors that signal overload should shrink it
+	failWith = usrv.ErrTimeout
+	limitedHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	if limit := limiter.Stats().Limit; limit != 1 {
+		t.Fatalf("Expected limit to shrink to 1; got %d", limit)
+	}
+
+	// The limit should never drop below MinLimit
+	limitedHandler(&usrvtest.Message{}, &usrvtest.Message{})
+	if limit := limiter.Stats().Limit; limit != 1 {
+		t.Fatalf("Expected limit to remain at 1; got %d", limit)
+	}
+}
+
+func TestAdaptiveLimiterLatencyThreshold(t *testing.T) {
+	handler := func(req, res usrv.Message) {
+		<-time.After(5 * time.Millisecond)
+		res.SetContent([]byte("OK"), nil)
+	}
+
+	limiter := NewAdaptiveLimiter(AdaptiveLimitConfig{
+		InitialLimit:     10,
+		LatencyThreshold: time.Millisecond,
+		BackoffRatio:     0.5,
+	})
+	limiter.Handler(handler)(&usrvtest.Message{}, &usrvtest.Message{})
+
+	if limit := limiter.Stats().Limit; limit != 5 {
+		t.Fatalf("Expected slow request to shrink limit to 5; got %d", limit)
+	}
+}
@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/context"
+)
+
+var (
+	errUnsupportedKeyType = errors.New("Unsupported key type")
+	errUnknownKeyId       = errors.New("Unknown key id")
+	errKeyMethodMismatch  = errors.New("Signing method does not match key type")
+)
+
+// The context key for the verified token claims.
+type claimsContextKey struct{}
+
+// A set of keys for verifying signed tokens. Keys are selected using the "kid"
+// header of each token; the empty key id matches tokens without a "kid" header.
+//
+// Keys can be rotated by adding the new key to the set before it is used
+// for signing tokens and removing the old key once all tokens signed with
+// it have expired.
+type KeySet struct {
+	// A mutex for synchronized access to the keys
+	mu   sync.RWMutex
+	keys map[string]interface{}
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{
+		keys: make(map[string]interface{}, 0),
+	}
+}
+
+// Add a verification key to the set replacing any existing key with the same
+// id. Supported key types are []byte for HMAC signatures, *rsa.PublicKey for
+// RSA signatures and *ecdsa.PublicKey for ECDSA signatures.
+func (ks *KeySet) Add(keyId string, key interface{}) error {
+	switch key.(type) {
+	case []byte, *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return errUnsupportedKeyType
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[keyId] = key
+	return nil
+}
+
+// Remove a verification key from the set.
+func (ks *KeySet) Remove(keyId string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	delete(ks.keys, keyId)
+}
+
+// Lookup the verification key for a token ensuring that the key type matches
+// the token signing method.
+func (ks *KeySet) keyFor(token *jwt.Token) (interface{}, error) {
+	keyId, _ := token.Header["kid"].(string)
+
+	ks.mu.RLock()
+	key, found := ks.keys[keyId]
+	ks.mu.RUnlock()
+	if !found {
+		return nil, errUnknownKeyId
+	}
+
+	var methodOk bool
+	switch key.(type) {
+	case []byte:
+		_, methodOk = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, methodOk = token.Method.(*jwt.SigningMethodRSA)
+		if !methodOk {
+			_, methodOk = token.Method.(*jwt.SigningMethodRSAPSS)
+		}
+	case *ecdsa.PublicKey:
+		_, methodOk = token.Method.(*jwt.SigningMethodECDSA)
+	}
+	if !methodOk {
+		return nil, errKeyMethodMismatch
+	}
+
+	return key, nil
+}
+
+// A request whose sender has been verified by the Authenticate middleware.
+type authenticatedMessage struct {
+	usrv.Message
+	subject string
+}
+
+// Get the verified token subject.
+func (m *authenticatedMessage) From() string {
+	return m.subject
+}
+
+// Authenticate incoming requests using the signed token (JWT) stored in the
+// usrv.PropertyAuthToken property. Tokens must be signed by one of the keys in
+// the key set, must specify an expiration time and a subject and must be
+// issued for the audience specified by service. Requests without a valid
+// token are rejected with ErrUnauthorized.
+//
+// The request passed to the wrapped handler reports the verified token
+// subject as its sender. The verified token claims can be retrieved by the
+// wrapped handler using TokenClaims.
+func Authenticate(service string, keys *KeySet, handler usrv.Handler) usrv.Handler {
+	return func(req, res usrv.Message) {
+		tokenString := req.Property().Get(usrv.PropertyAuthToken)
+		if tokenString == "" {
+			res.SetContent(nil, usrv.ErrUnauthorized)
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(
+			tokenString,
+			claims,
+			keys.keyFor,
+			jwt.WithExpirationRequired(),
+			jwt.WithAudience(service),
+		)
+		if err != nil {
+			res.SetContent(nil, usrv.ErrUnauthorized)
+			return
+		}
+
+		subject, err := claims.GetSubject()
+		if err != nil || subject == "" {
+			res.SetContent(nil, usrv.ErrUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(usrv.MessageContext(req), claimsContextKey{}, claims)
+		authReq := &authenticatedMessage{Message: req, subject: subject}
+		handler(usrv.WithContext(authReq, ctx), res)
+	}
+}
+
+// Get the verified token claims for a request processed by the Authenticate
+// middleware. Returns nil if the request has not been authenticated.
+func TokenClaims(req usrv.Message) jwt.MapClaims {
+	claims, _ := usrv.MessageContext(req).Value(claimsContextKey{}).(jwt.MapClaims)
+	return claims
+}
+
+// The TokenSigner generates signed tokens that can be verified by the
+// Authenticate middleware.
+type TokenSigner struct {
+	keyId  string
+	method jwt.SigningMethod
+	key    interface{}
+	ttl    time.Duration
+}
+
+// Create a new TokenSigner. The key type must match the signing method:
+// []byte for HMAC methods, *rsa.PrivateKey for RSA methods and *ecdsa.PrivateKey
+// for ECDSA methods. If keyId is not empty, it is included in the "kid" header
+// of each token. Generated tokens expire after ttl.
+func NewTokenSigner(keyId string, method jwt.SigningMethod, key interface{}, ttl time.Duration) *TokenSigner {
+	return &TokenSigner{
+		keyId:  keyId,
+		method: method,
+		key:    key,
+		ttl:    ttl,
+	}
+}
+
+// Sign a token for a subject that can be used with the service specified by
+// audience. Any additional claims are included in the token; they cannot
+// override the subject, audience, issue and expiration time claims.
+func (s *TokenSigner) Sign(subject string, audience string, extraClaims jwt.MapClaims) (string, error) {
+	claims := jwt.MapClaims{}
+	for k, v := range extraClaims {
+		claims[k] = v
+	}
+
+	now := time.Now()
+	claims["sub"] = subject
+	claims["aud"] = audience
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(s.ttl).Unix()
+
+	token := jwt.NewWithClaims(s.method, claims)
+	if s.keyId != "" {
+		token.Header["kid"] = s.keyId
+	}
+
+	return token.SignedString(s.key)
+}
+
+// Create a client interceptor that attaches a signed token to outgoing
+// messages. The token subject is set to the message sender and its audience
+// to the target service.
+func AttachToken(signer *TokenSigner, audience string) usrv.ClientInterceptor {
+	return func(msg usrv.Message) error {
+		token, err := signer.Sign(msg.From(), audience, nil)
+		if err != nil {
+			return err
+		}
+
+		msg.Property().Set(usrv.PropertyAuthToken, token)
+		return nil
+	}
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func authenticatedHandler(t *testing.T, keys *KeySet) usrv.Handler {
+	return Authenticate("srv", keys, func(req, res usrv.Message) {
+		claims := TokenClaims(req)
+		if claims == nil {
+			t.Fatalf("Expected handler to receive verified claims")
+		}
+		subject, _ := claims.GetSubject()
+		res.SetContent([]byte(subject), nil)
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := []byte("secret")
+
+	keys := NewKeySet()
+	keys.Add("hmac", hmacKey)
+	keys.Add("rsa", &rsaKey.PublicKey)
+	keys.Add("ec", &ecKey.PublicKey)
+
+	signers := []*TokenSigner{
+		NewTokenSigner("hmac", jwt.SigningMethodHS256, hmacKey, time.Minute),
+		NewTokenSigner("rsa", jwt.SigningMethodRS256, rsaKey, time.Minute),
+		NewTokenSigner("ec", jwt.SigningMethodES256, ecKey, time.Minute),
+	}
+
+	handler := authenticatedHandler(t, keys)
+	for idx, signer := range signers {
+		req := &usrvtest.Message{F: "api", P: make(usrv.Property, 0)}
+		err = AttachToken(signer, "srv")(req)
+		if err != nil {
+			t.Fatalf("[signer %d] %v", idx, err)
+		}
+
+		res := &usrvtest.Message{}
+		handler(req, res)
+		if res.Err != nil {
+			t.Fatalf("[signer %d] Expected request to be authenticated; got %v", idx, res.Err)
+		}
+		if string(res.Cont) != "api" {
+			t.Fatalf("[signer %d] Expected subject to be 'api'; got %s", idx, string(res.Cont))
+		}
+	}
+}
+
+func TestAuthenticateRejectsInvalidTokens(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := NewKeySet()
+	keys.Add("k1", []byte("secret"))
+	keys.Add("rsa", &rsaKey.PublicKey)
+
+	spec := []*TokenSigner{
+		// Unknown key id
+		NewTokenSigner("k2", jwt.SigningMethodHS256, []byte("secret"), time.Minute),
+		// Wrong key
+		NewTokenSigner("k1", jwt.SigningMethodHS256, []byte("other"), time.Minute),
+		// Expired token
+		NewTokenSigner("k1", jwt.SigningMethodHS256, []byte("secret"), -time.Minute),
+		// HMAC token using the RSA public key as the secret
+		NewTokenSigner("rsa", jwt.SigningMethodHS256, []byte("secret"), time.Minute),
+	}
+
+	handler := Authenticate("srv", keys, func(req, res usrv.Message) {
+		t.Fatalf("Handler should not be invoked for unauthenticated requests")
+	})
+
+	for idx, signer := range spec {
+		token, err := signer.Sign("api", "srv", nil)
+		if err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+
+		res := &usrvtest.Message{}
+		handler(&usrvtest.Message{P: usrv.Property{usrv.PropertyAuthToken: token}}, res)
+		if res.Err != usrv.ErrUnauthorized {
+			t.Fatalf("[spec %d] Expected request to fail with ErrUnauthorized; got %v", idx, res.Err)
+		}
+	}
+
+	// Missing token
+	res := &usrvtest.Message{}
+	handler(&usrvtest.Message{P: make(usrv.Property, 0)}, res)
+	if res.Err != usrv.ErrUnauthorized {
+		t.Fatalf("Expected request without token to fail with ErrUnauthorized; got %v", res.Err)
+	}
+}
+
+func TestAuthenticateBindsSubjectToSender(t *testing.T) {
+	keys := NewKeySet()
+	keys.Add("k1", []byte("secret"))
+	signer := NewTokenSigner("k1", jwt.SigningMethodHS256, []byte("secret"), time.Minute)
+
+	handler := Authenticate("srv", keys, func(req, res usrv.Message) {
+		res.SetContent([]byte(req.From()), nil)
+	})
+
+	// The sender reported to the handler should be the verified subject
+	token, _ := signer.Sign("api", "srv", nil)
+	res := &usrvtest.Message{}
+	handler(&usrvtest.Message{F: "admin", P: usrv.Property{usrv.PropertyAuthToken: token}}, res)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if string(res.Cont) != "api" {
+		t.Fatalf("Expected sender to be 'api'; got %s", string(res.Cont))
+	}
+
+	// Tokens without a subject should be rejected
+	token, _ = signer.Sign("", "srv", nil)
+	res = &usrvtest.Message{}
+	handler(&usrvtest.Message{F: "admin", P: usrv.Property{usrv.PropertyAuthToken: token}}, res)
+	if res.Err != usrv.ErrUnauthorized {
+		t.Fatalf("Expected request without a token subject to fail with ErrUnauthorized; got %v", res.Err)
+	}
+}
+
+func TestAuthenticateAudience(t *testing.T) {
+	keys := NewKeySet()
+	keys.Add("k1", []byte("secret"))
+	signer := NewTokenSigner("k1", jwt.SigningMethodHS256, []byte("secret"), time.Minute)
+	handler := authenticatedHandler(t, keys)
+
+	// Tokens issued for another service should be rejected
+	token, _ := signer.Sign("api", "other", nil)
+	res := &usrvtest.Message{}
+	handler(&usrvtest.Message{P: usrv.Property{usrv.PropertyAuthToken: token}}, res)
+	if res.Err != usrv.ErrUnauthorized {
+		t.Fatalf("Expected token for another audience to fail with ErrUnauthorized; got %v", res.Err)
+	}
+
+	// Extra claims should not override the reserved claims
+	token, _ = signer.Sign("api", "other", jwt.MapClaims{
+		"sub":  "admin",
+		"aud":  "srv",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"role": "reader",
+	})
+	res = &usrvtest.Message{}
+	handler(&usrvtest.Message{P: usrv.Property{usrv.PropertyAuthToken: token}}, res)
+	if res.Err != usrv.ErrUnauthorized {
+		t.Fatalf("Expected extra claims not to override the audience; got %v", res.Err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "api" || claims["role"] != "reader" {
+		t.Fatalf("Expected reserved claims to be kept and extra claims to be added; got %v", claims)
+	}
+}
+
+func TestAuthenticateKeyRotation(t *testing.T) {
+	keys := NewKeySet()
+	keys.Add("k1", []byte("old"))
+	keys.Add("k2", []byte("new"))
+
+	oldToken, _ := NewTokenSigner("k1", jwt.SigningMethodHS256, []byte("old"), time.Minute).Sign("api", "srv", nil)
+	newToken, _ := NewTokenSigner("k2", jwt.SigningMethodHS256, []byte("new"), time.Minute).Sign("api", "srv", nil)
+
+	handler := authenticatedHandler(t, keys)
+	for _, token := range []string{oldToken, newToken} {
+		res := &usrvtest.Message{}
+		handler(&usrvtest.Message{P: usrv.Property{usrv.PropertyAuthToken: token}}, res)
+		if res.Err != nil {
+			t.Fatalf("Expected request to be authenticated; got %v", res.Err)
+		}
+	}
+
+	// Retire old key
+	keys.Remove("k1")
+	res := &usrvtest.Message{}
+	handler(&usrvtest.Message{P: usrv.Property{usrv.PropertyAuthToken: oldToken}}, res)
+	if res.Err != usrv.ErrUnauthorized {
+		t.Fatalf("Expected token signed with retired key to fail with ErrUnauthorized; got %v", res.Err)
+	}
+}
+
+func TestKeySetUnsupportedKey(t *testing.T) {
+	err := NewKeySet().Add("k1", "secret")
+	if err != errUnsupportedKeyType {
+		t.Fatalf("Expected to get errUnsupportedKeyType; got %v", err)
+	}
+}
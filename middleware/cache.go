@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Values for the usrv.PropertyCacheStatus property.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Configuration options for the ResponseCache.
+type CacheConfig struct {
+	// The maximum number of cached replies. When the cache is full, the
+	// least recently used reply is evicted (default: 1000).
+	MaxEntries int
+
+	// The ttl for replies that do not specify the usrv.PropertyMaxAge
+	// property. If zero, such replies are not cached.
+	DefaultTTL time.Duration
+
+	// The request properties whose values are included in the cache key
+	// in addition to the endpoint and the request content.
+	KeyProperties []string
+
+	// Share cached replies between all senders. By default the request
+	// sender is part of the cache key so that replies computed for one
+	// caller are never served to another. Only enable this option for
+	// endpoints whose replies do not depend on the caller's identity.
+	SharedReplies bool
+}
+
+type cacheEntry struct {
+	key     string
+	reply   *StoredReply
+	expires time.Time
+}
+
+// The ResponseCache caches successful replies generated by the handlers it
+// wraps. Replies are keyed on a hash of the request sender (unless
+// CacheConfig.SharedReplies is set), the target endpoint, the request content
+// and the names and values of the configured key properties.
+//
+// Handlers control caching by setting the usrv.PropertyMaxAge property on the
+// response to the number of seconds that the reply may be cached; a value of
+// 0 disables caching for that reply. Error replies are never cached.
+//
+// All replies served by the wrapped handlers are tagged with the
+// usrv.PropertyCacheStatus property.
+type ResponseCache struct {
+	config CacheConfig
+
+	// A mutex for synchronized access to the cache entries
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// Create a new ResponseCache using the supplied configuration.
+func NewResponseCache(config CacheConfig) *ResponseCache {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 1000
+	}
+
+	return &ResponseCache{
+		config:  config,
+		entries: make(map[string]*list.Element, 0),
+		lru:     list.New(),
+	}
+}
+
+// Get the number of cached replies.
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Wrap a handler so that its replies are cached.
+func (c *ResponseCache) Handler(handler usrv.Handler) usrv.Handler {
+	return func(req, res usrv.Message) {
+		key := c.keyFor(req)
+
+		if reply := c.get(key); reply != nil {
+			applyStoredReply(reply, res)
+			res.Property().Set(usrv.PropertyCacheStatus, CacheHit)
+			return
+		}
+
+		handler(req, res)
+
+		if ttl := c.ttlFor(res); ttl > 0 {
+			c.put(key, captureReply(res), ttl)
+		}
+		res.Property().Set(usrv.PropertyCacheStatus, CacheMiss)
+	}
+}
+
+// Calculate the cache key for a request.
+func (c *ResponseCache) keyFor(req usrv.Message) string {
+	hash := sha256.New()
+	content, _ := req.Content()
+	if !c.config.SharedReplies {
+		writeKeyField(hash, []byte(req.From()))
+	}
+	writeKeyField(hash, []byte(req.To()))
+	writeKeyField(hash, content)
+	for _, name := range c.config.KeyProperties {
+		writeKeyField(hash, []byte(name))
+		writeKeyField(hash, []byte(req.Property().Get(name)))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Write a length-prefixed field to a key hash so that field boundaries are
+// unambiguous regardless of the field contents.
+func writeKeyField(hash io.Writer, field []byte) {
+	binary.Write(hash, binary.BigEndian, uint64(len(field)))
+	hash.Write(field)
+}
+
+// Get the ttl for a reply.
+func (c *ResponseCache) ttlFor(res usrv.Message) time.Duration {
+	if _, err := res.Content(); err != nil {
+		return 0
+	}
+
+	maxAge := res.Property().Get(usrv.PropertyMaxAge)
+	if maxAge == "" {
+		return c.config.DefaultTTL
+	}
+
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Lookup a cached reply and mark it as recently used.
+func (c *ResponseCache) get(key string) *StoredReply {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return nil
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry.reply
+}
+
+// Add a reply to the cache evicting the least recently used entries if
+// the cache is full.
+func (c *ResponseCache) put(key string, reply *StoredReply, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{
+		key:     key,
+		reply:   reply,
+		expires: time.Now().Add(ttl),
+	}
+
+	if elem, found := c.entries[key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
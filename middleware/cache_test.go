@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func newCacheRequest(content string, property usrv.Property) *usrvtest.Message {
+	return &usrvtest.Message{
+		F:    "api",
+		T:    "service",
+		P:    property,
+		Cont: []byte(content),
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	invocations := 0
+	handler := func(req, res usrv.Message) {
+		invocations++
+		res.Property().Set(usrv.PropertyMaxAge, "60")
+		res.SetContent([]byte(fmt.Sprintf("%d", invocations)), nil)
+	}
+
+	cache := NewResponseCache(CacheConfig{
+		KeyProperties: []string{"lang"},
+	})
+	cachedHandler := cache.Handler(handler)
+
+	spec := []struct {
+		content    string
+		lang       string
+		expContent string
+		expStatus  string
+	}{
+		{"req1", "en", "1", CacheMiss},
+		{"req1", "en", "1", CacheHit},
+		{"req2", "en", "2", CacheMiss},
+		{"req1", "de", "3", CacheMiss},
+		{"req2", "en", "2", CacheHit},
+	}
+
+	for idx, s := range spec {
+		res := &usrvtest.Message{P: make(usrv.Property, 0)}
+		cachedHandler(newCacheRequest(s.content, usrv.Property{"lang": s.lang}), res)
+
+		if string(res.Cont) != s.expContent {
+			t.Fatalf("[spec %d] Expected reply content to be %s; got %s", idx, s.expContent, string(res.Cont))
+		}
+		if status := res.P.Get(usrv.PropertyCacheStatus); status != s.expStatus {
+			t.Fatalf("[spec %d] Expected cache status to be %s; got %s", idx, s.expStatus, status)
+		}
+	}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	var maxAge string
+	var failWith error
+	invocations := 0
+	handler := func(req, res usrv.Message) {
+		invocations++
+		if maxAge != "" {
+			res.Property().Set(usrv.PropertyMaxAge, maxAge)
+		}
+		res.SetContent([]byte("OK"), failWith)
+	}
+
+	cache := NewResponseCache(CacheConfig{
+		DefaultTTL: time.Millisecond,
+	})
+	cachedHandler := cache.Handler(handler)
+
+	// Replies without max-age should expire after the default ttl
+	cachedHandler(newCacheRequest("req1", nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	<-time.After(5 * time.Millisecond)
+	cachedHandler(newCacheRequest("req1", nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	if invocations != 2 {
+		t.Fatalf("Expected cached reply to expire; handler invoked %d times", invocations)
+	}
+
+	// A max-age of 0 disables caching
+	maxAge = "0"
+	cachedHandler(newCacheRequest("req2", nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	cachedHandler(newCacheRequest("req2", nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	if invocations != 4 {
+		t.Fatalf("Expected reply with max-age 0 not to be cached; handler invoked %d times", invocations)
+	}
+
+	// Errors should never be cached
+	maxAge = "60"
+	failWith = fmt.Errorf("An error")
+	cachedHandler(newCacheRequest("req3", nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	cachedHandler(newCacheRequest("req3", nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	if invocations != 6 {
+		t.Fatalf("Expected error reply not to be cached; handler invoked %d times", invocations)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	handler := func(req, res usrv.Message) {
+		content, _ := req.Content()
+		res.SetContent(content, nil)
+	}
+
+	cache := NewResponseCache(CacheConfig{
+		MaxEntries: 2,
+		DefaultTTL: time.Minute,
+	})
+	cachedHandler := cache.Handler(handler)
+
+	for _, content := range []string{"req1", "req2", "req1", "req3"} {
+		cachedHandler(newCacheRequest(content, nil), &usrvtest.Message{P: make(usrv.Property, 0)})
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("Expected cache to contain 2 entries; got %d", cache.Len())
+	}
+
+	// req2 was the least recently used entry and should have been evicted
+	spec := []struct {
+		content   string
+		expStatus string
+	}{
+		{"req1", CacheHit},
+		{"req2", CacheMiss},
+	}
+	for _, s := range spec {
+		res := &usrvtest.Message{P: make(usrv.Property, 0)}
+		cachedHandler(newCacheRequest(s.content, nil), res)
+		if status := res.P.Get(usrv.PropertyCacheStatus); status != s.expStatus {
+			t.Fatalf("Expected cache status for %s to be %s; got %s", s.content, s.expStatus, status)
+		}
+	}
+}
+
+func TestResponseCacheKeyBoundaries(t *testing.T) {
+	cache := NewResponseCache(CacheConfig{
+		KeyProperties: []string{"lang"},
+	})
+
+	// Moving bytes between the content and a property value must not
+	// produce the same key
+	key1 := cache.keyFor(newCacheRequest("x", usrv.Property{"lang": "y\x00z"}))
+	key2 := cache.keyFor(newCacheRequest("x\x00y", usrv.Property{"lang": "z"}))
+	if key1 == key2 {
+		t.Fatal("Expected requests with different content and properties to have different cache keys")
+	}
+}
+
+func TestResponseCacheSenders(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		invocations := 0
+		handler := func(req, res usrv.Message) {
+			invocations++
+			res.Property().Set(usrv.PropertyMaxAge, "60")
+			res.SetContent([]byte(req.From()), nil)
+		}
+
+		cachedHandler := NewResponseCache(CacheConfig{SharedReplies: shared}).Handler(handler)
+		for _, from := range []string{"api", "admin"} {
+			req := newCacheRequest("req1", nil)
+			req.F = from
+			cachedHandler(req, &usrvtest.Message{P: make(usrv.Property, 0)})
+		}
+
+		expInvocations := 2
+		if shared {
+			expInvocations = 1
+		}
+		if invocations != expInvocations {
+			t.Fatalf("[shared %t] Expected handler to be invoked %d times; got %d", shared, expInvocations, invocations)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// A reply stored by the Idempotent middleware.
+type StoredReply struct {
+	Content  []byte        `json:"content,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Property usrv.Property `json:"property,omitempty"`
+}
+
+// The IdempotencyStore interface is implemented by stores that can persist
+// replies for the Idempotent middleware.
+type IdempotencyStore interface {
+	// Get the stored reply for a key. Returns nil if the key is not
+	// present or has expired.
+	Get(key string) (*StoredReply, error)
+
+	// Store a reply for a key. The reply should expire after ttl.
+	Put(key string, reply *StoredReply, ttl time.Duration) error
+}
+
+// Tracks a request that is currently being executed.
+type inflightReply struct {
+	done  chan struct{}
+	reply *StoredReply
+}
+
+// Errors that are restored as their sentinel values when a stored reply is
+// returned to a duplicate request.
+var storedErrors = []error{
+	usrv.ErrServiceUnavailable,
+	usrv.ErrTimeout,
+	usrv.ErrCancelled,
+	usrv.ErrUnauthorized,
+	usrv.ErrPermissionDenied,
+	usrv.ErrInternal,
+}
+
+// Deduplicate requests that carry an idempotency key. The reply to the first
+// request with a particular key (its content, error and properties) is saved
+// to the store and is returned to any duplicate requests received before the
+// ttl expires, without invoking the handler. Duplicates that arrive while the
+// first request is still being processed wait for its result.
+//
+// Replies with transient errors (ErrTimeout, ErrServiceUnavailable and
+// ErrCancelled) are not stored so that the request can be safely retried.
+//
+// Keys are scoped to the request sender and endpoint. Requests without an
+// idempotency key are passed to the handler unmodified. If the store returns
+// an error, the request is processed as if no reply had been stored.
+func Idempotent(store IdempotencyStore, ttl time.Duration, handler usrv.Handler) usrv.Handler {
+	var mutex sync.Mutex
+	inflight := make(map[string]*inflightReply, 0)
+
+	return func(req, res usrv.Message) {
+		key := req.Property().Get(usrv.PropertyIdempotencyKey)
+		if key == "" {
+			handler(req, res)
+			return
+		}
+		storeKey := idempotencyStoreKey(req, key)
+
+		var pending *inflightReply
+		for {
+			mutex.Lock()
+			var found bool
+			pending, found = inflight[storeKey]
+			if !found {
+				pending = &inflightReply{done: make(chan struct{}, 0)}
+				inflight[storeKey] = pending
+				mutex.Unlock()
+				break
+			}
+			mutex.Unlock()
+
+			select {
+			case <-pending.done:
+			case <-usrv.MessageContext(req).Done():
+				res.SetContent(nil, usrv.ErrCancelled)
+				return
+			}
+
+			// If the request we were waiting on did not produce a
+			// reply that can be reused (e.g. it panicked or failed
+			// with a transient error), try again.
+			if pending.reply == nil {
+				continue
+			}
+
+			applyStoredReply(pending.reply, res)
+			return
+		}
+
+		defer func() {
+			mutex.Lock()
+			delete(inflight, storeKey)
+			mutex.Unlock()
+			close(pending.done)
+		}()
+
+		// Store lookups are performed by the request that owns the key
+		// so that slow stores do not block requests with other keys.
+		if stored, err := store.Get(storeKey); err == nil && stored != nil {
+			applyStoredReply(stored, res)
+			pending.reply = stored
+			return
+		}
+
+		handler(req, res)
+
+		if _, err := res.Content(); isTransientError(err) {
+			return
+		}
+
+		reply := captureReply(res)
+		store.Put(storeKey, reply, ttl)
+		pending.reply = reply
+	}
+}
+
+// Calculate the store key for a request with an idempotency key. The key is a
+// hash of the sender, the target endpoint and the idempotency key so that
+// keys supplied by one sender cannot collide with those of another.
+func idempotencyStoreKey(req usrv.Message, key string) string {
+	hash := sha256.New()
+	writeKeyField(hash, []byte(req.From()))
+	writeKeyField(hash, []byte(req.To()))
+	writeKeyField(hash, []byte(key))
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Check whether err indicates a failure that may not occur if the request
+// is retried.
+func isTransientError(err error) bool {
+	return err == usrv.ErrTimeout || err == usrv.ErrServiceUnavailable || err == usrv.ErrCancelled
+}
+
+// Create a StoredReply from a response message.
+func captureReply(res usrv.Message) *StoredReply {
+	content, err := res.Content()
+	reply := &StoredReply{
+		Content:  content,
+		Property: make(usrv.Property, 0),
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	for k, v := range res.Property() {
+		reply.Property[k] = v
+	}
+
+	return reply
+}
+
+// Populate a response message from a StoredReply.
+func applyStoredReply(reply *StoredReply, res usrv.Message) {
+	for k, v := range reply.Property {
+		res.Property().Set(k, v)
+	}
+
+	res.SetContent(reply.Content, storedError(reply.Error))
+}
+
+// Convert a stored error message back to an error, mapping well-known usrv
+// errors to their sentinel values.
+func storedError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, err := range storedErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// The interval between purges of expired entries from the idempotency stores.
+const idempotencyPurgeInterval = time.Minute
+
+type memoryStoreEntry struct {
+	reply   *StoredReply
+	expires time.Time
+}
+
+// An IdempotencyStore that keeps replies in memory.
+type MemoryIdempotencyStore struct {
+	entries   map[string]memoryStoreEntry
+	lastPurge time.Time
+
+	// A mutex for synchronized access to the stored entries
+	mu sync.Mutex
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries:   make(map[string]memoryStoreEntry, 0),
+		lastPurge: time.Now(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (*StoredReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, found := s.entries[key]
+	if !found {
+		return nil, nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		return nil, nil
+	}
+
+	return entry.reply, nil
+}
+
+func (s *MemoryIdempotencyStore) Put(key string, reply *StoredReply, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.entries[key] = memoryStoreEntry{
+		reply:   reply,
+		expires: now.Add(ttl),
+	}
+
+	// Periodically purge expired entries
+	if now.Sub(s.lastPurge) > idempotencyPurgeInterval {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastPurge = now
+	}
+
+	return nil
+}
+
+type fileStoreEntry struct {
+	Reply   *StoredReply `json:"reply"`
+	Expires time.Time    `json:"expires"`
+}
+
+// An IdempotencyStore that keeps each reply in a separate file inside a
+// directory. It can be used to preserve stored replies across restarts.
+// Expired entries are periodically removed when new replies are stored.
+type FileIdempotencyStore struct {
+	dir string
+
+	// A mutex for synchronized access to the purge timestamp
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+// Create a new file-backed store. The directory will be created if it does
+// not exist.
+func NewFileIdempotencyStore(dir string) (*FileIdempotencyStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileIdempotencyStore{dir: dir, lastPurge: time.Now()}, nil
+}
+
+func (s *FileIdempotencyStore) Get(key string) (*StoredReply, error) {
+	path := s.pathFor(key)
+	entry, err := readFileStoreEntry(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(entry.Expires) {
+		os.Remove(path)
+		return nil, nil
+	}
+
+	return entry.Reply, nil
+}
+
+func (s *FileIdempotencyStore) Put(key string, reply *StoredReply, ttl time.Duration) error {
+	data, err := json.Marshal(fileStoreEntry{
+		Reply:   reply,
+		Expires: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename it so readers never observe partial writes
+	tmpFile, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), s.pathFor(key))
+	if err != nil {
+		return err
+	}
+
+	s.purge()
+	return nil
+}
+
+// Remove expired entries if the purge interval has elapsed since the last purge.
+func (s *FileIdempotencyStore) purge() {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastPurge) <= idempotencyPurgeInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPurge = now
+	s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		entry, err := readFileStoreEntry(path)
+		if err == nil && now.After(entry.Expires) {
+			os.Remove(path)
+		}
+	}
+}
+
+// Read a stored entry from a file.
+func readFileStoreEntry(path string) (*fileStoreEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry fileStoreEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Map a key to a file path. Keys are hashed so they can contain any character.
+func (s *FileIdempotencyStore) pathFor(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+".json")
+}
@@ -0,0 +1,326 @@
+package middleware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func newIdempotentRequest(key string) *usrvtest.Message {
+	return &usrvtest.Message{
+		F: "api",
+		T: "service",
+		P: usrv.Property{usrv.PropertyIdempotencyKey: key},
+	}
+}
+
+func TestIdempotentMiddleware(t *testing.T) {
+	invocations := 0
+	handler := func(req, res usrv.Message) {
+		invocations++
+		res.Property().Set("foo", "bar")
+		res.SetContent([]byte(fmt.Sprintf("%d", invocations)), nil)
+	}
+
+	idempotentHandler := Idempotent(NewMemoryIdempotencyStore(), time.Minute, handler)
+
+	for i := 0; i < 2; i++ {
+		res := &usrvtest.Message{P: make(usrv.Property, 0)}
+		idempotentHandler(newIdempotentRequest("key1"), res)
+
+		if string(res.Cont) != "1" {
+			t.Fatalf("[attempt %d] Expected stored reply content '1'; got %s", i, string(res.Cont))
+		}
+		if res.P.Get("foo") != "bar" {
+			t.Fatalf("[attempt %d] Expected stored reply property 'foo' to be 'bar'; got %s", i, res.P.Get("foo"))
+		}
+	}
+
+	// Requests with a different key or without a key should reach the handler
+	res := &usrvtest.Message{P: make(usrv.Property, 0)}
+	idempotentHandler(newIdempotentRequest("key2"), res)
+	idempotentHandler(&usrvtest.Message{P: make(usrv.Property, 0)}, res)
+	if invocations != 3 {
+		t.Fatalf("Expected handler to be invoked 3 times; got %d", invocations)
+	}
+}
+
+func TestIdempotentMiddlewareStoresErrors(t *testing.T) {
+	invocations := 0
+	handler := func(req, res usrv.Message) {
+		invocations++
+		res.SetContent(nil, fmt.Errorf("An error"))
+	}
+
+	idempotentHandler := Idempotent(NewMemoryIdempotencyStore(), time.Minute, handler)
+
+	for i := 0; i < 2; i++ {
+		res := &usrvtest.Message{P: make(usrv.Property, 0)}
+		idempotentHandler(newIdempotentRequest("key1"), res)
+
+		if res.Err == nil || res.Err.Error() != "An error" {
+			t.Fatalf("[attempt %d] Expected stored reply error; got %v", i, res.Err)
+		}
+	}
+
+	if invocations != 1 {
+		t.Fatalf("Expected handler to be invoked once; got %d", invocations)
+	}
+}
+
+func TestIdempotentMiddlewareRestoresWellKnownErrors(t *testing.T) {
+	handler := func(req, res usrv.Message) {
+		res.SetContent(nil, usrv.ErrPermissionDenied)
+	}
+
+	idempotentHandler := Idempotent(NewMemoryIdempotencyStore(), time.Minute, handler)
+
+	for i := 0; i < 2; i++ {
+		res := &usrvtest.Message{P: make(usrv.Property, 0)}
+		idempotentHandler(newIdempotentRequest("key1"), res)
+
+		if res.Err != usrv.ErrPermissionDenied {
+			t.Fatalf("[attempt %d] Expected to get ErrPermissionDenied; got %v", i, res.Err)
+		}
+	}
+}
+
+func TestIdempotentMiddlewareSkipsTransientErrors(t *testing.T) {
+	invocations := 0
+	handler := func(req, res usrv.Message) {
+		invocations++
+		if invocations == 1 {
+			res.SetContent(nil, usrv.ErrTimeout)
+			return
+		}
+		res.SetContent([]byte("OK"), nil)
+	}
+
+	idempotentHandler := Idempotent(NewMemoryIdempotencyStore(), time.Minute, handler)
+
+	res := &usrvtest.Message{P: make(usrv.Property, 0)}
+	idempotentHandler(newIdempotentRequest("key1"), res)
+	if res.Err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", res.Err)
+	}
+
+	// The retry should reach the handler and its reply should be stored
+	for i := 0; i < 2; i++ {
+		res = &usrvtest.Message{P: make(usrv.Property, 0)}
+		idempotentHandler(newIdempotentRequest("key1"), res)
+		if res.Err != nil || string(res.Cont) != "OK" {
+			t.Fatalf("[attempt %d] Expected reply content 'OK'; got %q, %v", i, string(res.Cont), res.Err)
+		}
+	}
+
+	if invocations != 2 {
+		t.Fatalf("Expected handler to be invoked twice; got %d", invocations)
+	}
+}
+
+// A store whose lookups for a particular key block until released.
+type blockingIdempotencyStore struct {
+	*MemoryIdempotencyStore
+	blockKey string
+	release  chan struct{}
+}
+
+func (s *blockingIdempotencyStore) Get(key string) (*StoredReply, error) {
+	if key == s.blockKey {
+		<-s.release
+	}
+	return s.MemoryIdempotencyStore.Get(key)
+}
+
+func TestIdempotentMiddlewareSlowStore(t *testing.T) {
+	handler := func(req, res usrv.Message) {
+		res.SetContent([]byte("OK"), nil)
+	}
+
+	store := &blockingIdempotencyStore{
+		MemoryIdempotencyStore: NewMemoryIdempotencyStore(),
+		blockKey:               "api|service|key1",
+		release:                make(chan struct{}),
+	}
+	idempotentHandler := Idempotent(store, time.Minute, handler)
+
+	blockedDone := make(chan struct{})
+	go func() {
+		defer close(blockedDone)
+		idempotentHandler(newIdempotentRequest("key1"), &usrvtest.Message{P: make(usrv.Property, 0)})
+	}()
+
+	// Requests with other keys should not wait for the blocked lookup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		idempotentHandler(newIdempotentRequest("key2"), &usrvtest.Message{P: make(usrv.Property, 0)})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for request with a different key")
+	}
+
+	close(store.release)
+	<-blockedDone
+}
+
+func TestIdempotentMiddlewareConcurrentDuplicates(t *testing.T) {
+	var invocations int
+	trigger := make(chan struct{})
+	handler := func(req, res usrv.Message) {
+		invocations++
+		<-trigger
+		res.SetContent([]byte("OK"), nil)
+	}
+
+	idempotentHandler := Idempotent(NewMemoryIdempotencyStore(), time.Minute, handler)
+
+	var wg sync.WaitGroup
+	results := make([]*usrvtest.Message, 5)
+	for i := range results {
+		results[i] = &usrvtest.Message{P: make(usrv.Property, 0)}
+		wg.Add(1)
+		go func(res *usrvtest.Message) {
+			defer wg.Done()
+			idempotentHandler(newIdempotentRequest("key1"), res)
+		}(results[i])
+	}
+
+	<-time.After(10 * time.Millisecond)
+	close(trigger)
+	wg.Wait()
+
+	if invocations != 1 {
+		t.Fatalf("Expected handler to be invoked once; got %d", invocations)
+	}
+	for idx, res := range results {
+		if string(res.Cont) != "OK" {
+			t.Fatalf("[req %d] Expected reply content 'OK'; got %s", idx, string(res.Cont))
+		}
+	}
+}
+
+func TestIdempotentMiddlewareKeyBoundaries(t *testing.T) {
+	invocations := 0
+	handler := func(req, res usrv.Message) {
+		invocations++
+		res.SetContent([]byte(req.From()), nil)
+	}
+
+	idempotentHandler := Idempotent(NewMemoryIdempotencyStore(), time.Minute, handler)
+
+	// Requests whose fields concatenate to the same value must not share
+	// a stored reply
+	reqs := []*usrvtest.Message{
+		{F: "api|service", T: "ep", P: usrv.Property{usrv.PropertyIdempotencyKey: "key"}},
+		{F: "api", T: "service|ep", P: usrv.Property{usrv.PropertyIdempotencyKey: "key"}},
+	}
+	for idx, req := range reqs {
+		res := &usrvtest.Message{P: make(usrv.Property, 0)}
+		idempotentHandler(req, res)
+		if string(res.Cont) != req.F {
+			t.Fatalf("[req %d] Expected reply for sender %s; got %s", idx, req.F, string(res.Cont))
+		}
+	}
+	if invocations != 2 {
+		t.Fatalf("Expected handler to be invoked 2 times; got %d", invocations)
+	}
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	store.Put("key", &StoredReply{Content: []byte("OK")}, time.Millisecond)
+
+	<-time.After(5 * time.Millisecond)
+	reply, err := store.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil {
+		t.Fatalf("Expected stored reply to expire")
+	}
+}
+
+func TestFileIdempotencyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileIdempotencyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := store.Get("api|service|key")
+	if err != nil || reply != nil {
+		t.Fatalf("Expected no stored reply; got %v, %v", reply, err)
+	}
+
+	err = store.Put("api|service|key", &StoredReply{
+		Content:  []byte("OK"),
+		Error:    "An error",
+		Property: usrv.Property{"foo": "bar"},
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err = store.Get("api|service|key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply == nil || string(reply.Content) != "OK" || reply.Error != "An error" || reply.Property.Get("foo") != "bar" {
+		t.Fatalf("Stored reply does not match; got %v", reply)
+	}
+
+	// Expired entries should not be returned
+	err = store.Put("api|service|key", &StoredReply{}, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = store.Get("api|service|key")
+	if err != nil || reply != nil {
+		t.Fatalf("Expected stored reply to expire; got %v, %v", reply, err)
+	}
+}
+
+func TestFileIdempotencyStorePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileIdempotencyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put("expired", &StoredReply{}, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired entries should be removed once the purge interval elapses
+	store.lastPurge = time.Now().Add(-2 * idempotencyPurgeInterval)
+	if err := store.Put("key", &StoredReply{}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(store.pathFor("expired")); !os.IsNotExist(err) {
+		t.Fatalf("Expected expired entry to be purged; got %v", err)
+	}
+	if _, err := os.Stat(store.pathFor("key")); err != nil {
+		t.Fatalf("Expected entry to be kept; got %v", err)
+	}
+}
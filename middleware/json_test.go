@@ -49,6 +49,8 @@ func TestJsonHandlerErrorWrapping(t *testing.T) {
 			return fmt.Errorf("This is not the answer you are looking for")
 		} else if req.A == "0/0" {
 			panic(fmt.Errorf("Divide by zero"))
+		} else if req.A == "-1" {
+			panic(-1)
 		}
 		panic("42 is the ultimate answer")
 	}, true)
@@ -84,6 +86,16 @@ func TestJsonHandlerErrorWrapping(t *testing.T) {
 	if resMsg.Err == nil || resMsg.Err.Error() != "42 is the ultimate answer" {
 		t.Fatalf("Response message has unexpected error: %v", resMsg.Err)
 	}
+
+	// Test panic wrapping when panic is invoked with a non-string value
+	reqMsg = &usrvtest.Message{
+		Cont: []byte(`{"A":"-1"}`),
+	}
+	handler(reqMsg, resMsg)
+
+	if resMsg.Err == nil || resMsg.Err.Error() != "-1" {
+		t.Fatalf("Response message has unexpected error: %v", resMsg.Err)
+	}
 }
 
 func TestJsonHandlerPanics(t *testing.T) {
@@ -0,0 +1,374 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Policy rule effects.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// A policy rule matches requests based on the caller identity, the target
+// endpoint and the request properties. All fields except Effect may contain
+// glob patterns using the path.Match syntax. Unlike path.Match, "*" and "?"
+// also match "/" so that patterns can be applied to addresses such as
+// "host:port/endpoint" and URI identities such as "spiffe://domain/service".
+// Empty fields match any request.
+type PolicyRule struct {
+	// The rule effect; either "allow" or "deny".
+	Effect string `json:"effect"`
+
+	// Patterns for the caller identity. The rule matches if any pattern matches.
+	Callers []string `json:"callers,omitempty"`
+
+	// Patterns for the target endpoint. The rule matches if any pattern matches.
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// Patterns for request property values. The rule matches if all patterns match.
+	Properties map[string]string `json:"properties,omitempty"`
+
+	// Compiled patterns
+	compiled map[string]*regexp.Regexp
+}
+
+// An authorization policy. Requests matching at least one deny rule are denied.
+// Otherwise, requests matching at least one allow rule are allowed. Requests
+// that match no rules are handled according to the policy default.
+type Policy struct {
+	// The effect for requests that match no rules (default: "deny").
+	Default string `json:"default,omitempty"`
+
+	Rules []PolicyRule `json:"rules"`
+}
+
+// Parse and validate a JSON-encoded policy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	err := json.Unmarshal(data, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Default == "" {
+		policy.Default = PolicyDeny
+	}
+	if policy.Default != PolicyAllow && policy.Default != PolicyDeny {
+		return nil, fmt.Errorf("Invalid policy default %q", policy.Default)
+	}
+
+	for idx, rule := range policy.Rules {
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			return nil, fmt.Errorf("Rule %d: invalid effect %q", idx, rule.Effect)
+		}
+
+		patterns := append(append([]string{}, rule.Callers...), rule.Endpoints...)
+		for _, pattern := range rule.Properties {
+			patterns = append(patterns, pattern)
+		}
+		compiled := make(map[string]*regexp.Regexp, len(patterns))
+		for _, pattern := range patterns {
+			expr, err := compilePattern(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Rule %d: invalid pattern %q", idx, pattern)
+			}
+			compiled[pattern] = expr
+		}
+		policy.Rules[idx].compiled = compiled
+	}
+
+	return policy, nil
+}
+
+// Evaluate the policy for a request. Returns whether the request is allowed
+// and the index of the rule that determined the outcome or -1 if the policy
+// default was applied.
+func (p *Policy) Evaluate(caller, endpoint string, property usrv.Property) (bool, int) {
+	allowRule := -1
+	for idx, rule := range p.Rules {
+		if !rule.matches(caller, endpoint, property) {
+			continue
+		}
+
+		if rule.Effect == PolicyDeny {
+			return false, idx
+		}
+		if allowRule == -1 {
+			allowRule = idx
+		}
+	}
+
+	if allowRule != -1 {
+		return true, allowRule
+	}
+	return p.Default == PolicyAllow, -1
+}
+
+func (r *PolicyRule) matches(caller, endpoint string, property usrv.Property) bool {
+	if !r.matchesAny(r.Callers, caller) || !r.matchesAny(r.Endpoints, endpoint) {
+		return false
+	}
+
+	for key, pattern := range r.Properties {
+		if !r.match(pattern, property.Get(key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether a value matches any of the patterns. An empty pattern list
+// matches any value.
+func (r *PolicyRule) matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if r.match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a value matches a pattern. Patterns of rules that were not
+// created by ParsePolicy are compiled on demand; invalid patterns never match.
+func (r *PolicyRule) match(pattern, value string) bool {
+	expr, found := r.compiled[pattern]
+	if !found {
+		var err error
+		if expr, err = compilePattern(pattern); err != nil {
+			return false
+		}
+	}
+	return expr.MatchString(value)
+}
+
+// Compile a glob pattern using the path.Match syntax to a regular expression
+// in which "*" and "?" also match "/".
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	// Reject malformed patterns using the path.Match rules
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	var expr strings.Builder
+	expr.WriteString(`(?s)^`)
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			expr.WriteString(`.*`)
+			pattern = pattern[1:]
+		case '?':
+			expr.WriteString(`.`)
+			pattern = pattern[1:]
+		case '[':
+			pattern = pattern[1:]
+			expr.WriteString(`[`)
+			if pattern[0] == '^' {
+				expr.WriteString(`^`)
+				pattern = pattern[1:]
+			}
+			for pattern[0] != ']' {
+				var lo, hi rune
+				lo, pattern = nextPatternRune(pattern)
+				expr.WriteString(quoteClassRune(lo))
+				if pattern[0] == '-' {
+					hi, pattern = nextPatternRune(pattern[1:])
+					expr.WriteString(`-` + quoteClassRune(hi))
+				}
+			}
+			expr.WriteString(`]`)
+			pattern = pattern[1:]
+		default:
+			var r rune
+			r, pattern = nextPatternRune(pattern)
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString(`$`)
+
+	return regexp.Compile(expr.String())
+}
+
+// Get the next, possibly escaped, rune of a pattern and the remaining pattern.
+func nextPatternRune(pattern string) (rune, string) {
+	if pattern[0] == '\\' {
+		pattern = pattern[1:]
+	}
+	r, size := utf8.DecodeRuneInString(pattern)
+	return r, pattern[size:]
+}
+
+// Quote a rune for use inside a regular expression character class.
+func quoteClassRune(r rune) string {
+	if strings.ContainsRune(`\]^-[`, r) {
+		return `\` + string(r)
+	}
+	return string(r)
+}
+
+// The PolicyEnforcer authorizes requests using a policy loaded from a JSON
+// file. The file can be periodically checked for changes and reloaded without
+// restarting the service.
+type PolicyEnforcer struct {
+	file   string
+	logger usrv.Logger
+
+	// A mutex for synchronized access to the policy
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+
+	stopChan chan struct{}
+}
+
+// Create a new PolicyEnforcer that loads its policy from file. If
+// reloadInterval is non-zero, the file will be checked for changes at the
+// specified interval and reloaded if modified. Policy decisions and reload
+// errors are logged to the supplied logger.
+func NewPolicyEnforcer(file string, reloadInterval time.Duration, logger usrv.Logger) (*PolicyEnforcer, error) {
+	e := &PolicyEnforcer{
+		file:     file,
+		logger:   logger,
+		stopChan: make(chan struct{}, 0),
+	}
+
+	err := e.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	if reloadInterval > 0 {
+		go e.watch(reloadInterval)
+	}
+
+	return e, nil
+}
+
+// Stop watching the policy file for changes.
+func (e *PolicyEnforcer) Close() error {
+	select {
+	case <-e.stopChan:
+	default:
+		close(e.stopChan)
+	}
+	return nil
+}
+
+// Load the policy file. If the file cannot be loaded, the current policy
+// remains in effect.
+func (e *PolicyEnforcer) Reload() error {
+	info, err := os.Stat(e.file)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(e.file)
+	if err != nil {
+		return err
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.policy = policy
+	e.modTime = info.ModTime()
+	e.mu.Unlock()
+
+	e.logger.Info("Loaded authorization policy", "file", e.file, "rules", len(policy.Rules))
+	return nil
+}
+
+// Periodically reload the policy file if its modification time changes.
+func (e *PolicyEnforcer) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Track the last seen modification time so that we only try to
+	// load (and report errors for) each version of the file once.
+	e.mu.RLock()
+	lastModTime := e.modTime
+	e.mu.RUnlock()
+
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(e.file)
+			if err != nil {
+				e.logger.Error("Could not stat authorization policy", "file", e.file, "error", err)
+				continue
+			}
+
+			if info.ModTime().Equal(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+
+			if err = e.Reload(); err != nil {
+				e.logger.Error("Could not reload authorization policy", "file", e.file, "error", err)
+			}
+		}
+	}
+}
+
+// Wrap a handler so that only requests allowed by the policy reach it.
+// Denied requests are rejected with ErrPermissionDenied.
+//
+// The caller identity is the subject of the token verified by the
+// Authenticate middleware or, if the request was not authenticated
+// by a token, the request sender.
+func (e *PolicyEnforcer) Handler(handler usrv.Handler) usrv.Handler {
+	return func(req, res usrv.Message) {
+		caller := req.From()
+		if claims := TokenClaims(req); claims != nil {
+			if subject, err := claims.GetSubject(); err == nil && subject != "" {
+				caller = subject
+			}
+		}
+
+		e.mu.RLock()
+		policy := e.policy
+		e.mu.RUnlock()
+
+		allowed, rule := policy.Evaluate(caller, req.To(), req.Property())
+		if !allowed {
+			e.logger.Warn(
+				"Request denied by policy",
+				"caller", caller,
+				"endpoint", req.To(),
+				"rule", rule,
+				"correlation_id", req.CorrelationId(),
+			)
+			res.SetContent(nil, usrv.ErrPermissionDenied)
+			return
+		}
+
+		e.logger.Debug(
+			"Request allowed by policy",
+			"caller", caller,
+			"endpoint", req.To(),
+			"rule", rule,
+			"correlation_id", req.CorrelationId(),
+		)
+		handler(req, res)
+	}
+}
@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+const testPolicy = `{
+	"default": "deny",
+	"rules": [
+		{"effect": "allow", "callers": ["api", "billing-*"], "endpoints": ["users.*"]},
+		{"effect": "allow", "callers": ["admin"]},
+		{"effect": "deny", "endpoints": ["users.delete"], "properties": {"tenant": "acme"}}
+	]
+}`
+
+func writePolicyFile(t *testing.T, file *os.File, policy string, modTime time.Time) {
+	err := ioutil.WriteFile(file.Name(), []byte(policy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(file.Name(), modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := []struct {
+		caller   string
+		endpoint string
+		property usrv.Property
+		allowed  bool
+		rule     int
+	}{
+		{"api", "users.get", nil, true, 0},
+		{"billing-eu", "users.get", nil, true, 0},
+		{"billing-eu", "orders.get", nil, false, -1},
+		{"admin", "orders.get", nil, true, 1},
+		{"api", "users.delete", usrv.Property{"tenant": "other"}, true, 0},
+		{"api", "users.delete", usrv.Property{"tenant": "acme"}, false, 2},
+		{"admin", "users.delete", usrv.Property{"tenant": "acme"}, false, 2},
+		{"unknown", "users.get", nil, false, -1},
+	}
+
+	for idx, s := range spec {
+		allowed, rule := policy.Evaluate(s.caller, s.endpoint, s.property)
+		if allowed != s.allowed || rule != s.rule {
+			t.Fatalf("[spec %d] Expected evaluation to return (%t, %d); got (%t, %d)", idx, s.allowed, s.rule, allowed, rule)
+		}
+	}
+}
+
+func TestPolicyEvaluateAddresses(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{
+		"default": "allow",
+		"rules": [
+			{"effect": "deny", "endpoints": ["*/admin"]},
+			{"effect": "deny", "callers": ["spiffe://example.org/ns/test/*"]},
+			{"effect": "allow", "callers": ["spiffe://example.org/*"], "endpoints": ["localhost:8080/users/*"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := []struct {
+		caller   string
+		endpoint string
+		allowed  bool
+		rule     int
+	}{
+		{"api", "localhost:8080/admin", false, 0},
+		{"spiffe://example.org/ns/prod/api", "localhost:8080/svc/admin", false, 0},
+		{"spiffe://example.org/ns/test/api", "localhost:8080/users/get", false, 1},
+		{"spiffe://example.org/ns/prod/api", "localhost:8080/users/get", true, 2},
+		{"api", "localhost:8080/users/get", true, -1},
+	}
+
+	for idx, s := range spec {
+		allowed, rule := policy.Evaluate(s.caller, s.endpoint, nil)
+		if allowed != s.allowed || rule != s.rule {
+			t.Fatalf("[spec %d] Expected evaluation to return (%t, %d); got (%t, %d)", idx, s.allowed, s.rule, allowed, rule)
+		}
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	spec := []struct {
+		pattern string
+		value   string
+		matched bool
+	}{
+		{"*", "localhost:8080/svc/ep", true},
+		{"svc/*", "svc/a/b", true},
+		{"svc/?", "svc//", true},
+		{"svc.[a-c]", "svc.b", true},
+		{"svc.[^a-c]", "svc.b", false},
+		{"svc.[\\-\\]]", "svc.]", true},
+		{"a.b", "axb", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"ünï*", "ünïcode", true},
+	}
+
+	for idx, s := range spec {
+		expr, err := compilePattern(s.pattern)
+		if err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+		if matched := expr.MatchString(s.value); matched != s.matched {
+			t.Fatalf("[spec %d] Expected pattern %q to match %q: %t; got %t", idx, s.pattern, s.value, s.matched, matched)
+		}
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	spec := []string{
+		`{"rules": [`,
+		`{"default": "maybe"}`,
+		`{"rules": [{"effect": "maybe"}]}`,
+		`{"rules": [{"effect": "allow", "callers": ["[a-"]}]}`,
+	}
+
+	for idx, s := range spec {
+		if _, err := ParsePolicy([]byte(s)); err == nil {
+			t.Fatalf("[spec %d] Expected policy parsing to fail", idx)
+		}
+	}
+}
+
+func TestPolicyEnforcer(t *testing.T) {
+	file, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	writePolicyFile(t, file, testPolicy, time.Now())
+
+	logger := &usrvtest.Logger{}
+	enforcer, err := NewPolicyEnforcer(file.Name(), 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enforcer.Close()
+
+	handler := enforcer.Handler(func(req, res usrv.Message) {
+		res.SetContent([]byte("OK"), nil)
+	})
+
+	res := &usrvtest.Message{}
+	handler(&usrvtest.Message{F: "api", T: "users.get", C: "123"}, res)
+	if res.Err != nil {
+		t.Fatalf("Expected request to be allowed; got %v", res.Err)
+	}
+
+	res = &usrvtest.Message{}
+	handler(&usrvtest.Message{F: "api", T: "orders.get", C: "456"}, res)
+	if res.Err != usrv.ErrPermissionDenied {
+		t.Fatalf("Expected request to fail with ErrPermissionDenied; got %v", res.Err)
+	}
+
+	entry := logger.Entries[len(logger.Entries)-1]
+	if entry.Level != "warn" || entry.Message != "Request denied by policy" {
+		t.Fatalf("Expected denial to be logged as a warning; got %s: %s", entry.Level, entry.Message)
+	}
+	exp := map[string]interface{}{
+		"caller":         "api",
+		"endpoint":       "orders.get",
+		"rule":           -1,
+		"correlation_id": "456",
+	}
+	for k, v := range exp {
+		if entry.Context[k] != v {
+			t.Fatalf("Expected logger key '%s' to contain value %v; got %v", k, v, entry.Context[k])
+		}
+	}
+}
+
+func TestPolicyEnforcerReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	modTime := time.Now().Add(-time.Minute)
+	writePolicyFile(t, file, testPolicy, modTime)
+
+	enforcer, err := NewPolicyEnforcer(file.Name(), time.Millisecond, usrv.NullLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enforcer.Close()
+
+	handler := enforcer.Handler(func(req, res usrv.Message) {})
+	req := &usrvtest.Message{F: "api", T: "orders.get"}
+
+	res := &usrvtest.Message{}
+	handler(req, res)
+	if res.Err != usrv.ErrPermissionDenied {
+		t.Fatalf("Expected request to fail with ErrPermissionDenied; got %v", res.Err)
+	}
+
+	// An invalid policy should be ignored
+	writePolicyFile(t, file, `{"default": "maybe"}`, modTime.Add(time.Second))
+	<-time.After(10 * time.Millisecond)
+	res = &usrvtest.Message{}
+	handler(req, res)
+	if res.Err != usrv.ErrPermissionDenied {
+		t.Fatalf("Expected invalid policy to be ignored; got %v", res.Err)
+	}
+
+	// Update the policy to allow everything
+	writePolicyFile(t, file, `{"default": "allow"}`, modTime.Add(2*time.Second))
+	deadline := time.Now().Add(time.Second)
+	for {
+		res = &usrvtest.Message{}
+		handler(req, res)
+		if res.Err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected updated policy to be loaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
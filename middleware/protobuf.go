@@ -1,7 +1,6 @@
 package middleware
 
 import (
-	"errors"
 	"reflect"
 
 	"github.com/achilleasa/usrv"
@@ -42,11 +41,7 @@ func ProtobufHandler(handler interface{}, recoverFromPanic bool) usrv.Handler {
 		if recoverFromPanic {
 			defer func() {
 				if err := recover(); err != nil {
-					if e, ok := err.(error); ok {
-						res.SetContent(nil, e)
-					} else {
-						res.SetContent(nil, errors.New(err.(string)))
-					}
+					res.SetContent(nil, panicToError(err))
 				}
 			}()
 		}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Recover from any panic() invocations in the wrapped handler. The panic value
+// and the stack trace are logged and the request fails with ErrInternal.
+func Recover(logger usrv.Logger, handler usrv.Handler) usrv.Handler {
+	return func(req, res usrv.Message) {
+		defer func() {
+			usrv.HandlePanic(logger, recover(), req, res)
+		}()
+
+		handler(req, res)
+	}
+}
+
+// Convert a value passed to panic() into an error.
+func panicToError(val interface{}) error {
+	if err, ok := val.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", val)
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	spec := []struct {
+		panicVal interface{}
+		expPanic string
+	}{
+		{"a string", "a string"},
+		{fmt.Errorf("an error"), "an error"},
+		{42, "42"},
+		{struct{ A int }{1}, "{1}"},
+	}
+
+	for idx, s := range spec {
+		logger := &usrvtest.Logger{}
+		handler := Recover(logger, func(req, res usrv.Message) {
+			panic(s.panicVal)
+		})
+
+		req := &usrvtest.Message{F: "api", T: "service", C: "123"}
+		res := &usrvtest.Message{}
+		handler(req, res)
+
+		if res.Err != usrv.ErrInternal {
+			t.Fatalf("[spec %d] Expected request to fail with ErrInternal; got %v", idx, res.Err)
+		}
+
+		if len(logger.Entries) != 1 {
+			t.Fatalf("[spec %d] Expected to log 1 entry; got %d", idx, len(logger.Entries))
+		}
+		entry := logger.Entries[0]
+		if entry.Level != "error" {
+			t.Fatalf("[spec %d] Expected log entry level to be 'error'; got %s", idx, entry.Level)
+		}
+		if entry.Context["panic"] != s.expPanic {
+			t.Fatalf("[spec %d] Expected logger key 'panic' to contain value %v; got %v", idx, s.expPanic, entry.Context["panic"])
+		}
+		if entry.Context["correlation_id"] != req.C {
+			t.Fatalf("[spec %d] Expected logger key 'correlation_id' to contain value %v; got %v", idx, req.C, entry.Context["correlation_id"])
+		}
+		stack, _ := entry.Context["stack"].(string)
+		if !strings.Contains(stack, "TestRecoverMiddleware") {
+			t.Fatalf("[spec %d] Expected logger key 'stack' to contain the stack trace; got %v", idx, stack)
+		}
+	}
+}
+
+func TestRecoverMiddlewareWithoutPanic(t *testing.T) {
+	logger := &usrvtest.Logger{}
+	handler := Recover(logger, func(req, res usrv.Message) {
+		res.SetContent([]byte("OK"), nil)
+	})
+
+	res := &usrvtest.Message{}
+	handler(&usrvtest.Message{}, res)
+
+	if res.Err != nil || string(res.Cont) != "OK" {
+		t.Fatalf("Expected request to complete successfully; got error %v", res.Err)
+	}
+	if len(logger.Entries) != 0 {
+		t.Fatalf("Expected to log 0 entries; got %d", len(logger.Entries))
+	}
+}
@@ -1,17 +1,55 @@
 package middleware
 
 import (
+	"sync"
 	"time"
 
 	"github.com/achilleasa/usrv"
 )
 
-// Throttle incoming requests so that only maxConcurrent requests can be
-// executed in parallel.  If a non-zero timeout is specified and a pending request
-// cannot be serviced within the specified timeout, it will be aborted with
-// ErrTimeout.
-func Throttle(maxConcurrent int, timeout time.Duration, handler usrv.Handler) usrv.Handler {
+// Runtime statistics for a Throttler.
+type ThrottleStats struct {
+	// Number of requests currently being executed.
+	Concurrent int
+
+	// Number of requests waiting for an execution slot.
+	Queued int
+
+	// Number of requests rejected because the wait queue was full.
+	Rejected uint64
+
+	// Number of queued requests aborted because they timed out.
+	TimedOut uint64
+
+	// Number of queued requests aborted because their context was cancelled.
+	Cancelled uint64
+}
 
+// The Throttler limits the number of requests that can be executed in parallel
+// by the handlers it wraps. All handlers wrapped by the same Throttler share the
+// same concurrency limit and wait queue.
+type Throttler struct {
+	tokens    chan struct{}
+	maxQueued int
+	timeout   time.Duration
+
+	// A mutex for synchronized access to the stats
+	mu    sync.Mutex
+	stats ThrottleStats
+}
+
+// Create a new Throttler that allows up to maxConcurrent requests to be
+// executed in parallel.
+//
+// Requests that cannot be serviced immediately are queued. If maxQueued is
+// >= 0 and the queue is full, the request is rejected with ErrServiceUnavailable.
+// A negative maxQueued value allows an unlimited number of requests to be queued.
+//
+// If a non-zero timeout is specified and a queued request cannot be serviced
+// within the specified timeout, it will be aborted with ErrTimeout. Queued
+// requests are aborted with ErrCancelled if their context is cancelled (e.g.
+// because the server is shutting down).
+func NewThrottler(maxConcurrent, maxQueued int, timeout time.Duration) *Throttler {
 	if maxConcurrent <= 0 {
 		panic("maxConcurrent should be > 0")
 	}
@@ -22,23 +60,98 @@ func Throttle(maxConcurrent int, timeout time.Duration, handler usrv.Handler) us
 		tokens <- struct{}{}
 	}
 
+	return &Throttler{
+		tokens:    tokens,
+		maxQueued: maxQueued,
+		timeout:   timeout,
+	}
+}
+
+// Get a snapshot of the throttler statistics.
+func (t *Throttler) Stats() ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats
+	stats.Concurrent = cap(t.tokens) - len(t.tokens)
+	return stats
+}
+
+// Wrap a handler so that its execution is throttled. Requests are only
+// executed without queueing if no other requests are waiting for a slot so
+// that queued requests are not starved by new ones.
+func (t *Throttler) Handler(handler usrv.Handler) usrv.Handler {
 	return func(req, res usrv.Message) {
+		t.mu.Lock()
+		if t.stats.Queued == 0 {
+			// Try to grab a token without queueing
+			select {
+			case <-t.tokens:
+				t.mu.Unlock()
+				t.serve(handler, req, res)
+				return
+			default:
+			}
+		}
+
+		if t.maxQueued >= 0 && t.stats.Queued >= t.maxQueued {
+			t.stats.Rejected++
+			t.mu.Unlock()
+			res.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+		t.stats.Queued++
+		t.mu.Unlock()
 
 		var timeoutChan <-chan time.Time
-		if timeout > 0 {
-			timeoutChan = time.After(timeout)
+		if t.timeout > 0 {
+			timer := time.NewTimer(t.timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
 		}
 
 		select {
-		case <-tokens:
-			defer func() {
-				tokens <- struct{}{}
-			}()
-
-			handler(req, res)
+		case <-t.tokens:
+			t.dequeue(nil)
+			t.serve(handler, req, res)
 		case <-timeoutChan:
+			t.dequeue(&t.stats.TimedOut)
 			res.SetContent(nil, usrv.ErrTimeout)
+		case <-usrv.MessageContext(req).Done():
+			t.dequeue(&t.stats.Cancelled)
+			res.SetContent(nil, usrv.ErrCancelled)
 		}
+	}
+}
 
+// Remove a request from the wait queue and optionally increment a counter.
+func (t *Throttler) dequeue(counter *uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.Queued--
+	if counter != nil {
+		*counter++
 	}
 }
+
+// Invoke the handler and return the execution token once it completes.
+func (t *Throttler) serve(handler usrv.Handler, req, res usrv.Message) {
+	defer func() {
+		t.tokens <- struct{}{}
+	}()
+
+	handler(req, res)
+}
+
+// Throttle incoming requests so that only maxConcurrent requests can be
+// executed in parallel.  If a non-zero timeout is specified and a pending request
+// cannot be serviced within the specified timeout, it will be aborted with
+// ErrTimeout. Pending requests are aborted with ErrCancelled if their context
+// is cancelled.
+//
+// This is a shortcut for wrapping a single handler with a Throttler that
+// does not limit the number of pending requests.
+func Throttle(maxConcurrent int, timeout time.Duration, handler usrv.Handler) usrv.Handler {
+	return NewThrottler(maxConcurrent, -1, timeout).Handler(handler)
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"golang.org/x/net/context"
 )
 
 func TestThrotleErrors(t *testing.T) {
@@ -25,132 +27,179 @@ func TestThrotleErrors(t *testing.T) {
 
 }
 
-/*
 func TestThrottleTimeout(t *testing.T) {
-
-	done := make(chan usrv.ResponseWriter)
 	trigger := make(chan struct{})
-
-	ep := usrv.Endpoint{
-		Name: "throttleTest",
-		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
-			rw.Header().Set("status", "ok")
-
-			// Block till we are triggered
-			<-trigger
-		}),
+	handler := func(req, res usrv.Message) {
+		// Block till we are triggered
+		<-trigger
+		res.SetContent([]byte("OK"), nil)
 	}
 
 	// Apply throttle (1 req, 1ms timeout)
-	err := Throttle(1, time.Millisecond*1)(&ep)
-	if err != nil {
-		t.Fatalf("Throttle invocation failed with error: %s", err.Error())
-	}
+	throttler := NewThrottler(1, -1, time.Millisecond*1)
+	throttledHandler := throttler.Handler(handler)
 
-	// Spawn requests
+	done := make(chan *usrvtest.Message)
 	for i := 0; i < 2; i++ {
 		go func() {
-			w := usrvtest.NewRecorder()
-			ep.Handler.Serve(context.Background(), w, nil)
-
-			// Signal that we are done
-			done <- w
+			res := &usrvtest.Message{}
+			throttledHandler(&usrvtest.Message{}, res)
+			done <- res
 		}()
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
+	// The second request should time out while the first one is blocked
+	res := <-done
+	if res.Err != usrv.ErrTimeout {
+		t.Fatalf("Expected request to fail with ErrTimeout; got %v", res.Err)
+	}
 
-		// Wait 2 ms. The second request should have timed-out by now
-		<-time.After(time.Millisecond * 2)
+	// Allow first request to finish
+	trigger <- struct{}{}
+	res = <-done
+	if res.Err != nil || string(res.Cont) != "OK" {
+		t.Fatalf("Expected request to complete successfully; got error %v", res.Err)
+	}
 
-		var rw usrv.ResponseWriter
-		rw = <-done
+	stats := throttler.Stats()
+	if stats.TimedOut != 1 {
+		t.Fatalf("Expected stats to report 1 timed-out request; got %d", stats.TimedOut)
+	}
+	if stats.Concurrent != 0 || stats.Queued != 0 {
+		t.Fatalf("Expected stats to report no active or queued requests; got %d active and %d queued", stats.Concurrent, stats.Queued)
+	}
+}
 
-		errMsg := rw.Header().Get("error")
-		if errMsg == nil {
-			t.Fatalf("Expected request to fail")
-		} else if errMsg.(string) != usrv.ErrTimeout.Error() {
-			t.Fatalf("Expected request to fail with ErrTimeout. Instead failed with: %s", errMsg)
-		}
+func TestThrottleCancellation(t *testing.T) {
+	trigger := make(chan struct{})
+	handler := func(req, res usrv.Message) {
+		// Block till we are triggered
+		<-trigger
+		res.SetContent([]byte("OK"), nil)
+	}
 
-		// Allow first request to finish
-		trigger <- struct{}{}
-		rw = <-done
+	// Apply throttle (1 req, no timeout)
+	throttler := NewThrottler(1, -1, 0)
+	throttledHandler := throttler.Handler(handler)
 
-		if rw.Header().Get("status") == nil || rw.Header().Get("error") != nil {
-			t.Fatalf("Expected request to complete successfully")
-		}
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	done := make(chan *usrvtest.Message)
 
-		wg.Done()
+	// Spawn the first request and wait till it starts executing
+	go func() {
+		res := &usrvtest.Message{}
+		throttledHandler(&usrvtest.Message{Ctx: ctx}, res)
+		done <- res
 	}()
+	waitForThrottleStats(t, throttler, 1, 0)
 
-	wg.Wait()
-}
-
-func TestThrottleCancellation(t *testing.T) {
+	// Spawn the second request and wait till it gets queued
+	go func() {
+		res := &usrvtest.Message{}
+		throttledHandler(&usrvtest.Message{Ctx: ctx}, res)
+		done <- res
+	}()
+	waitForThrottleStats(t, throttler, 1, 1)
 
-	done := make(chan usrv.ResponseWriter)
-	trigger := make(chan struct{})
-	ctx, cancelCtx := context.WithCancel(context.Background())
+	// Cancel context; the queued request should be aborted
+	cancelCtx()
+	res := <-done
+	if res.Err != usrv.ErrCancelled {
+		t.Fatalf("Expected request to fail with ErrCancelled; got %v", res.Err)
+	}
 
-	ep := usrv.Endpoint{
-		Name: "throttleTest",
-		Handler: usrv.HandlerFunc(func(ctx context.Context, rw usrv.ResponseWriter, req *usrv.Message) {
-			rw.Header().Set("status", "ok")
+	// Allow first request to finish
+	trigger <- struct{}{}
+	res = <-done
+	if res.Err != nil || string(res.Cont) != "OK" {
+		t.Fatalf("Expected request to complete successfully; got error %v", res.Err)
+	}
 
-			// Block till we are triggered
-			<-trigger
-		}),
+	stats := throttler.Stats()
+	if stats.Cancelled != 1 {
+		t.Fatalf("Expected stats to report 1 cancelled request; got %d", stats.Cancelled)
 	}
+}
 
-	// Apply throttle (1 req, no timeout)
-	err := Throttle(1, 0)(&ep)
-	if err != nil {
-		t.Fatalf("Throttle invocation failed with error: %s", err.Error())
+func TestThrottleQueueLimit(t *testing.T) {
+	trigger := make(chan struct{})
+	handler := func(req, res usrv.Message) {
+		// Block till we are triggered
+		<-trigger
+		res.SetContent([]byte("OK"), nil)
 	}
 
-	// Spawn requests
+	// Apply throttle (1 req, 1 queued req, no timeout)
+	throttler := NewThrottler(1, 1, 0)
+	throttledHandler := throttler.Handler(handler)
+
+	done := make(chan *usrvtest.Message)
 	for i := 0; i < 2; i++ {
 		go func() {
-			w := usrvtest.NewRecorder()
-			ep.Handler.Serve(ctx, w, nil)
-
-			// Signal that we are done
-			done <- w
+			res := &usrvtest.Message{}
+			throttledHandler(&usrvtest.Message{}, res)
+			done <- res
 		}()
+		waitForThrottleStats(t, throttler, 1, i)
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		// Cancel context
-		cancelCtx()
-		var rw usrv.ResponseWriter
-		rw = <-done
-
-		errMsg := rw.Header().Get("error")
-		if errMsg == nil {
-			t.Fatalf("Expected request to fail")
-		} else if errMsg.(string) != usrv.ErrCancelled.Error() {
-			t.Fatalf("Expected request to fail with ErrCancelled. Instead failed with: %s", errMsg)
-		}
+	// The queue is full; the next request should be rejected immediately
+	res := &usrvtest.Message{}
+	throttledHandler(&usrvtest.Message{}, res)
+	if res.Err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected request to fail with ErrServiceUnavailable; got %v", res.Err)
+	}
 
-		// Allow first request to finish
-		trigger <- struct{}{}
-		rw = <-done
+	stats := throttler.Stats()
+	if stats.Rejected != 1 {
+		t.Fatalf("Expected stats to report 1 rejected request; got %d", stats.Rejected)
+	}
 
-		if rw.Header().Get("status") == nil || rw.Header().Get("error") != nil {
-			t.Fatalf("Expected request to complete successfully")
+	// Allow both requests to finish
+	for i := 0; i < 2; i++ {
+		trigger <- struct{}{}
+		res = <-done
+		if res.Err != nil || string(res.Cont) != "OK" {
+			t.Fatalf("Expected request to complete successfully; got error %v", res.Err)
 		}
+	}
+}
 
-		wg.Done()
-	}()
+func TestThrottleQueuedRequestsFirst(t *testing.T) {
+	served := false
+	handler := func(req, res usrv.Message) {
+		served = true
+	}
+
+	// Apply throttle (1 req, 1 queued req, no timeout)
+	throttler := NewThrottler(1, 1, 0)
+	throttledHandler := throttler.Handler(handler)
+
+	// Simulate a queued request that has not yet picked up the free
+	// execution slot; new requests should not skip ahead of it
+	throttler.stats.Queued = 1
+
+	res := &usrvtest.Message{}
+	throttledHandler(&usrvtest.Message{}, res)
+	if served || res.Err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected request to be rejected while another request is queued; got error %v", res.Err)
+	}
+}
+
+// Poll the throttler till it reports the expected number of active and queued requests.
+func waitForThrottleStats(t *testing.T, throttler *Throttler, concurrent, queued int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		stats := throttler.Stats()
+		if stats.Concurrent == concurrent && stats.Queued == queued {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
 
-	wg.Wait()
+	stats := throttler.Stats()
+	t.Fatalf("Expected throttler to report %d active and %d queued requests; got %d and %d", concurrent, queued, stats.Concurrent, stats.Queued)
 }
-*/
 
 func catchPanicInThrottleMiddleware(maxConcurrent int, timeout time.Duration, handler usrv.Handler, didPanic *bool) {
 	*didPanic = false
@@ -1,7 +1,10 @@
 package usrv
 
 import (
+	"fmt"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -13,6 +16,61 @@ type serverEndpoint struct {
 	name    string
 	msgChan <-chan Message
 	handler Handler
+
+	// The maximum execution time for the handler; 0 disables the timeout.
+	timeout time.Duration
+}
+
+// Endpoint options are passed to Server.Handle to customize endpoint behavior.
+type EndpointOption func(ep *serverEndpoint)
+
+// Limit the execution time for the endpoint handler. If the handler does not
+// complete within the timeout, its request context is cancelled and the
+// request fails with ErrTimeout. Any reply generated by the handler after
+// the timeout expires is discarded.
+func WithTimeout(timeout time.Duration) EndpointOption {
+	return func(ep *serverEndpoint) {
+		ep.timeout = timeout
+	}
+}
+
+// Server options are passed to NewServer to customize the server behavior.
+type ServerOption func(srv *Server)
+
+// Set the logger used by the server.
+func WithLogger(logger Logger) ServerOption {
+	return func(srv *Server) {
+		srv.logger = logger
+	}
+}
+
+// Recover from any panic() invocations in endpoint handlers. The panic value
+// and the stack trace are logged and the request fails with ErrInternal.
+// Without this option, a panicking handler crashes the process.
+func WithPanicRecovery() ServerOption {
+	return func(srv *Server) {
+		srv.recoverPanics = true
+	}
+}
+
+// Handle a value recovered from a panic in the handler for req. The panic
+// value and the stack trace are logged and the request fails with ErrInternal.
+// It should be passed the result of recover() from a deferred function; nil
+// values are ignored.
+func HandlePanic(logger Logger, val interface{}, req, res Message) {
+	if val == nil {
+		return
+	}
+
+	logger.Error(
+		"Recovered from panic",
+		"panic", fmt.Sprint(val),
+		"stack", string(debug.Stack()),
+		"from", req.From(),
+		"to", req.To(),
+		"correlation_id", req.CorrelationId(),
+	)
+	res.SetContent(nil, ErrInternal)
 }
 
 type Server struct {
@@ -25,21 +83,31 @@ type Server struct {
 	transport Transport
 
 	service string
+
+	logger        Logger
+	recoverPanics bool
 }
 
-func NewServer(service string, transport Transport) *Server {
+func NewServer(service string, transport Transport, options ...ServerOption) *Server {
 	ctx, cancelFn := context.WithCancel(context.Background())
-	return &Server{
+	srv := &Server{
 		ctx:         ctx,
 		ctxCancelFn: cancelFn,
 		endpoints:   make([]serverEndpoint, 0),
 		transport:   transport,
 		service:     service,
+		logger:      NullLogger,
 	}
+
+	for _, option := range options {
+		option(srv)
+	}
+
+	return srv
 }
 
 // Bind endpoint.
-func (srv *Server) Handle(endpoint string, handler Handler) error {
+func (srv *Server) Handle(endpoint string, handler Handler, options ...EndpointOption) error {
 	for _, existing := range srv.endpoints {
 		if existing.name == endpoint {
 			return ErrEndpointAlreadyBound
@@ -52,11 +120,16 @@ func (srv *Server) Handle(endpoint string, handler Handler) error {
 		return err
 	}
 
-	srv.endpoints = append(srv.endpoints, serverEndpoint{
+	ep := serverEndpoint{
 		name:    endpoint,
 		msgChan: msgChan,
 		handler: handler,
-	})
+	}
+	for _, option := range options {
+		option(&ep)
+	}
+
+	srv.endpoints = append(srv.endpoints, ep)
 
 	return nil
 }
@@ -95,13 +168,77 @@ func (srv *Server) serve(endpoint serverEndpoint) {
 		case <-srv.ctx.Done():
 			return
 		case msg := <-endpoint.msgChan:
-			go func(req Message) {
-				res := srv.transport.ReplyTo(req)
-				endpoint.handler(req, res)
-				srv.transport.Send(res, 0, false)
+			go srv.handleRequest(endpoint, msg)
+		}
+	}
+
+}
+
+// Process an incoming request and send back the reply.
+func (srv *Server) handleRequest(endpoint serverEndpoint, req Message) {
+	// Each request gets its own context which is cancelled when the
+	// handler returns, its timeout expires or the server shuts down.
+	var ctx context.Context
+	var cancelFn context.CancelFunc
+	if endpoint.timeout > 0 {
+		ctx, cancelFn = context.WithTimeout(srv.ctx, endpoint.timeout)
+	} else {
+		ctx, cancelFn = context.WithCancel(srv.ctx)
+	}
+	defer cancelFn()
+	ctx = ContextWithLogger(ctx, srv.requestLogger(req))
+
+	res := srv.transport.ReplyTo(req)
+	if endpoint.timeout == 0 {
+		srv.invoke(endpoint.handler, WithContext(req, ctx), res)
+		srv.transport.Send(res, 0, false)
+		return
+	}
 
-			}(msg)
+	doneChan := make(chan struct{}, 0)
+	go func() {
+		defer close(doneChan)
+		srv.invoke(endpoint.handler, WithContext(req, ctx), res)
+	}()
+
+	select {
+	case <-doneChan:
+		srv.transport.Send(res, 0, false)
+	case <-ctx.Done():
+		// Reply with a fresh message; the handler may still be writing to res
+		timeoutRes := srv.transport.ReplyTo(req)
+		if ctx.Err() == context.DeadlineExceeded {
+			timeoutRes.SetContent(nil, ErrTimeout)
+		} else {
+			timeoutRes.SetContent(nil, ErrCancelled)
 		}
+		srv.transport.Send(timeoutRes, 0, false)
+	}
+}
+
+// Create a logger that includes the request metadata in every entry.
+func (srv *Server) requestLogger(req Message) Logger {
+	args := []interface{}{
+		"correlation_id", req.CorrelationId(),
+		"from", req.From(),
+		"to", req.To(),
+	}
+	for _, key := range []string{PropertyTraceId, PropertySpanId} {
+		if val := req.Property().Get(key); val != "" {
+			args = append(args, key, val)
+		}
+	}
+
+	return LoggerWith(srv.logger, args...)
+}
+
+// Invoke an endpoint handler, optionally recovering from panics.
+func (srv *Server) invoke(handler Handler, req, res Message) {
+	if srv.recoverPanics {
+		defer func() {
+			HandlePanic(srv.logger, recover(), req, res)
+		}()
 	}
 
+	handler(req, res)
 }
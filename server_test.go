@@ -0,0 +1,135 @@
+package usrv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/transport"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func TestServerPanicRecovery(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	logger := &usrvtest.Logger{}
+	srv := usrv.NewServer("srv", tr, usrv.WithLogger(logger), usrv.WithPanicRecovery())
+	err := srv.Handle("ep1", func(req, res usrv.Message) {
+		panic(42)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client := usrv.NewClient("srv", tr)
+	resMsg := <-client.Send(client.NewMessage("test", "ep1"), time.Second)
+
+	_, err = resMsg.Content()
+	if err != usrv.ErrInternal {
+		t.Fatalf("Expected to get ErrInternal; got %v", err)
+	}
+
+	if len(logger.Entries) != 1 {
+		t.Fatalf("Expected to log 1 entry; got %d", len(logger.Entries))
+	}
+	if logger.Entries[0].Context["panic"] != "42" {
+		t.Fatalf("Expected logger key 'panic' to contain value 42; got %v", logger.Entries[0].Context["panic"])
+	}
+}
+
+func TestServerHandlerTimeout(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	cancelled := make(chan struct{}, 1)
+	srv := usrv.NewServer("srv", tr)
+	err := srv.Handle("ep1", func(req, res usrv.Message) {
+		// Block till the request context is cancelled
+		<-usrv.MessageContext(req).Done()
+		cancelled <- struct{}{}
+
+		// This late reply should be discarded
+		res.SetContent([]byte("late"), nil)
+	}, usrv.WithTimeout(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client := usrv.NewClient("srv", tr)
+	resMsg := <-client.Send(client.NewMessage("test", "ep1"), time.Second)
+
+	content, err := resMsg.Content()
+	if err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", err)
+	}
+	if content != nil {
+		t.Fatalf("Expected content to be nil; got %v", content)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected handler context to be cancelled")
+	}
+}
+
+func TestServerRequestLogger(t *testing.T) {
+	tr := transport.NewInMemory()
+	defer tr.Close()
+
+	logger := &usrvtest.Logger{}
+	srv := usrv.NewServer("srv", tr, usrv.WithLogger(logger))
+	err := srv.Handle("ep1", func(req, res usrv.Message) {
+		usrv.RequestLogger(req).Info("Handling request", "k1", "v1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client := usrv.NewClient("srv", tr)
+	reqMsg := client.NewMessage("test", "ep1")
+	reqMsg.Property().Set(usrv.PropertyTraceId, "trace-123")
+	<-client.Send(reqMsg, time.Second)
+
+	if len(logger.Entries) != 1 {
+		t.Fatalf("Expected to log 1 entry; got %d", len(logger.Entries))
+	}
+
+	exp := map[string]interface{}{
+		"correlation_id":     reqMsg.CorrelationId(),
+		"from":               "test",
+		"to":                 reqMsg.To(),
+		usrv.PropertyTraceId: "trace-123",
+		"k1":                 "v1",
+	}
+	for k, v := range exp {
+		if logger.Entries[0].Context[k] != v {
+			t.Fatalf("Expected logger key '%s' to contain value %v; got %v", k, v, logger.Entries[0].Context[k])
+		}
+	}
+	if _, found := logger.Entries[0].Context[usrv.PropertySpanId]; found {
+		t.Fatalf("Expected logger key '%s' to be omitted", usrv.PropertySpanId)
+	}
+}
+
+func TestRequestLoggerWithoutServer(t *testing.T) {
+	if usrv.RequestLogger(&usrvtest.Message{}) != usrv.NullLogger {
+		t.Fatalf("Expected RequestLogger to return NullLogger for messages without a logger")
+	}
+}
@@ -0,0 +1,161 @@
+package usrv
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+
+	"golang.org/x/net/context"
+)
+
+// Log levels for Trace and Fatal messages which have no log/slog equivalent.
+const (
+	LevelTrace = slog.LevelDebug - 4
+	LevelFatal = slog.LevelError + 4
+)
+
+// A Logger implementation that forwards log entries to a log/slog logger.
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// Create a Logger that forwards entries to a log/slog logger. The variadic
+// key/value args are passed to slog as attributes. Trace and Fatal entries are
+// logged using LevelTrace and LevelFatal; Fatal also terminates the process.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+func (l *slogLogger) Trace(msg string, args ...interface{}) {
+	l.logger.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+func (l *slogLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelDebug, msg, args...)
+}
+
+func (l *slogLogger) Info(msg string, args ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelInfo, msg, args...)
+}
+
+func (l *slogLogger) Warn(msg string, args ...interface{}) error {
+	l.logger.Log(context.Background(), slog.LevelWarn, msg, args...)
+	return errors.New(msg)
+}
+
+func (l *slogLogger) Error(msg string, args ...interface{}) error {
+	l.logger.Log(context.Background(), slog.LevelError, msg, args...)
+	return errors.New(msg)
+}
+
+func (l *slogLogger) Fatal(msg string, args ...interface{}) {
+	l.logger.Log(context.Background(), LevelFatal, msg, args...)
+	os.Exit(1)
+}
+
+// A log/slog handler that forwards records to a Logger.
+type loggerHandler struct {
+	logger Logger
+	level  slog.Leveler
+
+	// Attributes added via WithAttrs, already flattened to key/value args
+	args []interface{}
+
+	// The key prefix for attributes added by WithGroup
+	prefix string
+}
+
+// Create a log/slog handler that forwards records with a level >= level to
+// a Logger. If level is nil, all records are forwarded. Record levels are
+// mapped to the closest Logger method at or below them (e.g. records with a
+// level between LevelInfo and LevelWarn are logged using Info). Attributes
+// are passed as key/value args; attributes inside groups use dot-separated keys.
+func NewSlogHandler(logger Logger, level slog.Leveler) slog.Handler {
+	if level == nil {
+		level = LevelTrace
+	}
+
+	return &loggerHandler{
+		logger: logger,
+		level:  level,
+	}
+}
+
+func (h *loggerHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *loggerHandler) Handle(ctx context.Context, record slog.Record) error {
+	args := make([]interface{}, len(h.args), len(h.args)+2*record.NumAttrs())
+	copy(args, h.args)
+	record.Attrs(func(attr slog.Attr) bool {
+		args = appendAttr(args, h.prefix, attr)
+		return true
+	})
+
+	switch {
+	case record.Level < slog.LevelDebug:
+		h.logger.Trace(record.Message, args...)
+	case record.Level < slog.LevelInfo:
+		h.logger.Debug(record.Message, args...)
+	case record.Level < slog.LevelWarn:
+		h.logger.Info(record.Message, args...)
+	case record.Level < slog.LevelError:
+		h.logger.Warn(record.Message, args...)
+	case record.Level < LevelFatal:
+		h.logger.Error(record.Message, args...)
+	default:
+		h.logger.Fatal(record.Message, args...)
+	}
+
+	return nil
+}
+
+func (h *loggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	args := make([]interface{}, len(h.args), len(h.args)+2*len(attrs))
+	copy(args, h.args)
+	for _, attr := range attrs {
+		args = appendAttr(args, h.prefix, attr)
+	}
+
+	return &loggerHandler{
+		logger: h.logger,
+		level:  h.level,
+		args:   args,
+		prefix: h.prefix,
+	}
+}
+
+func (h *loggerHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return &loggerHandler{
+		logger: h.logger,
+		level:  h.level,
+		args:   h.args,
+		prefix: h.prefix + name + ".",
+	}
+}
+
+// Flatten an attribute into key/value args.
+func appendAttr(args []interface{}, prefix string, attr slog.Attr) []interface{} {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return args
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if attr.Key != "" {
+			groupPrefix = prefix + attr.Key + "."
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			args = appendAttr(args, groupPrefix, groupAttr)
+		}
+		return args
+	}
+
+	return append(args, prefix+attr.Key, attr.Value.Any())
+}
@@ -0,0 +1,82 @@
+package usrv_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"golang.org/x/net/context"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: usrv.LevelTrace})
+	logger := usrv.NewSlogLogger(slog.New(handler))
+
+	logger.Trace("Test", "k1", "v1")
+	logger.Debug("Test", "k1", "v1")
+	logger.Info("Test", "k1", "v1")
+	logger.Warn("Test", "k1", "v1")
+	if err := logger.Error("Test", "k1", "v1"); err == nil || err.Error() != "Test" {
+		t.Fatalf("Expected Error to return an error with the log message; got %v", err)
+	}
+
+	expLevels := []string{"DEBUG-4", "DEBUG", "INFO", "WARN", "ERROR"}
+	decoder := json.NewDecoder(&buf)
+	for idx, expLevel := range expLevels {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("[entry %d] %v", idx, err)
+		}
+		if entry["level"] != expLevel {
+			t.Fatalf("[entry %d] Expected level to be '%s'; got %v", idx, expLevel, entry["level"])
+		}
+		if entry["msg"] != "Test" || entry["k1"] != "v1" {
+			t.Fatalf("[entry %d] Unexpected entry contents: %v", idx, entry)
+		}
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+	logger := &usrvtest.Logger{}
+	slogger := slog.New(usrv.NewSlogHandler(logger, nil)).With("service", "srv")
+
+	slogger.Log(context.Background(), usrv.LevelTrace, "Test")
+	slogger.Debug("Test")
+	slogger.Info("Test", slog.Group("req", "id", 42))
+	slogger.WithGroup("res").Warn("Test", "len", 3)
+	slogger.Error("Test")
+	slogger.Log(context.Background(), usrv.LevelFatal, "Test")
+
+	levels := []string{"trace", "debug", "info", "warn", "error", "fatal"}
+	if len(logger.Entries) != len(levels) {
+		t.Fatalf("Expected logger to contain %d entries; got %d", len(levels), len(logger.Entries))
+	}
+	for idx, level := range levels {
+		entry := logger.Entries[idx]
+		if entry.Level != level {
+			t.Fatalf("[entry %d] Expected level to be '%s'; got %s", idx, level, entry.Level)
+		}
+		if entry.Context["service"] != "srv" {
+			t.Fatalf("[entry %d] Expected context key 'service' to be 'srv'; got %v", idx, entry.Context["service"])
+		}
+	}
+
+	if v := logger.Entries[2].Context["req.id"]; v != int64(42) {
+		t.Fatalf("Expected grouped attribute 'req.id' to be 42; got %v", v)
+	}
+	if v := logger.Entries[3].Context["res.len"]; v != int64(3) {
+		t.Fatalf("Expected grouped attribute 'res.len' to be 3; got %v", v)
+	}
+
+	// Records below the handler level should be dropped
+	logger.Entries = nil
+	slogger = slog.New(usrv.NewSlogHandler(logger, slog.LevelWarn))
+	slogger.Info("Test")
+	if len(logger.Entries) != 0 {
+		t.Fatalf("Expected records below the handler level to be dropped")
+	}
+}
@@ -25,3 +25,12 @@ type Transport interface {
 	// Create a message that serves as a reply to an incoming message
 	ReplyTo(message Message) Message
 }
+
+// Transports that can abort in-flight requests may optionally implement
+// this interface. Cancelling a request causes the reply channel returned
+// by Send to emit a reply with ErrCancelled (unless a reply has already been
+// received).
+type Canceler interface {
+	// Cancel an in-flight request previously passed to Send.
+	Cancel(message Message)
+}
@@ -0,0 +1,346 @@
+package transport
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Latency functions sample the delay to inject before delivering a request.
+type LatencyFunc func(rng *rand.Rand) time.Duration
+
+// Inject a fixed delay.
+func FixedLatency(delay time.Duration) LatencyFunc {
+	return func(rng *rand.Rand) time.Duration {
+		return delay
+	}
+}
+
+// Inject a delay uniformly distributed in the [min, max) range.
+func UniformLatency(min, max time.Duration) LatencyFunc {
+	return func(rng *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rng.Int63n(int64(max-min)))
+	}
+}
+
+// Inject a normally distributed delay. Negative samples are clamped to 0.
+func NormalLatency(mean, stdDev time.Duration) LatencyFunc {
+	return func(rng *rand.Rand) time.Duration {
+		delay := time.Duration(rng.NormFloat64()*float64(stdDev)) + mean
+		if delay < 0 {
+			return 0
+		}
+		return delay
+	}
+}
+
+// Inject an exponentially distributed delay. This distribution produces
+// mostly short delays with a long tail.
+func ExponentialLatency(mean time.Duration) LatencyFunc {
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+}
+
+// The faults to inject for requests to a service or endpoint. Rates are
+// probabilities in the [0, 1] range.
+type FaultConfig struct {
+	// The delay to inject before delivering each request (default: none).
+	Latency LatencyFunc
+
+	// The probability that a request is never delivered. The sender
+	// receives ErrTimeout once its timeout expires; requests without a
+	// timeout never complete.
+	DropRequestRate float64
+
+	// The probability that a request is delivered but its reply is
+	// discarded. The sender receives ErrTimeout once its timeout expires;
+	// requests without a timeout never complete.
+	DropReplyRate float64
+
+	// The probability that a request is delivered twice. The same request,
+	// with the same correlation id, is delivered again once the reply to
+	// the original delivery has been received; the reply to the duplicate
+	// delivery is discarded.
+	DuplicateRate float64
+
+	// The probability that the request fails with Error without being delivered.
+	ErrorRate float64
+
+	// The error for failed requests (default: ErrServiceUnavailable).
+	Error error
+}
+
+// The fault decisions for a single request.
+type faultPlan struct {
+	latency     time.Duration
+	dropRequest bool
+	dropReply   bool
+	duplicate   bool
+	err         error
+}
+
+// A Message wrapper that tracks the service and endpoint a request is addressed to.
+type faultMessage struct {
+	usrv.Message
+	service  string
+	endpoint string
+}
+
+// A transport wrapper that injects faults into outgoing requests. Faults are
+// configured per service and endpoint and all random decisions are made
+// using a seeded RNG so that test runs are reproducible.
+type FaultInjector struct {
+	transport usrv.Transport
+
+	// A mutex for synchronized access to the fault config and the RNG
+	sync.Mutex
+	rng    *rand.Rand
+	faults map[string]FaultConfig
+
+	// Cancellation channels for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]chan struct{}
+}
+
+// Wrap a transport with a fault injector that uses an RNG initialized with seed.
+func NewFaultInjector(transport usrv.Transport, seed int64) *FaultInjector {
+	return &FaultInjector{
+		transport: transport,
+		rng:       rand.New(rand.NewSource(seed)),
+		faults:    make(map[string]FaultConfig, 0),
+		pending:   make(map[usrv.Message]chan struct{}, 0),
+	}
+}
+
+// Set the faults to inject into requests to a service endpoint. If endpoint
+// is empty, the faults apply to all endpoints of the service that do not
+// define their own faults. If both service and endpoint are empty, the faults
+// apply to all requests that do not match a more specific config.
+func (f *FaultInjector) SetFaults(service, endpoint string, config FaultConfig) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.faults[service+"/"+endpoint] = config
+}
+
+// Remove all fault configs.
+func (f *FaultInjector) ClearFaults() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.faults = make(map[string]FaultConfig, 0)
+}
+
+// Sample the faults to inject for a request. Returns false if no faults are
+// configured for the request destination.
+func (f *FaultInjector) plan(service, endpoint string) (faultPlan, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	var config FaultConfig
+	var found bool
+	for _, key := range []string{service + "/" + endpoint, service + "/", "/"} {
+		if config, found = f.faults[key]; found {
+			break
+		}
+	}
+	if !found {
+		return faultPlan{}, false
+	}
+
+	plan := faultPlan{}
+	if config.Latency != nil {
+		plan.latency = config.Latency(f.rng)
+	}
+	if f.rng.Float64() < config.ErrorRate {
+		plan.err = config.Error
+		if plan.err == nil {
+			plan.err = usrv.ErrServiceUnavailable
+		}
+	}
+	plan.dropRequest = f.rng.Float64() < config.DropRequestRate
+	plan.dropReply = f.rng.Float64() < config.DropReplyRate
+	plan.duplicate = f.rng.Float64() < config.DuplicateRate
+
+	return plan, true
+}
+
+func (f *FaultInjector) SetLogger(logger usrv.Logger) {
+	f.transport.SetLogger(logger)
+}
+
+func (f *FaultInjector) Config(params map[string]string) error {
+	return f.transport.Config(params)
+}
+
+func (f *FaultInjector) Close() error {
+	return f.transport.Close()
+}
+
+func (f *FaultInjector) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	return f.transport.Bind(service, endpoint)
+}
+
+func (f *FaultInjector) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*faultMessage)
+	if !ok || !expectReply {
+		return f.transport.Send(unwrapFaultMessage(m), timeout, expectReply)
+	}
+
+	plan, found := f.plan(msg.service, msg.endpoint)
+	if !found {
+		return f.transport.Send(msg.Message, timeout, expectReply)
+	}
+
+	cancelChan := make(chan struct{}, 0)
+	f.pendingMutex.Lock()
+	f.pending[msg.Message] = cancelChan
+	f.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
+	go func() {
+		defer func() {
+			f.pendingMutex.Lock()
+			delete(f.pending, msg.Message)
+			f.pendingMutex.Unlock()
+		}()
+
+		resChan <- f.sendWithFaults(msg, timeout, plan, cancelChan)
+		close(resChan)
+	}()
+
+	return resChan
+}
+
+// Deliver a request applying the sampled faults and return the reply.
+func (f *FaultInjector) sendWithFaults(msg *faultMessage, timeout time.Duration, plan faultPlan, cancelChan <-chan struct{}) usrv.Message {
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	start := time.Now()
+
+	// Block until the timeout expires or the request is cancelled
+	waitForTimeout := func() usrv.Message {
+		select {
+		case <-timeoutChan:
+			return f.errorReply(msg, usrv.ErrTimeout)
+		case <-cancelChan:
+			return f.errorReply(msg, usrv.ErrCancelled)
+		}
+	}
+
+	if plan.latency > 0 {
+		select {
+		case <-time.After(plan.latency):
+		case <-timeoutChan:
+			return f.errorReply(msg, usrv.ErrTimeout)
+		case <-cancelChan:
+			return f.errorReply(msg, usrv.ErrCancelled)
+		}
+	}
+
+	if plan.err != nil {
+		return f.errorReply(msg, plan.err)
+	}
+	if plan.dropRequest {
+		return waitForTimeout()
+	}
+
+	var remaining time.Duration
+	if timeout > 0 {
+		remaining = timeout - time.Since(start)
+		if remaining <= 0 {
+			return f.errorReply(msg, usrv.ErrTimeout)
+		}
+	}
+
+	replyChan := f.transport.Send(msg.Message, remaining, true)
+	var res usrv.Message
+	select {
+	case res = <-replyChan:
+	case <-cancelChan:
+		if canceler, ok := f.transport.(usrv.Canceler); ok {
+			canceler.Cancel(msg.Message)
+		}
+		return f.errorReply(msg, usrv.ErrCancelled)
+	}
+
+	// Redeliver the same request so that receivers observe a duplicate
+	// with the original correlation id. The request is resent after the
+	// original delivery completes as transports track in-flight requests
+	// by message and correlation id.
+	if plan.duplicate {
+		var dupTimeout time.Duration
+		if timeout > 0 {
+			dupTimeout = timeout - time.Since(start)
+			if dupTimeout <= 0 {
+				dupTimeout = time.Nanosecond
+			}
+		}
+		go func() {
+			<-f.transport.Send(msg.Message, dupTimeout, true)
+		}()
+	}
+
+	if plan.dropReply {
+		return waitForTimeout()
+	}
+	return res
+}
+
+// Create a reply to a request that failed with err.
+func (f *FaultInjector) errorReply(msg *faultMessage, err error) usrv.Message {
+	res := f.transport.ReplyTo(msg.Message)
+	res.SetContent(nil, err)
+	return res
+}
+
+// Cancel an in-flight request.
+func (f *FaultInjector) Cancel(m usrv.Message) {
+	m = unwrapFaultMessage(m)
+
+	f.pendingMutex.Lock()
+	cancelChan, found := f.pending[m]
+	delete(f.pending, m)
+	f.pendingMutex.Unlock()
+
+	if found {
+		close(cancelChan)
+		return
+	}
+
+	if canceler, ok := f.transport.(usrv.Canceler); ok {
+		canceler.Cancel(m)
+	}
+}
+
+// Create a message to be delivered to a target endpoint
+func (f *FaultInjector) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return &faultMessage{
+		Message:  f.transport.MessageTo(from, toService, toEndpoint),
+		service:  toService,
+		endpoint: toEndpoint,
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (f *FaultInjector) ReplyTo(msg usrv.Message) usrv.Message {
+	return f.transport.ReplyTo(unwrapFaultMessage(msg))
+}
+
+// Get the message wrapped by a faultMessage.
+func unwrapFaultMessage(msg usrv.Message) usrv.Message {
+	if wrapped, ok := msg.(*faultMessage); ok {
+		return wrapped.Message
+	}
+	return msg
+}
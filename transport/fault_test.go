@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+// Bind an endpoint that echoes requests and count the number of invocations.
+func bindEchoEndpoint(t *testing.T, tr usrv.Transport, service, endpoint string) *int32 {
+	reqChan, err := tr.Bind(service, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var invocations int32
+	go func() {
+		for req := range reqChan {
+			atomic.AddInt32(&invocations, 1)
+			content, _ := req.Content()
+			res := tr.ReplyTo(req)
+			res.SetContent(content, nil)
+			tr.Send(res, 0, false)
+		}
+	}()
+
+	return &invocations
+}
+
+func TestFaultInjector(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "srv", func() usrv.Transport {
+		return NewFaultInjector(NewInMemory(), 1)
+	})
+}
+
+func TestFaultInjectorFaults(t *testing.T) {
+	expErr := fmt.Errorf("Injected error")
+
+	spec := []struct {
+		config         FaultConfig
+		expErr         error
+		expInvocations int32
+	}{
+		{FaultConfig{}, nil, 1},
+		{FaultConfig{ErrorRate: 1}, usrv.ErrServiceUnavailable, 0},
+		{FaultConfig{ErrorRate: 1, Error: expErr}, expErr, 0},
+		{FaultConfig{DropRequestRate: 1}, usrv.ErrTimeout, 0},
+		{FaultConfig{DropReplyRate: 1}, usrv.ErrTimeout, 1},
+		{FaultConfig{DuplicateRate: 1}, nil, 2},
+		{FaultConfig{Latency: FixedLatency(100 * time.Millisecond)}, usrv.ErrTimeout, 0},
+	}
+
+	for idx, s := range spec {
+		tr := NewFaultInjector(NewInMemory(), 1)
+		invocations := bindEchoEndpoint(t, tr, "srv", "ep1")
+		tr.SetFaults("srv", "ep1", s.config)
+
+		req := tr.MessageTo("test", "srv", "ep1")
+		req.SetContent([]byte("OK"), nil)
+		res := <-tr.Send(req, 20*time.Millisecond, true)
+
+		content, err := res.Content()
+		if err != s.expErr {
+			t.Fatalf("[spec %d] Expected error %v; got %v", idx, s.expErr, err)
+		}
+		if err == nil && string(content) != "OK" {
+			t.Fatalf("[spec %d] Expected response to be 'OK'; got '%s'", idx, string(content))
+		}
+		if res.CorrelationId() != req.CorrelationId() {
+			t.Fatalf("[spec %d] Expected res msg correlation id to be %s; got %s", idx, req.CorrelationId(), res.CorrelationId())
+		}
+
+		// Wait for any duplicate deliveries to be processed
+		<-time.After(10 * time.Millisecond)
+		if count := atomic.LoadInt32(invocations); count != s.expInvocations {
+			t.Fatalf("[spec %d] Expected endpoint to be invoked %d time(s); got %d", idx, s.expInvocations, count)
+		}
+		tr.Close()
+	}
+}
+
+func TestFaultInjectorDuplicateKeepsCorrelationId(t *testing.T) {
+	tr := NewFaultInjector(NewInMemory(), 1)
+	defer tr.Close()
+	tr.SetFaults("srv", "ep1", FaultConfig{DuplicateRate: 1})
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 2)
+	go func() {
+		for req := range reqChan {
+			received <- req.CorrelationId()
+			res := tr.ReplyTo(req)
+			res.SetContent([]byte("OK"), nil)
+			tr.Send(res, 0, false)
+		}
+	}()
+
+	req := tr.MessageTo("test", "srv", "ep1")
+	if _, err := (<-tr.Send(req, time.Second, true)).Content(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-received:
+			if id != req.CorrelationId() {
+				t.Fatalf("[delivery %d] Expected correlation id %s; got %s", i, req.CorrelationId(), id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("[delivery %d] Timed out waiting for request delivery", i)
+		}
+	}
+}
+
+func TestFaultInjectorLatency(t *testing.T) {
+	tr := NewFaultInjector(NewInMemory(), 1)
+	defer tr.Close()
+	bindEchoEndpoint(t, tr, "srv", "ep1")
+
+	delay := 20 * time.Millisecond
+	tr.SetFaults("srv", "ep1", FaultConfig{Latency: FixedLatency(delay)})
+
+	start := time.Now()
+	res := <-tr.Send(tr.MessageTo("test", "srv", "ep1"), time.Second, true)
+	if _, err := res.Content(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("Expected request to take at least %s; took %s", delay, elapsed)
+	}
+}
+
+func TestFaultInjectorScopes(t *testing.T) {
+	tr := NewFaultInjector(NewInMemory(), 1)
+	defer tr.Close()
+	for _, ep := range []string{"ep1", "ep2"} {
+		bindEchoEndpoint(t, tr, "srv1", ep)
+		bindEchoEndpoint(t, tr, "srv2", ep)
+	}
+
+	errGlobal := fmt.Errorf("global")
+	errService := fmt.Errorf("service")
+	tr.SetFaults("", "", FaultConfig{ErrorRate: 1, Error: errGlobal})
+	tr.SetFaults("srv1", "", FaultConfig{ErrorRate: 1, Error: errService})
+	tr.SetFaults("srv1", "ep2", FaultConfig{})
+
+	spec := []struct {
+		service  string
+		endpoint string
+		expErr   error
+	}{
+		{"srv1", "ep1", errService},
+		{"srv1", "ep2", nil},
+		{"srv2", "ep1", errGlobal},
+	}
+
+	for idx, s := range spec {
+		res := <-tr.Send(tr.MessageTo("test", s.service, s.endpoint), time.Second, true)
+		if _, err := res.Content(); err != s.expErr {
+			t.Fatalf("[spec %d] Expected error %v; got %v", idx, s.expErr, err)
+		}
+	}
+
+	tr.ClearFaults()
+	res := <-tr.Send(tr.MessageTo("test", "srv1", "ep1"), time.Second, true)
+	if _, err := res.Content(); err != nil {
+		t.Fatalf("Expected faults to be cleared; got error %v", err)
+	}
+}
+
+func TestFaultInjectorReproducible(t *testing.T) {
+	run := func(seed int64) []bool {
+		tr := NewFaultInjector(NewInMemory(), seed)
+		defer tr.Close()
+		bindEchoEndpoint(t, tr, "srv", "ep1")
+		tr.SetFaults("srv", "ep1", FaultConfig{ErrorRate: 0.5})
+
+		failed := make([]bool, 50)
+		for i := range failed {
+			res := <-tr.Send(tr.MessageTo("test", "srv", "ep1"), time.Second, true)
+			_, err := res.Content()
+			failed[i] = err != nil
+		}
+		return failed
+	}
+
+	run1, run2 := run(42), run(42)
+	for i := range run1 {
+		if run1[i] != run2[i] {
+			t.Fatalf("Expected runs with the same seed to inject the same faults; request %d differs", i)
+		}
+	}
+}
+
+func TestLatencyDistributions(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	spec := []struct {
+		latency  LatencyFunc
+		min, max time.Duration
+	}{
+		{FixedLatency(time.Millisecond), time.Millisecond, time.Millisecond},
+		{UniformLatency(time.Millisecond, 2*time.Millisecond), time.Millisecond, 2 * time.Millisecond},
+		{NormalLatency(time.Millisecond, 10*time.Millisecond), 0, time.Hour},
+		{ExponentialLatency(time.Millisecond), 0, time.Hour},
+	}
+
+	for idx, s := range spec {
+		for i := 0; i < 100; i++ {
+			if delay := s.latency(rng); delay < s.min || delay > s.max {
+				t.Fatalf("[spec %d] Expected delay to be in the [%s, %s] range; got %s", idx, s.min, s.max, delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Frame types used by stream-based transports.
+const (
+	frameRequest byte = 1
+	frameReply   byte = 2
+)
+
+// The default maximum size of an encoded frame.
+const defaultMaxFrameSize = 4 * 1024 * 1024
+
+// The initial buffer size for reading frames. Larger frames grow the buffer
+// as their data arrives.
+const frameReadChunk = 64 * 1024
+
+var (
+	errFrameTooLarge = errors.New("Frame exceeds maximum size")
+	errInvalidFrame  = errors.New("Invalid frame")
+
+	// Errors that are mapped back to the matching usrv error when decoding frames
+	wellKnownErrors = []error{
+		usrv.ErrServiceUnavailable,
+		usrv.ErrTimeout,
+		usrv.ErrCancelled,
+		usrv.ErrUnauthorized,
+		usrv.ErrPermissionDenied,
+		usrv.ErrInternal,
+	}
+)
+
+// A message frame exchanged by stream-based transports. Frames are encoded as
+// a big-endian uint32 length prefix followed by the frame type and the frame
+// fields. Strings are prefixed by a uint16 length; the properties are prefixed
+// by a uint16 count and the content occupies the remainder of the frame.
+type frame struct {
+	kind          byte
+	correlationId string
+	from          string
+	to            string
+	property      usrv.Property
+	err           string
+	content       []byte
+}
+
+// Write an encoded frame to w. Frames larger than maxSize are rejected.
+func writeFrame(w io.Writer, f *frame, maxSize int) error {
+	if len(f.property) > math.MaxUint16 {
+		return errFrameTooLarge
+	}
+	size := 1 + 2 + len(f.content)
+	for _, val := range []string{f.correlationId, f.from, f.to, f.err} {
+		if len(val) > math.MaxUint16 {
+			return errFrameTooLarge
+		}
+		size += 2 + len(val)
+	}
+	for k, v := range f.property {
+		if len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return errFrameTooLarge
+		}
+		size += 2 + len(k) + 2 + len(v)
+	}
+	if size > maxSize {
+		return errFrameTooLarge
+	}
+
+	buf := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	buf = append(buf, f.kind)
+	buf = appendFrameString(buf, f.correlationId)
+	buf = appendFrameString(buf, f.from)
+	buf = appendFrameString(buf, f.to)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.property)))
+	for k, v := range f.property {
+		buf = appendFrameString(buf, k)
+		buf = appendFrameString(buf, v)
+	}
+	buf = appendFrameString(buf, f.err)
+	buf = append(buf, f.content...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendFrameString(buf []byte, val string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(val)))
+	return append(buf, val...)
+}
+
+// Read and decode a frame from r. Frames larger than maxSize are rejected.
+func readFrame(r *bufio.Reader, maxSize int) (*frame, error) {
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(sizeBuf[:]))
+	if size > int64(maxSize) {
+		return nil, errFrameTooLarge
+	}
+
+	// Don't trust the size prefix for allocating the whole frame upfront;
+	// grow the buffer as the frame data arrives instead.
+	var buf bytes.Buffer
+	if size < frameReadChunk {
+		buf.Grow(int(size))
+	} else {
+		buf.Grow(frameReadChunk)
+	}
+	if _, err := io.CopyN(&buf, r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	dec := frameDecoder{buf: buf.Bytes()}
+	f := &frame{
+		kind:          dec.byte(),
+		correlationId: dec.string(),
+		from:          dec.string(),
+		to:            dec.string(),
+		property:      make(usrv.Property, 0),
+	}
+	for count := dec.uint16(); count > 0; count-- {
+		k := dec.string()
+		f.property[k] = dec.string()
+	}
+	f.err = dec.string()
+	f.content = dec.remainder()
+
+	if dec.invalid {
+		return nil, errInvalidFrame
+	}
+	return f, nil
+}
+
+// Decode frame fields from a buffer. Reads past the end of the buffer mark
+// the decoder as invalid and return zero values.
+type frameDecoder struct {
+	buf     []byte
+	invalid bool
+}
+
+func (d *frameDecoder) next(n int) []byte {
+	if d.invalid || len(d.buf) < n {
+		d.invalid = true
+		return nil
+	}
+	val := d.buf[:n]
+	d.buf = d.buf[n:]
+	return val
+}
+
+func (d *frameDecoder) byte() byte {
+	if val := d.next(1); val != nil {
+		return val[0]
+	}
+	return 0
+}
+
+func (d *frameDecoder) uint16() uint16 {
+	if val := d.next(2); val != nil {
+		return binary.BigEndian.Uint16(val)
+	}
+	return 0
+}
+
+func (d *frameDecoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+func (d *frameDecoder) remainder() []byte {
+	if d.invalid || len(d.buf) == 0 {
+		return nil
+	}
+	return d.buf
+}
+
+// Convert a frame error string to an error. Errors matching one of the usrv
+// errors are mapped to the matching error value.
+func frameError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, err := range wellKnownErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,630 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/achilleasa/usrv"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys used to encode message metadata. All other metadata entries,
+// except for the ones reserved by gRPC, are mapped to message properties.
+const (
+	grpcFromKey          = "usrv-from"
+	grpcCorrelationIdKey = "usrv-correlation-id"
+)
+
+// Mappings between usrv errors and gRPC status codes.
+var (
+	grpcErrorCodes = map[error]codes.Code{
+		usrv.ErrServiceUnavailable: codes.Unavailable,
+		usrv.ErrTimeout:            codes.DeadlineExceeded,
+		usrv.ErrCancelled:          codes.Canceled,
+		usrv.ErrUnauthorized:       codes.Unauthenticated,
+		usrv.ErrPermissionDenied:   codes.PermissionDenied,
+		usrv.ErrInternal:           codes.Internal,
+	}
+	grpcCodeErrors = map[codes.Code]error{
+		codes.Unavailable:      usrv.ErrServiceUnavailable,
+		codes.Unimplemented:    usrv.ErrServiceUnavailable,
+		codes.DeadlineExceeded: usrv.ErrTimeout,
+		codes.Canceled:         usrv.ErrCancelled,
+		codes.Unauthenticated:  usrv.ErrUnauthorized,
+		codes.PermissionDenied: usrv.ErrPermissionDenied,
+		codes.Internal:         usrv.ErrInternal,
+	}
+)
+
+// A gRPC codec that passes payloads through unmodified. Payloads are
+// typically protobuf-encoded messages; encoding and decoding them is left to
+// the endpoint handlers (see middleware.ProtobufHandler).
+type grpcRawCodec struct{}
+
+func (grpcRawCodec) Marshal(v interface{}) ([]byte, error) {
+	payload, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported payload type %T", v)
+	}
+	return *payload, nil
+}
+
+func (grpcRawCodec) Unmarshal(data []byte, v interface{}) error {
+	payload, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("Unsupported payload type %T", v)
+	}
+	*payload = append((*payload)[:0], data...)
+	return nil
+}
+
+// Use the name of the default codec so that the content type of requests
+// matches the one used by regular gRPC clients.
+func (grpcRawCodec) Name() string {
+	return "proto"
+}
+
+// The internal message type used by the grpc transport.
+type grpcMessage struct {
+	from          string
+	to            string
+	property      usrv.Property
+	correlationId string
+	content       []byte
+	err           error
+
+	// A channel for sending back the reply to an incoming request
+	replyChan chan usrv.Message
+}
+
+func (m *grpcMessage) From() string {
+	return m.from
+}
+func (m *grpcMessage) To() string {
+	return m.to
+}
+func (m *grpcMessage) Property() usrv.Property {
+	return m.property
+}
+func (m *grpcMessage) CorrelationId() string {
+	return m.correlationId
+}
+func (m *grpcMessage) Content() ([]byte, error) {
+	return m.content, m.err
+}
+func (m *grpcMessage) SetContent(content []byte, err error) {
+	m.content, m.err = content, err
+}
+
+type GrpcConfig map[string]string
+
+func NewGrpcConfig(serverPort int) GrpcConfig {
+	return GrpcConfig{
+		"port": fmt.Sprint(serverPort),
+	}
+}
+
+// Create a configuration for TLS. The server presents the supplied certificate
+// and outgoing connections verify server certificates against the CA bundle
+// in rootCAFile.
+func NewGrpcTlsConfig(serverPort int, certFile, certKeyFile, rootCAFile string) GrpcConfig {
+	return GrpcConfig{
+		"port":        fmt.Sprint(serverPort),
+		"certFile":    certFile,
+		"certKeyFile": certKeyFile,
+		"rootCAFile":  rootCAFile,
+	}
+}
+
+// A transport that bridges usrv services and gRPC services.
+//
+// Bound endpoints are exposed as methods of a generic gRPC service: endpoint
+// "ep" of service "pkg.Service" is served as the "/pkg.Service/ep" method.
+// Request and reply payloads are passed through as raw bytes and message
+// properties are mapped to gRPC metadata. Since gRPC metadata keys are case
+// insensitive, property keys are received in lower case.
+//
+// Remote services are addressed as "host:port/pkg.Service"; a message to
+// endpoint "Method" of that service invokes the "/pkg.Service/Method" method
+// of the gRPC server at host:port. The address prefix is ignored by Bind, so
+// that servers and clients can use the same service name.
+//
+// usrv errors are mapped to gRPC status codes and back; other errors are
+// sent with the Unknown status code and their message is preserved.
+type GrpcTransport struct {
+	logger      usrv.Logger
+	port        int
+	certFile    string
+	certKeyFile string
+	dialer      *net.Dialer
+	msgChans    map[string]chan usrv.Message
+
+	// TLS settings for the server; used to verify client certificates
+	tlsConfig *tls.Config
+
+	// TLS settings for outgoing connections
+	clientTlsConfig *tls.Config
+	useTls          bool
+
+	server *grpc.Server
+
+	// A mutex for synchronized access to the server instance and the bound endpoints
+	sync.Mutex
+
+	// A mutex for synchronized access to the client connections
+	connMutex sync.Mutex
+	conns     map[string]*grpc.ClientConn
+
+	// Cancel functions for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]context.CancelFunc
+}
+
+func NewGrpc() *GrpcTransport {
+	return &GrpcTransport{
+		logger:   usrv.NullLogger,
+		dialer:   &net.Dialer{Timeout: defaultDialTimeout},
+		msgChans: make(map[string]chan usrv.Message, 0),
+		conns:    make(map[string]*grpc.ClientConn, 0),
+		pending:  make(map[usrv.Message]context.CancelFunc, 0),
+	}
+}
+
+func (t *GrpcTransport) SetLogger(logger usrv.Logger) {
+	t.logger = logger
+}
+
+// Configure the transport. The following params are supported:
+//   - port: the port to listen on for incoming gRPC requests
+//   - certFile, certKeyFile: serve TLS connections using this certificate
+//   - clientCAFile, clientAuth: verify client certificates (see NewMutualTlsConfig)
+//   - clientCertFile, clientCertKeyFile, rootCAFile: use TLS for outgoing
+//     connections, presenting a client certificate and/or verifying server
+//     certificates against a custom CA bundle
+//   - dialTimeout: the timeout for establishing connections (default: 1s)
+//
+// If client certificate verification is enabled (clientCAFile), the sender of
+// incoming requests is the identity of the verified client certificate
+// instead of the sender specified in the request metadata. With clientAuth
+// set to optional, requests without a certificate have an empty sender.
+func (t *GrpcTransport) Config(params map[string]string) error {
+	dialer, err := newDialer(params)
+	if err != nil {
+		return err
+	}
+
+	t.connMutex.Lock()
+	t.dialer = dialer
+	t.connMutex.Unlock()
+
+	t.certFile = ""
+	t.certKeyFile = ""
+	t.tlsConfig = nil
+	t.clientTlsConfig = nil
+	t.useTls = false
+
+	portVal, portDefined := params["port"]
+	if portDefined {
+		port, err := strconv.Atoi(portVal)
+		if err != nil {
+			return err
+		}
+		t.port = port
+	}
+
+	certFile := params["certFile"]
+	certKeyFile := params["certKeyFile"]
+	if certFile != "" && certKeyFile != "" {
+		t.certFile = certFile
+		t.certKeyFile = certKeyFile
+
+		tlsConfig, err := newServerTlsConfig(params)
+		if err != nil {
+			return err
+		}
+		t.tlsConfig = tlsConfig
+	}
+
+	clientTlsConfig, err := newClientTlsConfig(params)
+	if err != nil {
+		return err
+	}
+	if clientTlsConfig != nil {
+		t.clientTlsConfig = clientTlsConfig
+		t.useTls = true
+	}
+
+	if portDefined {
+		t.logger.Info("Configuration changed", "port", t.port, "tls", t.certFile != "")
+		return t.listen()
+	}
+
+	return nil
+}
+
+// Close the transport. The server and all client connections are closed
+// and all endpoints are unbound.
+func (t *GrpcTransport) Close() error {
+	t.Lock()
+	if t.server != nil {
+		t.server.Stop()
+		t.server = nil
+	}
+	t.msgChans = make(map[string]chan usrv.Message, 0)
+	t.Unlock()
+
+	t.connMutex.Lock()
+	for target, conn := range t.conns {
+		conn.Close()
+		delete(t.conns, target)
+	}
+	t.connMutex.Unlock()
+
+	return nil
+}
+
+// Bind service endpoint. Binding an endpoint that is already bound fails
+// with ErrEndpointAlreadyBound.
+func (t *GrpcTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	err := t.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip the address prefix from the service name
+	if idx := strings.Index(service, "/"); idx != -1 {
+		service = service[idx+1:]
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	method := fmt.Sprintf("/%s/%s", service, endpoint)
+	if _, found := t.msgChans[method]; found {
+		return nil, usrv.ErrEndpointAlreadyBound
+	}
+	t.msgChans[method] = make(chan usrv.Message, 0)
+	return t.msgChans[method], nil
+}
+
+func (t *GrpcTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*grpcMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	// Replies are sent back to the request handler
+	if msg.replyChan != nil {
+		msg.replyChan <- msg
+		return nil
+	}
+
+	var ctx context.Context
+	var cancelFn context.CancelFunc
+	if timeout > 0 {
+		ctx, cancelFn = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancelFn = context.WithCancel(context.Background())
+	}
+
+	t.pendingMutex.Lock()
+	t.pending[m] = cancelFn
+	t.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
+	go func() {
+		resMsg := &grpcMessage{
+			from:          msg.to,
+			to:            msg.from,
+			property:      make(usrv.Property, 0),
+			correlationId: msg.correlationId,
+		}
+
+		defer func() {
+			t.pendingMutex.Lock()
+			delete(t.pending, m)
+			t.pendingMutex.Unlock()
+			cancelFn()
+
+			resChan <- resMsg
+			close(resChan)
+		}()
+
+		target, method := splitGrpcAddress(msg.to)
+		conn, err := t.conn(target)
+		if err != nil {
+			t.logger.Error(
+				"Grpc request failed",
+				"from", msg.from,
+				"to", msg.to,
+				"err", err.Error(),
+			)
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		md := propertyMetadata(msg.property)
+		md.Set(grpcFromKey, msg.from)
+		md.Set(grpcCorrelationIdKey, msg.correlationId)
+
+		var header metadata.MD
+		var content []byte
+		reqContent := msg.content
+		err = conn.Invoke(
+			metadata.NewOutgoingContext(ctx, md),
+			method,
+			&reqContent,
+			&content,
+			grpc.Header(&header),
+			grpc.ForceCodec(grpcRawCodec{}),
+		)
+		resMsg.property = metadataProperty(header)
+		if err != nil && ctx.Err() != nil {
+			resMsg.SetContent(nil, contextError(ctx))
+			return
+		}
+		resMsg.SetContent(content, grpcError(err))
+	}()
+
+	return resChan
+}
+
+// Cancel an in-flight request.
+func (t *GrpcTransport) Cancel(m usrv.Message) {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	if cancelFn, found := t.pending[m]; found {
+		cancelFn()
+		delete(t.pending, m)
+	}
+}
+
+// Create a message to be delivered to a target endpoint
+func (t *GrpcTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return &grpcMessage{
+		from:          from,
+		to:            fmt.Sprintf("%s/%s", toService, toEndpoint),
+		property:      make(usrv.Property, 0),
+		correlationId: uuid.New(),
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *GrpcTransport) ReplyTo(msg usrv.Message) usrv.Message {
+	reqMsg, ok := msg.(*grpcMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	return &grpcMessage{
+		from:          reqMsg.to,
+		to:            reqMsg.from,
+		property:      make(usrv.Property, 0),
+		correlationId: reqMsg.correlationId,
+		replyChan:     reqMsg.replyChan,
+	}
+}
+
+// Handle an incoming gRPC request by delivering it to the endpoint bound to
+// the requested method.
+func (t *GrpcTransport) handleRequest(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+
+	t.Lock()
+	msgChan, found := t.msgChans[method]
+	t.Unlock()
+
+	if !found {
+		return status.Errorf(codes.Unimplemented, "Unknown method %s", method)
+	}
+
+	var content []byte
+	if err := stream.RecvMsg(&content); err != nil {
+		return err
+	}
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	reqMsg := &grpcMessage{
+		to:        strings.TrimPrefix(method, "/"),
+		property:  metadataProperty(md),
+		content:   content,
+		replyChan: make(chan usrv.Message, 1),
+	}
+	if t.tlsConfig != nil {
+		// Only trust the identity of a verified client certificate
+		if p, ok := peer.FromContext(stream.Context()); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				reqMsg.from = peerIdentity(&tlsInfo.State)
+			}
+		}
+	} else if vals := md.Get(grpcFromKey); len(vals) > 0 {
+		reqMsg.from = vals[0]
+	}
+	if vals := md.Get(grpcCorrelationIdKey); len(vals) > 0 {
+		reqMsg.correlationId = vals[0]
+	} else {
+		reqMsg.correlationId = uuid.New()
+	}
+
+	// Send to the bound endpoint listener and wait for reply. Stop waiting
+	// if the client aborts the request.
+	var resMsg usrv.Message
+	select {
+	case msgChan <- reqMsg:
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+	select {
+	case resMsg = <-reqMsg.replyChan:
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+
+	if len(resMsg.Property()) > 0 {
+		stream.SetHeader(propertyMetadata(resMsg.Property()))
+	}
+
+	content, err := resMsg.Content()
+	if err != nil {
+		return grpcStatus(err)
+	}
+	return stream.SendMsg(&content)
+}
+
+// Get a client connection to a gRPC server.
+func (t *GrpcTransport) conn(target string) (*grpc.ClientConn, error) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if conn, found := t.conns[target]; found {
+		return conn, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if t.useTls {
+		tlsConfig := t.clientTlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	dialer := t.dialer
+	conn, err := grpc.NewClient(
+		target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[target] = conn
+	return conn, nil
+}
+
+// Ensure that the transport is listening for incoming requests.
+func (t *GrpcTransport) listen() error {
+	t.Lock()
+	defer t.Unlock()
+
+	// Already listening
+	if t.server != nil {
+		return nil
+	}
+
+	if t.port == 0 {
+		return errMissingPort
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcRawCodec{}),
+		grpc.UnknownServiceHandler(t.handleRequest),
+	}
+	if t.certFile != "" && t.certKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.certKeyFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig := &tls.Config{}
+		if t.tlsConfig != nil {
+			tlsConfig = t.tlsConfig.Clone()
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", t.port))
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(opts...)
+	t.server = server
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != grpc.ErrServerStopped {
+			t.logger.Error("Grpc server exited", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// Split a message address into the target server address and the gRPC method.
+func splitGrpcAddress(to string) (target string, method string) {
+	idx := strings.Index(to, "/")
+	if idx == -1 {
+		return to, ""
+	}
+	return to[:idx], to[idx:]
+}
+
+// Convert message properties to gRPC metadata.
+func propertyMetadata(property usrv.Property) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range property {
+		md.Set(k, v)
+	}
+	return md
+}
+
+// Convert gRPC metadata to message properties. Metadata entries reserved by
+// gRPC or used to encode message metadata are skipped.
+func metadataProperty(md metadata.MD) usrv.Property {
+	property := make(usrv.Property, 0)
+	for k, vals := range md {
+		if len(vals) == 0 || strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		switch k {
+		case "content-type", "user-agent", "te", grpcFromKey, grpcCorrelationIdKey:
+			continue
+		}
+		property[k] = vals[0]
+	}
+	return property
+}
+
+// Convert an error to a gRPC status error.
+func grpcStatus(err error) error {
+	if code, found := grpcErrorCodes[err]; found {
+		return status.Error(code, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// Convert a gRPC status error to an error. Status codes that correspond to
+// usrv errors are mapped to the matching error value.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	if mapped, found := grpcCodeErrors[st.Code()]; found {
+		return mapped
+	}
+	return errors.New(st.Message())
+}
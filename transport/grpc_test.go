@@ -0,0 +1,251 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGrpcTransport(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "localhost:8097/srv", func() usrv.Transport {
+		tr := NewGrpc()
+		tr.Config(NewGrpcConfig(8097))
+		return tr
+	})
+}
+
+func TestGrpcTransportCallGrpcService(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:8098")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcSrv := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("db", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcSrv, healthSrv)
+	go grpcSrv.Serve(listener)
+	defer grpcSrv.Stop()
+
+	tr := NewGrpc()
+	defer tr.Close()
+	client := usrv.NewClient("localhost:8098/grpc.health.v1.Health", tr)
+
+	payload, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "db"})
+	reqMsg := client.NewMessage("test", "Check")
+	reqMsg.SetContent(payload, nil)
+	content, err := (<-client.Send(reqMsg, time.Second)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res healthpb.HealthCheckResponse
+	if err := proto.Unmarshal(content, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("Expected status NOT_SERVING; got %v", res.Status)
+	}
+
+	// Unknown services are reported as NotFound by the health server
+	payload, _ = proto.Marshal(&healthpb.HealthCheckRequest{Service: "unknown"})
+	reqMsg = client.NewMessage("test", "Check")
+	reqMsg.SetContent(payload, nil)
+	_, err = (<-client.Send(reqMsg, time.Second)).Content()
+	if err == nil || err.Error() != "unknown service" {
+		t.Fatalf("Expected to get 'unknown service' error; got %v", err)
+	}
+}
+
+func TestGrpcTransportServeGrpcClients(t *testing.T) {
+	tr := NewGrpc()
+	if err := tr.Config(NewGrpcConfig(8099)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	srv := usrv.NewServer("grpc.health.v1.Health", tr)
+	srv.Handle("Check", func(req, res usrv.Message) {
+		content, _ := req.Content()
+		var healthReq healthpb.HealthCheckRequest
+		if err := proto.Unmarshal(content, &healthReq); err != nil {
+			res.SetContent(nil, err)
+			return
+		}
+
+		res.Property().Set("tenant", req.Property().Get("tenant"))
+		switch healthReq.Service {
+		case "secret":
+			res.SetContent(nil, usrv.ErrPermissionDenied)
+		default:
+			payload, _ := proto.Marshal(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+			res.SetContent(payload, nil)
+		}
+	})
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conn, err := grpc.NewClient("localhost:8099", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	healthClient := healthpb.NewHealthClient(conn)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFn()
+	ctx = metadata.AppendToOutgoingContext(ctx, "tenant", "acme")
+
+	var header metadata.MD
+	res, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: "db"}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected status SERVING; got %v", res.Status)
+	}
+	if tenant := header.Get("tenant"); len(tenant) != 1 || tenant[0] != "acme" {
+		t.Fatalf("Expected reply properties to be sent as metadata; got %v", header)
+	}
+
+	_, err = healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: "secret"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected to get PermissionDenied status; got %v", err)
+	}
+
+	// Unbound methods are reported as unimplemented
+	_, err = healthpb.NewHealthClient(conn).List(ctx, &healthpb.HealthListRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Expected to get Unimplemented status; got %v", err)
+	}
+}
+
+func TestGrpcTransportMutualTls(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	config := NewMutualTlsConfig(
+		8115,
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+	)
+	config["clientAuth"] = "optional"
+
+	srvTr := NewGrpc()
+	if err := srvTr.Config(config); err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	specs := []struct {
+		config  GrpcConfig
+		expFrom string
+	}{
+		// Client presenting a certificate signed by the CA
+		{
+			GrpcConfig{
+				"clientCertFile":    filepath.Join(dir, "client.pem"),
+				"clientCertKeyFile": filepath.Join(dir, "client-key.pem"),
+				"rootCAFile":        filepath.Join(dir, "ca.pem"),
+			},
+			"api.example",
+		},
+		// Client without a certificate
+		{
+			GrpcConfig{
+				"rootCAFile": filepath.Join(dir, "ca.pem"),
+			},
+			"",
+		},
+	}
+
+	for idx, spec := range specs {
+		clientTr := NewGrpc()
+		if err := clientTr.Config(spec.config); err != nil {
+			t.Fatal(err)
+		}
+		defer clientTr.Close()
+
+		reqMsg := clientTr.MessageTo("spoofed", "localhost:8115/srv", "ep1")
+		content, err := (<-clientTr.Send(reqMsg, time.Second, true)).Content()
+		if err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+		if string(content) != spec.expFrom {
+			t.Fatalf("[spec %d] Expected sender to be %q; got %q", idx, spec.expFrom, string(content))
+		}
+	}
+
+	// Plaintext clients cannot connect to the TLS server
+	plainTr := NewGrpc()
+	defer plainTr.Close()
+	reqMsg := plainTr.MessageTo("test", "localhost:8115/srv", "ep1")
+	if _, err := (<-plainTr.Send(reqMsg, time.Second, true)).Content(); err == nil {
+		t.Fatal("Expected plaintext request to a TLS server to fail")
+	}
+}
+
+func TestGrpcTransportDuplicateBind(t *testing.T) {
+	tr := NewGrpc()
+	if err := tr.Config(NewGrpcConfig(8116)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if _, err := tr.Bind("localhost:8116/srv", "ep1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Bind("srv", "ep1"); err != usrv.ErrEndpointAlreadyBound {
+		t.Fatalf("Expected to get ErrEndpointAlreadyBound; got %v", err)
+	}
+}
+
+func TestGrpcErrorMapping(t *testing.T) {
+	spec := []error{
+		usrv.ErrServiceUnavailable,
+		usrv.ErrTimeout,
+		usrv.ErrCancelled,
+		usrv.ErrUnauthorized,
+		usrv.ErrPermissionDenied,
+		usrv.ErrInternal,
+	}
+	for _, err := range spec {
+		if mapped := grpcError(grpcStatus(err)); mapped != err {
+			t.Fatalf("Expected error %v to survive a round trip; got %v", err, mapped)
+		}
+	}
+
+	err := grpcError(grpcStatus(errors.New("custom error")))
+	if err == nil || err.Error() != "custom error" {
+		t.Fatalf("Expected custom error message to be preserved; got %v", err)
+	}
+}
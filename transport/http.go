@@ -2,6 +2,8 @@ package transport
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,28 +15,88 @@ import (
 	"sync"
 	"time"
 
-	"gopkg.in/tylerb/graceful.v1"
-
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/achilleasa/usrv"
+	"golang.org/x/net/context"
 )
 
 var (
-	errListenerClosed = errors.New("Listener stopped")
-	defaultDialer     = &net.Dialer{Timeout: 1000 * time.Millisecond}
-	httpClient        = &httpPkg.Client{
-		Transport: &httpPkg.Transport{
-			Dial:  defaultDialer.Dial,
-			Proxy: httpPkg.ProxyFromEnvironment,
-		},
-	}
+	errListenerClosed    = errors.New("Listener stopped")
+	errInvalidCABundle   = errors.New("No certificates found in CA bundle")
+	errMissingClientCA   = errors.New("clientCAFile must be specified to verify client certificates")
+	errInvalidClientAuth = errors.New("clientAuth must be one of: require, optional")
 )
 
-// The DefaultTransport used by the http package implements this
-// method but the Transport interface does not expose it. This
-// is a hack-y way to access it.
-type requestCanceler interface {
-	CancelRequest(*httpPkg.Request)
+// The default timeout for establishing outgoing connections.
+const defaultDialTimeout = time.Second
+
+// Tunable settings for the client and the server of an HttpTransport.
+type httpSettings struct {
+	// Client settings
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	maxIdleConnsPerHost   int
+	responseHeaderTimeout time.Duration
+
+	// Server settings
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	maxHeaderBytes int
+	maxBodySize    int64
+}
+
+// Parse the tunable settings from the transport config params. Settings that
+// are not specified use their default value.
+func parseHttpSettings(params map[string]string) (httpSettings, error) {
+	settings := httpSettings{
+		dialTimeout:         defaultDialTimeout,
+		keepAlive:           30 * time.Second,
+		maxIdleConnsPerHost: httpPkg.DefaultMaxIdleConnsPerHost,
+		maxHeaderBytes:      httpPkg.DefaultMaxHeaderBytes,
+	}
+
+	durations := map[string]*time.Duration{
+		"dialTimeout":           &settings.dialTimeout,
+		"keepAlive":             &settings.keepAlive,
+		"responseHeaderTimeout": &settings.responseHeaderTimeout,
+		"readTimeout":           &settings.readTimeout,
+		"writeTimeout":          &settings.writeTimeout,
+		"idleTimeout":           &settings.idleTimeout,
+	}
+	for key, dst := range durations {
+		if val := params[key]; val != "" {
+			duration, err := time.ParseDuration(val)
+			if err != nil {
+				return settings, fmt.Errorf("Invalid %s '%s': %s", key, val, err.Error())
+			}
+			*dst = duration
+		}
+	}
+
+	ints := map[string]*int{
+		"maxIdleConnsPerHost": &settings.maxIdleConnsPerHost,
+		"maxHeaderBytes":      &settings.maxHeaderBytes,
+	}
+	for key, dst := range ints {
+		if val := params[key]; val != "" {
+			num, err := strconv.Atoi(val)
+			if err != nil {
+				return settings, fmt.Errorf("Invalid %s '%s': %s", key, val, err.Error())
+			}
+			*dst = num
+		}
+	}
+
+	if val := params["maxBodySize"]; val != "" {
+		num, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return settings, fmt.Errorf("Invalid maxBodySize '%s': %s", val, err.Error())
+		}
+		settings.maxBodySize = num
+	}
+
+	return settings, nil
 }
 
 // The internal message type used by the http transport.
@@ -85,6 +147,34 @@ func NewHttpsConfig(serverPort int, certFile, certKeyFile string) HttpConfig {
 	}
 }
 
+// Create a configuration that uses HTTP/2 for incoming and outgoing requests.
+// Unless TLS is also configured, requests use cleartext HTTP/2 (h2c) with
+// prior knowledge, so all peers must have HTTP/2 enabled.
+func NewHttp2Config(serverPort int) HttpConfig {
+	return HttpConfig{
+		"port":  fmt.Sprint(serverPort),
+		"http2": "true",
+	}
+}
+
+// Create a configuration for mutual TLS. The transport will present the
+// supplied certificate both when serving requests and when making outgoing
+// requests. Client and server certificates are verified against the CA
+// bundle in caFile and client certificates are required for all incoming
+// requests.
+func NewMutualTlsConfig(serverPort int, certFile, certKeyFile, caFile string) HttpConfig {
+	return HttpConfig{
+		"port":              fmt.Sprint(serverPort),
+		"certFile":          certFile,
+		"certKeyFile":       certKeyFile,
+		"clientCAFile":      caFile,
+		"clientAuth":        "require",
+		"clientCertFile":    certFile,
+		"clientCertKeyFile": certKeyFile,
+		"rootCAFile":        caFile,
+	}
+}
+
 type HttpTransport struct {
 	logger      usrv.Logger
 	port        int
@@ -92,21 +182,42 @@ type HttpTransport struct {
 	certKeyFile string
 	msgChans    map[string]chan usrv.Message
 
+	// TLS settings for the server; used to verify client certificates
+	tlsConfig *tls.Config
+
+	// The client for outgoing requests
+	client *httpPkg.Client
+
+	// Tunable client and server settings
+	settings httpSettings
+
 	// The protocol for outgoing requests (http or https if TLS is enabled)
 	protocol string
 
-	server *graceful.Server
+	// Use HTTP/2 for incoming and outgoing requests; over TLS if enabled
+	// or in cleartext mode (h2c) otherwise
+	http2 bool
+
+	server *httpPkg.Server
 
 	// A mutex for synchronized access to the server instance
 	sync.Mutex
+
+	// Cancel functions for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]context.CancelFunc
 }
 
 func NewHttp() *HttpTransport {
+	settings, _ := parseHttpSettings(nil)
 	t := &HttpTransport{
 		logger:   usrv.NullLogger,
 		port:     80,
 		protocol: "http://",
 		msgChans: make(map[string]chan usrv.Message, 0),
+		pending:  make(map[usrv.Message]context.CancelFunc, 0),
+		settings: settings,
+		client:   newHttpClient(settings, nil, false, false),
 	}
 	return t
 }
@@ -115,11 +226,48 @@ func (t *HttpTransport) SetLogger(logger usrv.Logger) {
 	t.logger = logger
 }
 
+// Configure the transport. Besides the port, TLS (see NewHttpsConfig and
+// NewMutualTlsConfig) and HTTP/2 (see NewHttp2Config) params, the following
+// tunable params are supported:
+//   - dialTimeout: the timeout for establishing connections (default: 1s)
+//   - keepAlive: the interval between TCP keep-alive probes (default: 30s)
+//   - maxIdleConnsPerHost: the max number of idle connections kept per host (default: 2)
+//   - responseHeaderTimeout: the time to wait for the response headers of a request (default: no timeout)
+//   - readTimeout, writeTimeout, idleTimeout: server timeouts for reading
+//     requests, writing replies and keeping idle connections (default: no timeout)
+//   - maxHeaderBytes: the max size of incoming request headers (default: 1MB)
+//   - maxBodySize: the max size of incoming request bodies; larger requests
+//     are rejected (default: unlimited)
+//
+// Durations are specified using the time.ParseDuration format. Server settings
+// are applied when the server starts listening.
+//
+// If client certificate verification is enabled (clientCAFile), the sender of
+// incoming requests is the identity of the verified client certificate. With
+// clientAuth set to optional, requests without a certificate have an empty
+// sender.
 func (t *HttpTransport) Config(params map[string]string) error {
 	needsReset := false
 	t.certFile = ""
 	t.certKeyFile = ""
+	t.tlsConfig = nil
 	t.protocol = "http://"
+	t.http2 = false
+
+	settings, err := parseHttpSettings(params)
+	if err != nil {
+		return err
+	}
+	t.settings = settings
+
+	if http2Val := params["http2"]; http2Val != "" {
+		http2, err := strconv.ParseBool(http2Val)
+		if err != nil {
+			return err
+		}
+		t.http2 = http2
+		needsReset = true
+	}
 
 	portVal, portDefined := params["port"]
 	if portDefined {
@@ -144,10 +292,26 @@ func (t *HttpTransport) Config(params map[string]string) error {
 
 		t.protocol = "https://"
 		needsReset = true
+
+		tlsConfig, err := newServerTlsConfig(params)
+		if err != nil {
+			return err
+		}
+		t.tlsConfig = tlsConfig
+	}
+
+	clientTlsConfig, err := newClientTlsConfig(params)
+	if err != nil {
+		return err
+	}
+	if clientTlsConfig != nil {
+		t.protocol = "https://"
 	}
+	t.client.CloseIdleConnections()
+	t.client = newHttpClient(t.settings, clientTlsConfig, t.http2, t.protocol == "https://")
 
 	if needsReset {
-		t.logger.Info("Configuration changed", "port", t.port, "protocol", t.protocol)
+		t.logger.Info("Configuration changed", "port", t.port, "protocol", t.protocol, "http2", t.http2)
 		return t.listen()
 	}
 
@@ -158,14 +322,21 @@ func (t *HttpTransport) Close() error {
 	t.Lock()
 	defer t.Unlock()
 
+	// Drop pooled keep-alive connections; they become stale once the
+	// server they are connected to shuts down.
+	defer t.client.CloseIdleConnections()
+
 	if t.server == nil {
 		return nil
 	}
 
-	// Close server and wait for connections to drain
-	stopChan := t.server.StopChan()
-	t.server.Stop(1 * time.Second)
-	<-stopChan
+	// Close server and wait for in-flight requests to drain. Any connections
+	// still active when the drain timeout expires are forcibly closed.
+	ctx, cancelFn := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFn()
+	if err := t.server.Shutdown(ctx); err != nil {
+		t.server.Close()
+	}
 	t.server = nil
 
 	return nil
@@ -182,6 +353,10 @@ func (t *HttpTransport) Bind(service string, endpoint string) (<-chan usrv.Messa
 	return t.msgChans[fullPath], nil
 }
 
+// Send a message. Requests that do not receive a reply before timeout expires
+// fail with usrv.ErrTimeout and requests aborted via Cancel fail with
+// usrv.ErrCancelled. Connection and server errors are reported as
+// usrv.ErrServiceUnavailable.
 func (t *HttpTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
 	msg, ok := m.(*httpMessage)
 	if !ok {
@@ -211,7 +386,20 @@ func (t *HttpTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 	req.Header.Set("X-Usrv-CorrelationId", msg.correlationId)
 	req.Header.Set("Referer", msg.from)
 
-	resChan := make(chan usrv.Message, 0)
+	// If a timeout is specified, the request context expires when it elapses
+	var ctx context.Context
+	var cancelFn context.CancelFunc
+	if timeout > 0 {
+		ctx, cancelFn = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancelFn = context.WithCancel(context.Background())
+	}
+	req = req.WithContext(ctx)
+	t.pendingMutex.Lock()
+	t.pending[m] = cancelFn
+	t.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
 	go func() {
 		resMsg := &httpMessage{
 			from:          msg.to,
@@ -221,21 +409,20 @@ func (t *HttpTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 		}
 
 		defer func() {
+			t.pendingMutex.Lock()
+			delete(t.pending, m)
+			t.pendingMutex.Unlock()
+			cancelFn()
+
 			resChan <- resMsg
 			close(resChan)
 		}()
 
-		// If a timeout is specified, set up a timer to cancel the request
-		if timeout > 0 {
-			time.AfterFunc(timeout, func() {
-				if canceler, ok := httpClient.Transport.(requestCanceler); ok {
-					canceler.CancelRequest(req)
-				}
-			})
-		}
-
-		res, err := httpClient.Do(req)
-		if err != nil {
+		res, err := t.client.Do(req)
+		if err != nil && ctx.Err() != nil {
+			resMsg.SetContent(nil, contextError(ctx))
+			return
+		} else if err != nil {
 			t.logger.Error(
 				"Http request failed",
 				"from", msg.from,
@@ -273,7 +460,10 @@ func (t *HttpTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 
 		// Parse body
 		content, err := ioutil.ReadAll(res.Body)
-		if err != nil {
+		if err != nil && ctx.Err() != nil {
+			resMsg.SetContent(nil, contextError(ctx))
+			return
+		} else if err != nil {
 			resMsg.SetContent(nil, err)
 			return
 		}
@@ -284,6 +474,26 @@ func (t *HttpTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 	return resChan
 }
 
+// Cancel an in-flight request.
+func (t *HttpTransport) Cancel(m usrv.Message) {
+	t.pendingMutex.Lock()
+	cancelFn, found := t.pending[m]
+	delete(t.pending, m)
+	t.pendingMutex.Unlock()
+
+	if found {
+		cancelFn()
+	}
+}
+
+// Map the error of an expired request context to the matching usrv error.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return usrv.ErrTimeout
+	}
+	return usrv.ErrCancelled
+}
+
 // Create a message to be delivered to a target endpoint
 func (t *HttpTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
 	return &httpMessage{
@@ -324,19 +534,40 @@ func (t *HttpTransport) handleRequest(w httpPkg.ResponseWriter, r *httpPkg.Reque
 		return
 	}
 
+	if t.settings.maxBodySize > 0 {
+		r.Body = httpPkg.MaxBytesReader(w, r.Body, t.settings.maxBodySize)
+	}
 	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
+	if _, tooLarge := err.(*httpPkg.MaxBytesError); tooLarge {
+		httpPkg.Error(w, err.Error(), httpPkg.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		status := httpPkg.StatusBadRequest
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			status = httpPkg.StatusRequestTimeout
+		}
+		httpPkg.Error(w, "Failed to read request body", status)
+		return
+	}
+
+	// If the caller presented a verified client certificate use its
+	// identity as the sender. When client certificates are verified,
+	// callers without a certificate are anonymous so that their sender
+	// cannot be forged; otherwise fall back to the Referer header.
+	from := peerIdentity(r.TLS)
+	if from == "" && t.tlsConfig == nil {
+		from = r.Referer()
 	}
 
 	reqMsg := &httpMessage{
-		from:          r.Referer(),
+		from:          from,
 		to:            r.Host + r.URL.String(),
 		property:      make(usrv.Property, 0),
 		correlationId: r.Header.Get("X-Usrv-CorrelationId"),
 		content:       content,
-		// Reply Channel
-		replyChan: make(chan usrv.Message, 0),
+		// Reply Channel. It is buffered so that replies to requests
+		// whose client has gone away do not block.
+		replyChan: make(chan usrv.Message, 1),
 	}
 
 	// Parse properties
@@ -345,9 +576,19 @@ func (t *HttpTransport) handleRequest(w httpPkg.ResponseWriter, r *httpPkg.Reque
 		json.Unmarshal([]byte(propHeader), &reqMsg.property)
 	}
 
-	// Send to the bound endpoint listener and wait for reply
-	msgChan <- reqMsg
-	resMsg := <-reqMsg.replyChan
+	// Send to the bound endpoint listener and wait for reply. Stop waiting
+	// if the client aborts the request.
+	var resMsg usrv.Message
+	select {
+	case msgChan <- reqMsg:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case resMsg = <-reqMsg.replyChan:
+	case <-r.Context().Done():
+		return
+	}
 
 	content, err = resMsg.Content()
 	if err != nil {
@@ -373,29 +614,213 @@ func (t *HttpTransport) listen() error {
 	}
 
 	addr := fmt.Sprintf(":%d", t.port)
-	t.server = &graceful.Server{
-		Server: &httpPkg.Server{
-			Addr:    addr,
-			Handler: httpPkg.HandlerFunc(t.handleRequest),
-		},
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
 
-	var err error
-	var listener net.Listener
 	if t.certFile != "" && t.certKeyFile != "" {
-		listener, err = t.server.ListenTLS(t.certFile, t.certKeyFile)
-	} else {
-		listener, err = net.Listen("tcp", addr)
+		tlsConfig := t.tlsConfig
+		if t.http2 {
+			// Advertise HTTP/2 support during the TLS handshake
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			} else {
+				tlsConfig = tlsConfig.Clone()
+			}
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+
+		listener, err = newTlsListener(listener, t.certFile, t.certKeyFile, tlsConfig)
+		if err != nil {
+			return err
+		}
 	}
 
-	if err != nil {
-		return err
+	server := &httpPkg.Server{
+		Addr:           addr,
+		Handler:        httpPkg.HandlerFunc(t.handleRequest),
+		ReadTimeout:    t.settings.readTimeout,
+		WriteTimeout:   t.settings.writeTimeout,
+		IdleTimeout:    t.settings.idleTimeout,
+		MaxHeaderBytes: t.settings.maxHeaderBytes,
 	}
+	if t.http2 {
+		// Accept HTTP/1.1 and HTTP/2 requests; the latter may use either
+		// TLS or cleartext connections.
+		server.Protocols = new(httpPkg.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	t.server = server
 
 	go func() {
-		t.server.Serve(listener)
-		t.logger.Error("Http server exited", "err", err)
+		err := server.Serve(listener)
+		if err != httpPkg.ErrServerClosed {
+			t.logger.Error("Http server exited", "err", err)
+		}
 	}()
 
 	return nil
 }
+
+// Load a PEM-encoded CA bundle.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errInvalidCABundle
+	}
+	return pool, nil
+}
+
+// Create the server TLS configuration for verifying client certificates.
+// Returns nil if client certificate verification is not enabled.
+func newServerTlsConfig(params map[string]string) (*tls.Config, error) {
+	clientCAFile := params["clientCAFile"]
+	clientAuth := params["clientAuth"]
+	if clientCAFile == "" {
+		if clientAuth != "" {
+			return nil, errMissingClientCA
+		}
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	switch clientAuth {
+	case "", "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, errInvalidClientAuth
+	}
+
+	var err error
+	tlsConfig.ClientCAs, err = loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsConfig, nil
+}
+
+// Wrap a listener so that it serves TLS connections using the supplied
+// certificate. If tlsConfig is not nil, it is used as the base configuration
+// (e.g. for verifying client certificates). The listener is closed if the
+// certificate cannot be loaded.
+func newTlsListener(listener net.Listener, certFile, certKeyFile string, tlsConfig *tls.Config) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, certKeyFile)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Create a dialer for outgoing connections using the dialTimeout param.
+func newDialer(params map[string]string) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: defaultDialTimeout}
+	if val := params["dialTimeout"]; val != "" {
+		timeout, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid dialTimeout '%s': %s", val, err.Error())
+		}
+		dialer.Timeout = timeout
+	}
+	return dialer, nil
+}
+
+// Create a client for outgoing requests using the supplied settings. If
+// tlsConfig is not nil, it is used for presenting a client certificate and/or
+// verifying server certificates. If http2 is set, requests are multiplexed
+// over HTTP/2 connections; over TLS if useTls is set or in cleartext mode
+// (h2c) otherwise.
+func newHttpClient(settings httpSettings, tlsConfig *tls.Config, http2 bool, useTls bool) *httpPkg.Client {
+	dialer := &net.Dialer{
+		Timeout:   settings.dialTimeout,
+		KeepAlive: settings.keepAlive,
+	}
+	transport := &httpPkg.Transport{
+		DialContext:           dialer.DialContext,
+		Proxy:                 httpPkg.ProxyFromEnvironment,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConnsPerHost:   settings.maxIdleConnsPerHost,
+		ResponseHeaderTimeout: settings.responseHeaderTimeout,
+	}
+
+	if http2 {
+		// Cleartext HTTP/2 connections use prior knowledge, so the
+		// client must not fall back to HTTP/1.1 when TLS is disabled.
+		transport.Protocols = new(httpPkg.Protocols)
+		if useTls {
+			transport.Protocols.SetHTTP1(true)
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	return &httpPkg.Client{Transport: transport}
+}
+
+// Create the TLS settings for outgoing connections from the clientCertFile,
+// clientCertKeyFile and rootCAFile params. Returns nil if none of these
+// params is configured.
+func newClientTlsConfig(params map[string]string) (*tls.Config, error) {
+	clientCertFile := params["clientCertFile"]
+	clientCertKeyFile := params["clientCertKeyFile"]
+	rootCAFile := params["rootCAFile"]
+	if (clientCertFile == "" || clientCertKeyFile == "") && rootCAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if clientCertFile != "" && clientCertKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientCertKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if rootCAFile != "" {
+		var err error
+		tlsConfig.RootCAs, err = loadCertPool(rootCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Get the identity of a caller that presented a verified client certificate.
+// The identity is the first DNS or URI SAN of the certificate or, if the
+// certificate has no SANs, its subject common name.
+func peerIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := state.VerifiedChains[0][0]
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
@@ -1,17 +1,27 @@
 package transport
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
 )
 
 var localhostCert = []byte(`-----BEGIN CERTIFICATE-----
@@ -46,6 +56,14 @@ qyUBnu3X9ps8ZfjLZO7BAkEAlT4R5Yl6cGhaJQYZHOde3JEMhNRcVFMO8dJDaFeo
 f9Oeos0UUothgiDktdQHxdNEwLjQf7lJJBzV+5OtwswCWA==
 -----END RSA PRIVATE KEY-----`)
 
+func TestHttpTransportConformance(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "localhost:8080", func() usrv.Transport {
+		tr := NewHttp()
+		tr.Config(NewHttpConfig(8080))
+		return tr
+	})
+}
+
 func TestHttpTransport(t *testing.T) {
 	tr := NewHttp()
 	tr.Config(NewHttpConfig(8080))
@@ -61,7 +79,7 @@ func TestHttpTransport(t *testing.T) {
 		case reqMsg := <-reqChan:
 			propVal := reqMsg.Property().Get("foo")
 			if propVal != "bar" {
-				t.Fatalf("Expected property 'foo' to have value 'bar'; got %s", propVal)
+				t.Errorf("Expected property 'foo' to have value 'bar'; got %s", propVal)
 			}
 
 			resMsg := tr.ReplyTo(reqMsg)
@@ -109,8 +127,8 @@ func TestHttpTransportTimeouts(t *testing.T) {
 
 	resMsg := <-resChan
 	content, err := resMsg.Content()
-	if err != usrv.ErrServiceUnavailable {
-		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	if err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", err)
 	}
 	if content != nil {
 		t.Fatalf("Expected content to be nil; got %v", content)
@@ -175,20 +193,118 @@ func TestHttpTransportUnknownEndpoint(t *testing.T) {
 		t.Fatalf("Expected content to be nil; got %v", content)
 	}
 }
-func TestHttpsTransport(t *testing.T) {
-	// Bypass certificate verification
-	oldClient := httpClient
-	defer func() {
-		httpClient = oldClient
+
+func TestHttpTransportTimeoutErrors(t *testing.T) {
+	tr := NewHttp()
+	defer tr.Close()
+	if err := tr.Config(NewHttpConfig(8103)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Never reply to incoming requests
+	if _, err := tr.Bind("localhost:8103", "ep1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired requests should be distinguishable from unreachable services
+	reqMsg := tr.MessageTo("test", "localhost:8103", "ep1")
+	if _, err := (<-tr.Send(reqMsg, 50*time.Millisecond, true)).Content(); err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", err)
+	}
+
+	reqMsg = tr.MessageTo("test", "localhost:8103", "ep1")
+	resChan := tr.Send(reqMsg, 0, true)
+	<-time.After(50 * time.Millisecond)
+	tr.Cancel(reqMsg)
+	if _, err := (<-resChan).Content(); err != usrv.ErrCancelled {
+		t.Fatalf("Expected to get ErrCancelled; got %v", err)
+	}
+
+	reqMsg = tr.MessageTo("test", "localhost:8104", "ep1")
+	if _, err := (<-tr.Send(reqMsg, time.Second, true)).Content(); err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestHttpTransportCloseDrainsRequests(t *testing.T) {
+	srvTr := NewHttp()
+	if err := srvTr.Config(NewHttpConfig(8105)); err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8105", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{}, 2)
+	go func() {
+		for reqMsg := range reqChan {
+			received <- struct{}{}
+			go func(reqMsg usrv.Message) {
+				<-time.After(100 * time.Millisecond)
+				resMsg := srvTr.ReplyTo(reqMsg)
+				resMsg.SetContent([]byte("OK"), nil)
+				srvTr.Send(resMsg, 0, false)
+			}(reqMsg)
+		}
 	}()
-	dialer := &net.Dialer{Timeout: 1000 * time.Millisecond}
-	httpClient = &http.Client{
-		Transport: &http.Transport{
-			Dial:            dialer.Dial,
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+
+	tr := NewHttp()
+	defer tr.Close()
+
+	// Leave an idle keep-alive connection to the server
+	if _, err := (<-tr.Send(tr.MessageTo("test", "localhost:8105", "ep1"), time.Second, true)).Content(); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	// Closing the server should wait for in-flight requests but not for
+	// idle connections
+	resChan := tr.Send(tr.MessageTo("test", "localhost:8105", "ep1"), time.Second, true)
+	<-received
+	start := time.Now()
+	srvTr.Close()
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Fatalf("Expected close to complete once in-flight requests drained; took %v", elapsed)
+	}
+
+	if _, err := (<-resChan).Content(); err != nil {
+		t.Fatalf("Expected in-flight request to complete; got %v", err)
+	}
+}
+
+func TestHttpTransportCloseStuckRequests(t *testing.T) {
+	srvTr := NewHttp()
+	if err := srvTr.Config(NewHttpConfig(8106)); err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	// Never reply to incoming requests
+	reqChan, err := srvTr.Bind("localhost:8106", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewHttp()
+	defer tr.Close()
+	resChan := tr.Send(tr.MessageTo("test", "localhost:8106", "ep1"), 0, true)
+	<-reqChan
+
+	// Connections still active after the drain timeout are forcibly closed
+	start := time.Now()
+	srvTr.Close()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("Expected close to abort stuck requests after the drain timeout; took %v", elapsed)
 	}
 
+	if _, err := (<-resChan).Content(); err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected aborted request to fail with ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestHttpsTransport(t *testing.T) {
 	certFile, err := ioutil.TempFile("", "cert")
 	if err != nil {
 		t.Fatal(err)
@@ -215,6 +331,9 @@ func TestHttpsTransport(t *testing.T) {
 	tr.Config(NewHttpsConfig(8081, certFile.Name(), certKeyFile.Name()))
 	defer tr.Close()
 
+	// Bypass certificate verification
+	tr.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
 	// Bind at least one endpoint begin listening for http requests
 	reqChan, err := tr.Bind("localhost:8081", "ep1")
 	if err != nil {
@@ -226,7 +345,7 @@ func TestHttpsTransport(t *testing.T) {
 		case reqMsg := <-reqChan:
 			propVal := reqMsg.Property().Get("foo")
 			if propVal != "bar" {
-				t.Fatalf("Expected property 'foo' to have value 'bar'; got %s", propVal)
+				t.Errorf("Expected property 'foo' to have value 'bar'; got %s", propVal)
 			}
 
 			resMsg := tr.ReplyTo(reqMsg)
@@ -253,3 +372,557 @@ func TestHttpsTransport(t *testing.T) {
 		t.Fatalf("Expected res msg corellation id to be %s; got %s", reqMsg.CorrelationId(), resMsg.CorrelationId())
 	}
 }
+
+// Generate a CA and use it to sign a server and a client certificate. The
+// certificates and keys are written as PEM files to a temp directory.
+func generateMutualTlsCerts(t *testing.T) (dir string) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePem := func(name, blockType string, data []byte) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "usrv test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+	writePem("ca.pem", "CERTIFICATE", caDer)
+
+	leafs := map[string]*x509.Certificate{
+		"server": {
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		},
+		"client": {
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "api"},
+			DNSNames:     []string{"api.example"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		},
+	}
+	for name, template := range leafs {
+		template.NotBefore = caTemplate.NotBefore
+		template.NotAfter = caTemplate.NotAfter
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePem(name+".pem", "CERTIFICATE", der)
+		writePem(name+"-key.pem", "EC PRIVATE KEY", keyDer)
+	}
+
+	return dir
+}
+
+func TestHttpsTransportMutualTls(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	srvTr := NewHttp()
+	err := srvTr.Config(NewMutualTlsConfig(
+		8082,
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8082", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Client presenting a certificate signed by the CA
+	clientTr := NewHttp()
+	err = clientTr.Config(HttpConfig{
+		"clientCertFile":    filepath.Join(dir, "client.pem"),
+		"clientCertKeyFile": filepath.Join(dir, "client-key.pem"),
+		"rootCAFile":        filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg := clientTr.MessageTo("spoofed", "localhost:8082", "ep1")
+	resMsg := <-clientTr.Send(reqMsg, 0, true)
+	content, err := resMsg.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "api.example"; string(content) != exp {
+		t.Fatalf("Expected sender to be the verified certificate identity %s; got %s", exp, string(content))
+	}
+
+	// Client without a certificate
+	anonTr := NewHttp()
+	err = anonTr.Config(HttpConfig{
+		"rootCAFile": filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg = anonTr.MessageTo("test", "localhost:8082", "ep1")
+	resMsg = <-anonTr.Send(reqMsg, 0, true)
+	_, err = resMsg.Content()
+	if err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestHttpsTransportOptionalClientAuth(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	srvTr := NewHttp()
+	err := srvTr.Config(HttpConfig{
+		"port":         "8102",
+		"certFile":     filepath.Join(dir, "server.pem"),
+		"certKeyFile":  filepath.Join(dir, "server-key.pem"),
+		"clientCAFile": filepath.Join(dir, "ca.pem"),
+		"clientAuth":   "optional",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8102", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Callers without a certificate must not be able to claim a sender
+	anonTr := NewHttp()
+	err = anonTr.Config(HttpConfig{
+		"rootCAFile": filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg := anonTr.MessageTo("spoofed", "localhost:8102", "ep1")
+	content, err := (<-anonTr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("Expected sender of anonymous request to be empty; got %s", string(content))
+	}
+}
+
+func TestHttpTransportMutualTlsConfigErrors(t *testing.T) {
+	spec := []HttpConfig{
+		{"certFile": "cert", "certKeyFile": "key", "clientAuth": "require"},
+		{"certFile": "cert", "certKeyFile": "key", "clientCAFile": "ca", "clientAuth": "maybe"},
+		{"certFile": "cert", "certKeyFile": "key", "clientCAFile": "/does/not/exist"},
+		{"rootCAFile": "/does/not/exist"},
+	}
+
+	for idx, config := range spec {
+		tr := NewHttp()
+		if err := tr.Config(config); err == nil {
+			tr.Close()
+			t.Fatalf("[spec %d] Expected config to fail", idx)
+		}
+	}
+}
+
+func TestHttp2Transport(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "localhost:8083", func() usrv.Transport {
+		tr := NewHttp()
+		tr.Config(NewHttp2Config(8083))
+		return tr
+	})
+}
+
+func TestHttp2TransportProtocols(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	spec := []struct {
+		config   HttpConfig
+		url      string
+		protocol func(p *http.Protocols)
+	}{
+		{
+			NewHttp2Config(8084),
+			"http://localhost:8084/echo",
+			func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) },
+		},
+		{
+			HttpConfig{
+				"port":        "8085",
+				"http2":       "true",
+				"certFile":    filepath.Join(dir, "server.pem"),
+				"certKeyFile": filepath.Join(dir, "server-key.pem"),
+				"rootCAFile":  filepath.Join(dir, "ca.pem"),
+			},
+			"https://localhost:8085/echo",
+			func(p *http.Protocols) { p.SetHTTP2(true) },
+		},
+	}
+
+	for idx, s := range spec {
+		tr := NewHttp()
+		if err := tr.Config(s.config); err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+
+		service := "localhost:" + s.config["port"]
+		reqChan, err := tr.Bind(service, "echo")
+		if err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+		go func() {
+			for reqMsg := range reqChan {
+				content, _ := reqMsg.Content()
+				resMsg := tr.ReplyTo(reqMsg)
+				resMsg.SetContent(content, nil)
+				tr.Send(resMsg, 0, false)
+			}
+		}()
+
+		// The transport client should be able to reach the server
+		reqMsg := tr.MessageTo("test", service, "echo")
+		reqMsg.SetContent([]byte("hello"), nil)
+		content, err := (<-tr.Send(reqMsg, time.Second, true)).Content()
+		if err != nil || string(content) != "hello" {
+			t.Fatalf("[spec %d] Expected reply 'hello'; got %q, %v", idx, string(content), err)
+		}
+
+		// A client that only speaks HTTP/2 should be served over HTTP/2
+		h2Transport := &http.Transport{
+			Protocols:       new(http.Protocols),
+			TLSClientConfig: tr.client.Transport.(*http.Transport).TLSClientConfig,
+		}
+		s.protocol(h2Transport.Protocols)
+		res, err := (&http.Client{Transport: h2Transport}).Post(s.url, "", bytes.NewReader([]byte("hello")))
+		if err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+		res.Body.Close()
+		if res.ProtoMajor != 2 {
+			t.Fatalf("[spec %d] Expected request to be served over HTTP/2; got %s", idx, res.Proto)
+		}
+		h2Transport.CloseIdleConnections()
+
+		tr.Close()
+	}
+}
+
+func TestHttp2TransportConfigErrors(t *testing.T) {
+	tr := NewHttp()
+	if err := tr.Config(HttpConfig{"http2": "maybe"}); err == nil {
+		t.Fatal("Expected config to fail")
+	}
+}
+
+func TestHttpTransportSettings(t *testing.T) {
+	tr1 := NewHttp()
+	defer tr1.Close()
+	err := tr1.Config(HttpConfig{
+		"port":                  "8088",
+		"dialTimeout":           "250ms",
+		"keepAlive":             "10s",
+		"maxIdleConnsPerHost":   "16",
+		"responseHeaderTimeout": "2s",
+		"readTimeout":           "5s",
+		"writeTimeout":          "6s",
+		"idleTimeout":           "7s",
+		"maxHeaderBytes":        "4096",
+		"maxBodySize":           "1024",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr2 := NewHttp()
+	defer tr2.Close()
+	if err := tr2.Config(NewHttpConfig(8089)); err != nil {
+		t.Fatal(err)
+	}
+
+	expSettings := httpSettings{
+		dialTimeout:           250 * time.Millisecond,
+		keepAlive:             10 * time.Second,
+		maxIdleConnsPerHost:   16,
+		responseHeaderTimeout: 2 * time.Second,
+		readTimeout:           5 * time.Second,
+		writeTimeout:          6 * time.Second,
+		idleTimeout:           7 * time.Second,
+		maxHeaderBytes:        4096,
+		maxBodySize:           1024,
+	}
+	if tr1.settings != expSettings {
+		t.Fatalf("Expected settings %+v; got %+v", expSettings, tr1.settings)
+	}
+	defSettings, _ := parseHttpSettings(nil)
+	if tr2.settings != defSettings {
+		t.Fatalf("Expected default settings %+v; got %+v", defSettings, tr2.settings)
+	}
+
+	// Each transport should use its own client
+	client1 := tr1.client.Transport.(*http.Transport)
+	client2 := tr2.client.Transport.(*http.Transport)
+	if client1.MaxIdleConnsPerHost != 16 || client1.ResponseHeaderTimeout != 2*time.Second {
+		t.Fatalf("Expected client settings to be applied; got %d idle conns per host and %v response header timeout", client1.MaxIdleConnsPerHost, client1.ResponseHeaderTimeout)
+	}
+	if client2.MaxIdleConnsPerHost != http.DefaultMaxIdleConnsPerHost || client2.ResponseHeaderTimeout != 0 {
+		t.Fatalf("Expected client defaults to be applied; got %d idle conns per host and %v response header timeout", client2.MaxIdleConnsPerHost, client2.ResponseHeaderTimeout)
+	}
+
+	// Server settings should be applied when the server starts listening
+	if _, err := tr1.Bind("localhost:8088", "ep1"); err != nil {
+		t.Fatal(err)
+	}
+	tr1.Lock()
+	server := tr1.server
+	tr1.Unlock()
+	if server.ReadTimeout != 5*time.Second || server.WriteTimeout != 6*time.Second || server.IdleTimeout != 7*time.Second || server.MaxHeaderBytes != 4096 {
+		t.Fatalf("Expected server settings to be applied; got %+v", server)
+	}
+}
+
+func TestHttpTransportMaxBodySize(t *testing.T) {
+	tr := NewHttp()
+	defer tr.Close()
+	err := tr.Config(HttpConfig{
+		"port":        "8100",
+		"maxBodySize": "16",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqChan, err := tr.Bind("localhost:8100", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			content, _ := reqMsg.Content()
+			resMsg := tr.ReplyTo(reqMsg)
+			resMsg.SetContent(content, nil)
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	reqMsg := tr.MessageTo("test", "localhost:8100", "echo")
+	reqMsg.SetContent([]byte("small"), nil)
+	content, err := (<-tr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "small" {
+		t.Fatalf("Expected reply %q; got %q", "small", string(content))
+	}
+
+	reqMsg = tr.MessageTo("test", "localhost:8100", "echo")
+	reqMsg.SetContent(bytes.Repeat([]byte("x"), 17), nil)
+	if _, err := (<-tr.Send(reqMsg, time.Second, true)).Content(); err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected oversized request to fail with ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestHttpTransportBodyReadErrors(t *testing.T) {
+	tr := NewHttp()
+	defer tr.Close()
+	err := tr.Config(HttpConfig{
+		"port":        "8117",
+		"readTimeout": "200ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tr.Bind("localhost:8117", "echo"); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := []struct {
+		closeWrite bool
+		expStatus  int
+	}{
+		// Body is cut short by the client
+		{true, http.StatusBadRequest},
+		// Body does not arrive before the read timeout
+		{false, http.StatusRequestTimeout},
+	}
+
+	for idx, s := range spec {
+		conn, err := net.Dial("tcp", "localhost:8117")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost:8117\r\nContent-Length: 10\r\n\r\nabc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.closeWrite {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("[spec %d] %v", idx, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != s.expStatus {
+			t.Fatalf("[spec %d] Expected status %d; got %d", idx, s.expStatus, res.StatusCode)
+		}
+	}
+}
+
+func TestHttpTransportResponseHeaderTimeout(t *testing.T) {
+	srvTr := NewHttp()
+	defer srvTr.Close()
+	if err := srvTr.Config(NewHttpConfig(8101)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Never reply to incoming requests
+	if _, err := srvTr.Bind("localhost:8101", "ep1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewHttp()
+	defer tr.Close()
+	err := tr.Config(HttpConfig{
+		"responseHeaderTimeout": "50ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	reqMsg := tr.MessageTo("test", "localhost:8101", "ep1")
+	if _, err := (<-tr.Send(reqMsg, 5*time.Second, true)).Content(); err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected response header timeout to abort the request; took %v", elapsed)
+	}
+}
+
+func TestHttpTransportSettingsConfigErrors(t *testing.T) {
+	tr := NewHttp()
+	spec := []HttpConfig{
+		{"dialTimeout": "soon"},
+		{"keepAlive": "1"},
+		{"maxIdleConnsPerHost": "many"},
+		{"responseHeaderTimeout": "-"},
+		{"readTimeout": "5"},
+		{"writeTimeout": "x"},
+		{"idleTimeout": "forever"},
+		{"maxHeaderBytes": "1MB"},
+		{"maxBodySize": "big"},
+	}
+	for idx, params := range spec {
+		if err := tr.Config(params); err == nil {
+			t.Fatalf("[spec %d] Expected an error", idx)
+		}
+	}
+}
+
+// Send requests in parallel through a transport that serves an echo endpoint.
+func benchmarkHttpTransport(b *testing.B, config HttpConfig) {
+	tr := NewHttp()
+	if err := tr.Config(config); err != nil {
+		b.Fatal(err)
+	}
+	defer tr.Close()
+
+	service := "localhost:" + config["port"]
+	reqChan, err := tr.Bind(service, "echo")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			go func(reqMsg usrv.Message) {
+				content, _ := reqMsg.Content()
+				resMsg := tr.ReplyTo(reqMsg)
+				resMsg.SetContent(content, nil)
+				tr.Send(resMsg, 0, false)
+			}(reqMsg)
+		}
+	}()
+
+	payload := bytes.Repeat([]byte("x"), 1024)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			reqMsg := tr.MessageTo("bench", service, "echo")
+			reqMsg.SetContent(payload, nil)
+			if _, err := (<-tr.Send(reqMsg, 5*time.Second, true)).Content(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkHttpTransportHttp1(b *testing.B) {
+	benchmarkHttpTransport(b, NewHttpConfig(8086))
+}
+
+func BenchmarkHttpTransportH2c(b *testing.B) {
+	benchmarkHttpTransport(b, NewHttp2Config(8087))
+}
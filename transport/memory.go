@@ -2,6 +2,7 @@ package transport
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/achilleasa/usrv"
@@ -41,14 +42,22 @@ func (m *memMessage) SetContent(content []byte, err error) {
 }
 
 type InMemTransport struct {
-	logger   usrv.Logger
+	logger usrv.Logger
+
+	// A mutex for synchronized access to the bound endpoints
+	sync.RWMutex
 	msgChans map[string]chan usrv.Message
+
+	// Cancellation channels for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]chan struct{}
 }
 
 func NewInMemory() *InMemTransport {
 	return &InMemTransport{
 		logger:   usrv.NullLogger,
 		msgChans: make(map[string]chan usrv.Message, 0),
+		pending:  make(map[usrv.Message]chan struct{}, 0),
 	}
 }
 
@@ -60,10 +69,20 @@ func (t *InMemTransport) Config(params map[string]string) error {
 	return nil
 }
 
+// Close the transport and unbind all endpoints. Messages sent to previously
+// bound endpoints fail with ErrServiceUnavailable.
 func (t *InMemTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.msgChans = make(map[string]chan usrv.Message, 0)
 	return nil
 }
+
 func (t *InMemTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	t.Lock()
+	defer t.Unlock()
+
 	fullPath := fmt.Sprintf("%s.%s", service, endpoint)
 	t.msgChans[fullPath] = make(chan usrv.Message, 0)
 	return t.msgChans[fullPath], nil
@@ -81,8 +100,19 @@ func (t *InMemTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 		return nil
 	}
 
-	resChan := make(chan usrv.Message, 0)
+	cancelChan := make(chan struct{}, 0)
+	t.pendingMutex.Lock()
+	t.pending[m] = cancelChan
+	t.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
 	go func() {
+		defer func() {
+			t.pendingMutex.Lock()
+			delete(t.pending, m)
+			t.pendingMutex.Unlock()
+		}()
+
 		// Simulate async request
 		reqMsg := &memMessage{
 			from:          msg.from,
@@ -90,8 +120,9 @@ func (t *InMemTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 			property:      make(usrv.Property, 0),
 			correlationId: msg.correlationId,
 			content:       msg.content,
-			// Reply Channel
-			replyChan: make(chan usrv.Message, 0),
+			// Reply Channel. It is buffered so that replies to requests
+			// that have been cancelled or have timed out do not block.
+			replyChan: make(chan usrv.Message, 1),
 		}
 		for k, v := range msg.property {
 			reqMsg.property[k] = v
@@ -100,7 +131,9 @@ func (t *InMemTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 		var resMsg usrv.Message
 
 		// Try to match endpoint
+		t.RLock()
 		msgChan, found := t.msgChans[msg.to]
+		t.RUnlock()
 		if !found {
 			t.logger.Error(
 				"Unknown destination",
@@ -117,13 +150,19 @@ func (t *InMemTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 			}
 
 			// Send to the bound endpoint listener and wait for reply
-			msgChan <- reqMsg
-
-			select {
-			case resMsg = <-reqMsg.replyChan:
-			case <-timeoutChan:
-				resMsg = t.ReplyTo(reqMsg)
-				resMsg.SetContent(nil, usrv.ErrTimeout)
+			for resMsg == nil {
+				select {
+				case msgChan <- reqMsg:
+					// Stop trying to deliver the message
+					msgChan = nil
+				case resMsg = <-reqMsg.replyChan:
+				case <-timeoutChan:
+					resMsg = t.ReplyTo(reqMsg)
+					resMsg.SetContent(nil, usrv.ErrTimeout)
+				case <-cancelChan:
+					resMsg = t.ReplyTo(reqMsg)
+					resMsg.SetContent(nil, usrv.ErrCancelled)
+				}
 			}
 		}
 
@@ -135,6 +174,17 @@ func (t *InMemTransport) Send(m usrv.Message, timeout time.Duration, expectReply
 	return resChan
 }
 
+// Cancel an in-flight request.
+func (t *InMemTransport) Cancel(m usrv.Message) {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	if cancelChan, found := t.pending[m]; found {
+		close(cancelChan)
+		delete(t.pending, m)
+	}
+}
+
 // Create a message to be delivered to a target endpoint
 func (t *InMemTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
 	return &memMessage{
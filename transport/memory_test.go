@@ -3,11 +3,18 @@ package transport
 import (
 	"bytes"
 	"fmt"
+	"testing"
 	"time"
 
 	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
 )
-import "testing"
+
+func TestMemoryTransportConformance(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "srv", func() usrv.Transport {
+		return NewInMemory()
+	})
+}
 
 func TestMemoryTransport(t *testing.T) {
 	tr := NewInMemory()
@@ -23,7 +30,7 @@ func TestMemoryTransport(t *testing.T) {
 		case reqMsg := <-reqChan:
 			propVal := reqMsg.Property().Get("foo")
 			if propVal != "bar" {
-				t.Fatalf("Expected property 'foo' to have value 'bar'; got %s", propVal)
+				t.Errorf("Expected property 'foo' to have value 'bar'; got %s", propVal)
 			}
 
 			resMsg := tr.ReplyTo(reqMsg)
@@ -138,3 +145,91 @@ func TestMemoryTransportConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMemoryTransportCancel(t *testing.T) {
+	tr := NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg := tr.MessageTo("test", "srv", "ep1")
+	resChan := tr.Send(reqMsg, 0, true)
+
+	// Wait for the request to be delivered and then cancel it
+	<-reqChan
+	tr.Cancel(reqMsg)
+
+	resMsg := <-resChan
+	_, err = resMsg.Content()
+	if err != usrv.ErrCancelled {
+		t.Fatalf("Expected to get ErrCancelled; got %v", err)
+	}
+}
+
+func TestMemoryTransportLateReply(t *testing.T) {
+	tr := NewInMemory()
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg := tr.MessageTo("test", "srv", "ep1")
+	resChan := tr.Send(reqMsg, 1*time.Millisecond, true)
+	msg := <-reqChan
+
+	resMsg := <-resChan
+	if _, err = resMsg.Content(); err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", err)
+	}
+
+	// Replying after the client gave up should not block
+	replied := make(chan struct{})
+	go func() {
+		tr.Send(tr.ReplyTo(msg), 0, false)
+		close(replied)
+	}()
+
+	select {
+	case <-replied:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected late reply not to block")
+	}
+}
+
+func TestMemoryTransportClose(t *testing.T) {
+	tr := NewInMemory()
+	defer tr.Close()
+
+	if _, err := tr.Bind("srv", "ep1"); err != nil {
+		t.Fatal(err)
+	}
+	tr.Close()
+
+	// Endpoints bound before closing the transport should be unreachable
+	reqMsg := tr.MessageTo("test", "srv", "ep1")
+	if _, err := (<-tr.Send(reqMsg, time.Second, true)).Content(); err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+
+	// The transport can be reused by binding endpoints again
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		reqMsg := <-reqChan
+		resMsg := tr.ReplyTo(reqMsg)
+		resMsg.SetContent([]byte("OK"), nil)
+		tr.Send(resMsg, 0, false)
+	}()
+
+	reqMsg = tr.MessageTo("test", "srv", "ep1")
+	if _, err := (<-tr.Send(reqMsg, time.Second, true)).Content(); err != nil {
+		t.Fatal(err)
+	}
+}
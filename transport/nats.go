@@ -0,0 +1,393 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/achilleasa/usrv"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/net/context"
+)
+
+// Headers used to encode message metadata. Each message property is encoded
+// as a separate header whose name is the property key prefixed with
+// natsPropertyHeaderPrefix.
+const (
+	natsFromHeader           = "Usrv-From"
+	natsCorrelationIdHeader  = "Usrv-Correlation-Id"
+	natsErrorHeader          = "Usrv-Error"
+	natsPropertyHeaderPrefix = "Usrv-Property-"
+)
+
+var errInvalidSubjectToken = errors.New("Service and endpoint names must not be empty or contain '.', '*', '>' or whitespace")
+
+// The internal message type used by the nats transport.
+type natsMessage struct {
+	from          string
+	to            string
+	property      usrv.Property
+	correlationId string
+	content       []byte
+	err           error
+
+	// The inbox subject for replies; only set for incoming requests and replies
+	replySubject string
+	isReply      bool
+}
+
+func (m *natsMessage) From() string {
+	return m.from
+}
+func (m *natsMessage) To() string {
+	return m.to
+}
+func (m *natsMessage) Property() usrv.Property {
+	return m.property
+}
+func (m *natsMessage) CorrelationId() string {
+	return m.correlationId
+}
+func (m *natsMessage) Content() ([]byte, error) {
+	return m.content, m.err
+}
+func (m *natsMessage) SetContent(content []byte, err error) {
+	m.content, m.err = content, err
+}
+
+// Encode a message into a nats message for subject.
+func (m *natsMessage) encode(subject string) *nats.Msg {
+	natsMsg := nats.NewMsg(subject)
+	natsMsg.Data = m.content
+	natsMsg.Header.Set(natsFromHeader, m.from)
+	natsMsg.Header.Set(natsCorrelationIdHeader, m.correlationId)
+	if m.err != nil {
+		natsMsg.Header.Set(natsErrorHeader, m.err.Error())
+	}
+	for k, v := range m.property {
+		natsMsg.Header.Set(natsPropertyHeaderPrefix+k, v)
+	}
+	return natsMsg
+}
+
+// Decode the payload and headers of a nats message.
+func (m *natsMessage) decode(natsMsg *nats.Msg) {
+	m.property = make(usrv.Property, 0)
+	for k, v := range natsMsg.Header {
+		if strings.HasPrefix(k, natsPropertyHeaderPrefix) && len(v) > 0 {
+			m.property[strings.TrimPrefix(k, natsPropertyHeaderPrefix)] = v[0]
+		}
+	}
+	m.content = natsMsg.Data
+	m.err = frameError(natsMsg.Header.Get(natsErrorHeader))
+}
+
+type NatsConfig map[string]string
+
+func NewNatsConfig(url string) NatsConfig {
+	return NatsConfig{
+		"url": url,
+	}
+}
+
+// A transport that exchanges messages via a NATS server. Each bound endpoint
+// subscribes to the "<prefix>.<service>.<endpoint>" subject as a member of a
+// queue group named after the service endpoint, so that requests are load
+// balanced between all service replicas. Requests use the NATS request/reply
+// mechanism; message properties are mapped to NATS headers.
+type NatsTransport struct {
+	logger        usrv.Logger
+	url           string
+	subjectPrefix string
+	dialer        *net.Dialer
+
+	// A mutex for synchronized access to the connection and the subscriptions
+	sync.Mutex
+	conn          *nats.Conn
+	subscriptions []*nats.Subscription
+
+	// Closed when the transport is closed to stop delivering incoming requests
+	closeChan chan struct{}
+
+	// Cancel functions for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]context.CancelFunc
+}
+
+func NewNats() *NatsTransport {
+	return &NatsTransport{
+		logger:        usrv.NullLogger,
+		url:           nats.DefaultURL,
+		subjectPrefix: "usrv",
+		dialer:        &net.Dialer{Timeout: defaultDialTimeout},
+		closeChan:     make(chan struct{}, 0),
+		pending:       make(map[usrv.Message]context.CancelFunc, 0),
+	}
+}
+
+func (t *NatsTransport) SetLogger(logger usrv.Logger) {
+	t.logger = logger
+}
+
+// Configure the transport. The following params are supported:
+//   - url: a comma-separated list of NATS server URLs (default: nats://127.0.0.1:4222)
+//   - subjectPrefix: the prefix for endpoint subjects (default: usrv)
+//   - dialTimeout: the timeout for connecting to the NATS server (default: 1s)
+//
+// Changing the configuration closes any existing connection; endpoints need
+// to be bound again.
+func (t *NatsTransport) Config(params map[string]string) error {
+	dialer, err := newDialer(params)
+	if err != nil {
+		return err
+	}
+
+	t.Close()
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.url = nats.DefaultURL
+	if url := params["url"]; url != "" {
+		t.url = url
+	}
+	t.dialer = dialer
+	t.subjectPrefix = "usrv"
+	if subjectPrefix := params["subjectPrefix"]; subjectPrefix != "" {
+		t.subjectPrefix = subjectPrefix
+	}
+
+	t.logger.Info("Configuration changed", "url", t.url, "subjectPrefix", t.subjectPrefix)
+	return nil
+}
+
+// Close the transport. All subscriptions and the connection to the NATS
+// server are closed.
+func (t *NatsTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+
+	for _, sub := range t.subscriptions {
+		sub.Unsubscribe()
+	}
+	t.subscriptions = nil
+	close(t.closeChan)
+	t.closeChan = make(chan struct{}, 0)
+
+	t.conn.Close()
+	t.conn = nil
+
+	return nil
+}
+
+// Bind service endpoint. Incoming requests are delivered to the returned
+// channel; requests are distributed between all transports bound to the same
+// service endpoint. Service and endpoint names must be valid NATS subject
+// tokens so that they cannot match the subjects of other endpoints.
+func (t *NatsTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	subject, err := t.subject(service, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	msgChan := make(chan usrv.Message, 0)
+	closeChan := t.closeChan
+	to := fmt.Sprintf("%s/%s", service, endpoint)
+	sub, err := conn.QueueSubscribe(subject, to, func(natsMsg *nats.Msg) {
+		reqMsg := &natsMessage{
+			from:          natsMsg.Header.Get(natsFromHeader),
+			to:            to,
+			correlationId: natsMsg.Header.Get(natsCorrelationIdHeader),
+			replySubject:  natsMsg.Reply,
+		}
+		reqMsg.decode(natsMsg)
+
+		select {
+		case msgChan <- reqMsg:
+		case <-closeChan:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.subscriptions = append(t.subscriptions, sub)
+
+	return msgChan, nil
+}
+
+func (t *NatsTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*natsMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	t.Lock()
+	conn, err := t.connect()
+	t.Unlock()
+
+	if msg.isReply {
+		if err == nil {
+			err = conn.PublishMsg(msg.encode(msg.replySubject))
+		}
+		if err != nil {
+			t.logger.Error(
+				"Failed to send reply",
+				"from", msg.from,
+				"to", msg.to,
+				"err", err.Error(),
+			)
+		}
+		return nil
+	}
+
+	service, endpoint := splitStreamAddress(msg.to)
+	subject, subjectErr := t.subject(service, endpoint)
+
+	var ctx context.Context
+	var cancelFn context.CancelFunc
+	if timeout > 0 {
+		ctx, cancelFn = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancelFn = context.WithCancel(context.Background())
+	}
+
+	t.pendingMutex.Lock()
+	t.pending[m] = cancelFn
+	t.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
+	go func() {
+		resMsg := &natsMessage{
+			from:          msg.to,
+			to:            msg.from,
+			property:      make(usrv.Property, 0),
+			correlationId: msg.correlationId,
+		}
+
+		defer func() {
+			t.pendingMutex.Lock()
+			delete(t.pending, m)
+			t.pendingMutex.Unlock()
+			cancelFn()
+
+			resChan <- resMsg
+			close(resChan)
+		}()
+
+		if subjectErr != nil {
+			resMsg.SetContent(nil, subjectErr)
+			return
+		} else if err != nil {
+			t.logger.Error(
+				"Nats request failed",
+				"from", msg.from,
+				"to", msg.to,
+				"err", err.Error(),
+			)
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		natsRes, err := conn.RequestMsgWithContext(ctx, msg.encode(subject))
+		if err != nil && ctx.Err() != nil {
+			resMsg.SetContent(nil, contextError(ctx))
+			return
+		} else if err != nil {
+			if err != nats.ErrNoResponders {
+				t.logger.Error(
+					"Nats request failed",
+					"from", msg.from,
+					"to", msg.to,
+					"err", err.Error(),
+				)
+			}
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		resMsg.decode(natsRes)
+	}()
+
+	return resChan
+}
+
+// Cancel an in-flight request.
+func (t *NatsTransport) Cancel(m usrv.Message) {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	if cancelFn, found := t.pending[m]; found {
+		cancelFn()
+		delete(t.pending, m)
+	}
+}
+
+// Create a message to be delivered to a target endpoint
+func (t *NatsTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return &natsMessage{
+		from:          from,
+		to:            fmt.Sprintf("%s/%s", toService, toEndpoint),
+		property:      make(usrv.Property, 0),
+		correlationId: uuid.New(),
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *NatsTransport) ReplyTo(msg usrv.Message) usrv.Message {
+	reqMsg, ok := msg.(*natsMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	return &natsMessage{
+		from:          reqMsg.to,
+		to:            reqMsg.from,
+		property:      make(usrv.Property, 0),
+		correlationId: reqMsg.correlationId,
+		replySubject:  reqMsg.replySubject,
+		isReply:       true,
+	}
+}
+
+// Get the subject for a service endpoint. Names that are not valid subject
+// tokens are rejected; otherwise "." would split them into multiple tokens
+// and "*" or ">" would act as wildcards when binding.
+func (t *NatsTransport) subject(service string, endpoint string) (string, error) {
+	for _, name := range []string{service, endpoint} {
+		if name == "" || strings.ContainsAny(name, ".*> \t\r\n") {
+			return "", errInvalidSubjectToken
+		}
+	}
+	return fmt.Sprintf("%s.%s.%s", t.subjectPrefix, service, endpoint), nil
+}
+
+// Ensure that the transport is connected to the NATS server. This method
+// must be called while holding the transport lock.
+func (t *NatsTransport) connect() (*nats.Conn, error) {
+	if t.conn != nil {
+		return t.conn, nil
+	}
+
+	conn, err := nats.Connect(t.url, nats.Timeout(t.dialer.Timeout), nats.SetCustomDialer(t.dialer))
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return conn, nil
+}
@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Start an embedded nats server listening on a random port.
+func startNatsServer(t *testing.T) *server.Server {
+	srv, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Timed out waiting for nats server to start")
+	}
+	return srv
+}
+
+func TestNatsTransport(t *testing.T) {
+	natsSrv := startNatsServer(t)
+	defer natsSrv.Shutdown()
+
+	usrvtest.RunTransportSuite(t, "srv", func() usrv.Transport {
+		tr := NewNats()
+		tr.Config(NewNatsConfig(natsSrv.ClientURL()))
+		return tr
+	})
+}
+
+func TestNatsTransportQueueGroups(t *testing.T) {
+	natsSrv := startNatsServer(t)
+	defer natsSrv.Shutdown()
+
+	// Start two replicas of the same service
+	var mutex sync.Mutex
+	served := make(map[string]int, 0)
+	for _, replica := range []string{"replica-1", "replica-2"} {
+		tr := NewNats()
+		tr.Config(NewNatsConfig(natsSrv.ClientURL()))
+		defer tr.Close()
+
+		srv := usrv.NewServer("srv", tr)
+		replica := replica
+		srv.Handle("ep1", func(req, res usrv.Message) {
+			mutex.Lock()
+			served[replica]++
+			mutex.Unlock()
+			res.SetContent([]byte(replica), nil)
+		})
+		if err := srv.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+	}
+
+	clientTr := NewNats()
+	clientTr.Config(NewNatsConfig(natsSrv.ClientURL()))
+	defer clientTr.Close()
+	client := usrv.NewClient("srv", clientTr)
+
+	numReqs := 50
+	for i := 0; i < numReqs; i++ {
+		if _, err := (<-client.Send(client.NewMessage("test", "ep1"), time.Second)).Content(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if served["replica-1"]+served["replica-2"] != numReqs {
+		t.Fatalf("Expected %d requests to be served; got %v", numReqs, served)
+	}
+	if served["replica-1"] == 0 || served["replica-2"] == 0 {
+		t.Fatalf("Expected requests to be load balanced between replicas; got %v", served)
+	}
+}
+
+func TestNatsTransportHeaders(t *testing.T) {
+	natsSrv := startNatsServer(t)
+	defer natsSrv.Shutdown()
+
+	tr := NewNats()
+	tr.Config(NewNatsConfig(natsSrv.ClientURL()))
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Inspect the raw request headers
+	tr.Lock()
+	conn := tr.conn
+	tr.Unlock()
+	sub, err := conn.SubscribeSync("usrv.srv.ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Flush()
+
+	go func() {
+		reqMsg := <-reqChan
+		resMsg := tr.ReplyTo(reqMsg)
+		resMsg.SetContent(nil, usrv.ErrPermissionDenied)
+		tr.Send(resMsg, 0, false)
+	}()
+
+	reqMsg := tr.MessageTo("test", "srv", "ep1")
+	reqMsg.Property().Set("tenant", "acme")
+	_, err = (<-tr.Send(reqMsg, time.Second, true)).Content()
+	if err != usrv.ErrPermissionDenied {
+		t.Fatalf("Expected to get ErrPermissionDenied; got %v", err)
+	}
+
+	natsMsg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := map[string]string{
+		natsFromHeader:                      "test",
+		natsCorrelationIdHeader:             reqMsg.CorrelationId(),
+		natsPropertyHeaderPrefix + "tenant": "acme",
+	}
+	for header, expVal := range spec {
+		if val := natsMsg.Header.Get(header); val != expVal {
+			t.Fatalf("Expected header %s to be %q; got %q", header, expVal, val)
+		}
+	}
+}
+
+func TestNatsTransportInvalidSubjects(t *testing.T) {
+	tr := NewNats()
+	defer tr.Close()
+
+	specs := []struct {
+		service  string
+		endpoint string
+	}{
+		{"srv", ""},
+		{"srv.admin", "ep1"},
+		{"srv", "*"},
+		{">", "ep1"},
+		{"srv", "ep 1"},
+	}
+	for idx, spec := range specs {
+		if _, err := tr.Bind(spec.service, spec.endpoint); err != errInvalidSubjectToken {
+			t.Fatalf("[spec %d] Expected Bind to fail with errInvalidSubjectToken; got %v", idx, err)
+		}
+
+		reqMsg := tr.MessageTo("test", spec.service, spec.endpoint)
+		if _, err := (<-tr.Send(reqMsg, time.Second, true)).Content(); err != errInvalidSubjectToken {
+			t.Fatalf("[spec %d] Expected Send to fail with errInvalidSubjectToken; got %v", idx, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// The side of an exchange observed by a Recorder.
+const (
+	// An outgoing request sent via the recorded transport.
+	SideClient = "client"
+
+	// An incoming request received by an endpoint bound to the recorded transport.
+	SideServer = "server"
+)
+
+// The payload of a recorded message.
+type RecordedMessage struct {
+	Property usrv.Property `json:"property,omitempty"`
+	Content  []byte        `json:"content,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// A recorded request/reply exchange. Recorders emit one exchange per line.
+type RecordedExchange struct {
+	Side          string          `json:"side"`
+	Time          time.Time       `json:"time"`
+	Duration      time.Duration   `json:"duration"`
+	From          string          `json:"from"`
+	Service       string          `json:"service"`
+	Endpoint      string          `json:"endpoint"`
+	CorrelationId string          `json:"correlation_id"`
+	Request       RecordedMessage `json:"request"`
+	Reply         RecordedMessage `json:"reply"`
+}
+
+// Capture the payload of a message.
+func recordMessage(msg usrv.Message) RecordedMessage {
+	content, err := msg.Content()
+	rec := RecordedMessage{
+		Content: append([]byte(nil), content...),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if len(msg.Property()) > 0 {
+		rec.Property = make(usrv.Property, len(msg.Property()))
+		for k, v := range msg.Property() {
+			rec.Property[k] = v
+		}
+	}
+	return rec
+}
+
+// A request that is tracked by the Recorder.
+type recordedRequest struct {
+	usrv.Message
+	service  string
+	endpoint string
+	start    time.Time
+}
+
+// A reply to a request received by a bound endpoint.
+type recordedReply struct {
+	usrv.Message
+	request *recordedRequest
+}
+
+// A transport wrapper that records all request/reply exchanges as JSON lines.
+// Both outgoing requests and requests received by bound endpoints are
+// recorded once their reply is available.
+type Recorder struct {
+	transport usrv.Transport
+	logger    usrv.Logger
+
+	// A mutex for synchronized access to the writer
+	sync.Mutex
+	encoder *json.Encoder
+
+	// Closed when the recorder is closed to stop forwarding incoming requests
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// Wrap a transport with a recorder that writes exchanges to w.
+func NewRecorder(transport usrv.Transport, w io.Writer) *Recorder {
+	return &Recorder{
+		transport: transport,
+		logger:    usrv.NullLogger,
+		encoder:   json.NewEncoder(w),
+		closeChan: make(chan struct{}, 0),
+	}
+}
+
+// Write an exchange to the recording.
+func (r *Recorder) record(side string, req *recordedRequest, res usrv.Message) {
+	exchange := RecordedExchange{
+		Side:          side,
+		Time:          req.start,
+		Duration:      time.Since(req.start),
+		From:          req.From(),
+		Service:       req.service,
+		Endpoint:      req.endpoint,
+		CorrelationId: req.CorrelationId(),
+		Request:       recordMessage(req.Message),
+		Reply:         recordMessage(res),
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.encoder.Encode(exchange); err != nil {
+		r.logger.Error(
+			"Failed to record exchange",
+			"from", exchange.From,
+			"service", exchange.Service,
+			"endpoint", exchange.Endpoint,
+			"err", err.Error(),
+		)
+	}
+}
+
+func (r *Recorder) SetLogger(logger usrv.Logger) {
+	r.logger = logger
+	r.transport.SetLogger(logger)
+}
+
+func (r *Recorder) Config(params map[string]string) error {
+	return r.transport.Config(params)
+}
+
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeChan)
+	})
+	return r.transport.Close()
+}
+
+// Bind service endpoint. Incoming requests are tagged with the service and
+// endpoint so that they can be recorded once the endpoint replies.
+func (r *Recorder) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	inChan, err := r.transport.Bind(service, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	outChan := make(chan usrv.Message, 0)
+	go func() {
+		for {
+			select {
+			case msg := <-inChan:
+				req := &recordedRequest{
+					Message:  msg,
+					service:  service,
+					endpoint: endpoint,
+					start:    time.Now(),
+				}
+				select {
+				case outChan <- req:
+				case <-r.closeChan:
+					return
+				}
+			case <-r.closeChan:
+				return
+			}
+		}
+	}()
+
+	return outChan, nil
+}
+
+func (r *Recorder) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	switch msg := m.(type) {
+	case *recordedReply:
+		r.record(SideServer, msg.request, msg.Message)
+		return r.transport.Send(msg.Message, timeout, expectReply)
+	case *recordedRequest:
+		if !expectReply {
+			return r.transport.Send(msg.Message, timeout, expectReply)
+		}
+
+		msg.start = time.Now()
+		replyChan := r.transport.Send(msg.Message, timeout, expectReply)
+		resChan := make(chan usrv.Message, 1)
+		go func() {
+			res := <-replyChan
+			r.record(SideClient, msg, res)
+			resChan <- res
+			close(resChan)
+		}()
+		return resChan
+	}
+
+	return r.transport.Send(m, timeout, expectReply)
+}
+
+// Cancel an in-flight request.
+func (r *Recorder) Cancel(m usrv.Message) {
+	if canceler, ok := r.transport.(usrv.Canceler); ok {
+		canceler.Cancel(unwrapRecordedMessage(m))
+	}
+}
+
+// Create a message to be delivered to a target endpoint
+func (r *Recorder) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return &recordedRequest{
+		Message:  r.transport.MessageTo(from, toService, toEndpoint),
+		service:  toService,
+		endpoint: toEndpoint,
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (r *Recorder) ReplyTo(msg usrv.Message) usrv.Message {
+	res := r.transport.ReplyTo(unwrapRecordedMessage(msg))
+	if req, ok := msg.(*recordedRequest); ok {
+		return &recordedReply{
+			Message: res,
+			request: req,
+		}
+	}
+	return res
+}
+
+// Get the message wrapped by a recordedRequest or recordedReply.
+func unwrapRecordedMessage(msg usrv.Message) usrv.Message {
+	switch wrapped := msg.(type) {
+	case *recordedRequest:
+		return wrapped.Message
+	case *recordedReply:
+		return wrapped.Message
+	}
+	return msg
+}
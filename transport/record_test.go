@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Start a server for the "srv" service with an "echo" and a "fail" endpoint.
+// The echo endpoint replies with the request content prefixed with prefix.
+func startRecordingTestServer(t *testing.T, tr usrv.Transport, prefix string) *usrv.Server {
+	srv := usrv.NewServer("srv", tr)
+	srv.Handle("echo", func(req, res usrv.Message) {
+		content, _ := req.Content()
+		res.Property().Set("tenant", req.Property().Get("tenant"))
+		res.SetContent(append([]byte(prefix), content...), nil)
+	})
+	srv.Handle("fail", func(req, res usrv.Message) {
+		res.SetContent(nil, fmt.Errorf("Failed"))
+	})
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewRecorder(NewInMemory(), &buf)
+	srv := startRecordingTestServer(t, tr, "echo:")
+	defer srv.Close()
+
+	client := usrv.NewClient("srv", tr)
+	req := client.NewMessage("test", "echo")
+	req.Property().Set("tenant", "acme")
+	req.SetContent([]byte("hello"), nil)
+	if _, err := (<-client.Send(req, time.Second)).Content(); err != nil {
+		t.Fatal(err)
+	}
+	<-client.Send(client.NewMessage("test", "fail"), time.Second)
+
+	exchanges, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each request should be recorded by both the server and the client side
+	if len(exchanges) != 4 {
+		t.Fatalf("Expected 4 recorded exchanges; got %d", len(exchanges))
+	}
+
+	spec := []struct {
+		side       string
+		endpoint   string
+		expContent string
+		expError   string
+	}{
+		{SideServer, "echo", "echo:hello", ""},
+		{SideClient, "echo", "echo:hello", ""},
+		{SideServer, "fail", "", "Failed"},
+		{SideClient, "fail", "", "Failed"},
+	}
+
+	for idx, s := range spec {
+		exchange := exchanges[idx]
+		if exchange.Side != s.side || exchange.Service != "srv" || exchange.Endpoint != s.endpoint {
+			t.Fatalf("[exchange %d] Expected %s exchange for srv/%s; got %s exchange for %s/%s", idx, s.side, s.endpoint, exchange.Side, exchange.Service, exchange.Endpoint)
+		}
+		if exchange.From != "test" {
+			t.Fatalf("[exchange %d] Expected sender to be 'test'; got '%s'", idx, exchange.From)
+		}
+		if string(exchange.Reply.Content) != s.expContent || exchange.Reply.Error != s.expError {
+			t.Fatalf("[exchange %d] Expected reply (%q, %q); got (%q, %q)", idx, s.expContent, s.expError, string(exchange.Reply.Content), exchange.Reply.Error)
+		}
+		if exchange.Time.IsZero() || exchange.Duration <= 0 {
+			t.Fatalf("[exchange %d] Expected exchange timing to be recorded", idx)
+		}
+	}
+
+	echo := exchanges[1]
+	if echo.CorrelationId != req.CorrelationId() {
+		t.Fatalf("Expected correlation id to be %s; got %s", req.CorrelationId(), echo.CorrelationId)
+	}
+	if string(echo.Request.Content) != "hello" || echo.Request.Property.Get("tenant") != "acme" {
+		t.Fatalf("Expected request payload to be recorded; got %v", echo.Request)
+	}
+	if echo.Reply.Property.Get("tenant") != "acme" {
+		t.Fatalf("Expected reply properties to be recorded; got %v", echo.Reply.Property)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recTr := NewRecorder(NewInMemory(), &buf)
+	recSrv := startRecordingTestServer(t, recTr, "echo:")
+	client := usrv.NewClient("srv", recTr)
+	for _, content := range []string{"a", "b"} {
+		req := client.NewMessage("test", "echo")
+		req.Property().Set("tenant", "acme")
+		req.SetContent([]byte(content), nil)
+		<-client.Send(req, time.Second)
+	}
+	<-client.Send(client.NewMessage("test", "fail"), time.Second)
+	recSrv.Close()
+
+	exchanges, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay against an unchanged server
+	tr := NewInMemory()
+	srv := startRecordingTestServer(t, tr, "echo:")
+	results := Replay(tr, exchanges, ReplayConfig{})
+	srv.Close()
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 replayed exchanges; got %d", len(results))
+	}
+	for idx, result := range results {
+		if !result.Matches() {
+			t.Fatalf("[result %d] Expected replayed reply to match; got diff %v", idx, result.Diff)
+		}
+	}
+
+	// Replay against a server whose behavior changed
+	tr = NewInMemory()
+	srv = startRecordingTestServer(t, tr, "changed:")
+	results = Replay(tr, exchanges, ReplayConfig{})
+	srv.Close()
+	for idx, result := range results {
+		expMatch := result.Exchange.Endpoint == "fail"
+		if result.Matches() != expMatch {
+			t.Fatalf("[result %d] Expected match to be %t; got diff %v", idx, expMatch, result.Diff)
+		}
+		if !expMatch && !strings.HasPrefix(result.Diff[0], "content:") {
+			t.Fatalf("[result %d] Expected content diff; got %v", idx, result.Diff)
+		}
+	}
+}
+
+func TestDiffReplies(t *testing.T) {
+	spec := []struct {
+		expected RecordedMessage
+		actual   RecordedMessage
+		expDiffs int
+	}{
+		{RecordedMessage{Content: []byte(`{"a":1,"b":2}`)}, RecordedMessage{Content: []byte(`{"b":2, "a":1}`)}, 0},
+		{RecordedMessage{Content: []byte(`{"a":1}`)}, RecordedMessage{Content: []byte(`{"a":2}`)}, 1},
+		{RecordedMessage{Error: "err"}, RecordedMessage{}, 1},
+		{RecordedMessage{Property: usrv.Property{"a": "1", "b": "2"}}, RecordedMessage{Property: usrv.Property{"a": "1", "c": "3"}}, 2},
+		{RecordedMessage{Property: usrv.Property{"cache": "hit"}}, RecordedMessage{Property: usrv.Property{"cache": "miss"}}, 0},
+	}
+
+	ignored := map[string]bool{"cache": true}
+	for idx, s := range spec {
+		if diff := diffReplies(s.expected, s.actual, ignored); len(diff) != s.expDiffs {
+			t.Fatalf("[spec %d] Expected %d diffs; got %v", idx, s.expDiffs, diff)
+		}
+	}
+}
+
+func TestReadRecordingError(t *testing.T) {
+	_, err := ReadRecording(strings.NewReader("{\"side\":\"client\"}\n\nnot json\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Fatalf("Expected a parse error for line 3; got %v", err)
+	}
+}
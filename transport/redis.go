@@ -0,0 +1,722 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/achilleasa/usrv"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+// How long stream reads block before checking whether the transport has been closed.
+const redisBlockTimeout = 100 * time.Millisecond
+
+// How long unread replies are retained after the last reply to a client.
+const redisReplyTTL = time.Minute
+
+// How long an endpoint stream is known to have a consumer group before it
+// is looked up again.
+const redisGroupTTL = 10 * time.Second
+
+// The internal message type used by the redis transport.
+type redisMessage struct {
+	from          string
+	to            string
+	property      usrv.Property
+	correlationId string
+	content       []byte
+	err           error
+
+	// The stream that the reply should be added to
+	replyTo string
+
+	// The stream, group and entry id of an incoming request; used to
+	// acknowledge the request once a reply is sent.
+	stream  string
+	group   string
+	entryId string
+
+	isReply bool
+}
+
+func (m *redisMessage) From() string {
+	return m.from
+}
+func (m *redisMessage) To() string {
+	return m.to
+}
+func (m *redisMessage) Property() usrv.Property {
+	return m.property
+}
+func (m *redisMessage) CorrelationId() string {
+	return m.correlationId
+}
+func (m *redisMessage) Content() ([]byte, error) {
+	return m.content, m.err
+}
+func (m *redisMessage) SetContent(content []byte, err error) {
+	m.content, m.err = content, err
+}
+
+// Encode message fields as stream entry values.
+func (m *redisMessage) values() map[string]interface{} {
+	values := map[string]interface{}{
+		"correlation_id": m.correlationId,
+		"from":           m.from,
+		"to":             m.to,
+		"content":        m.content,
+	}
+	if len(m.property) > 0 {
+		property, _ := json.Marshal(m.property)
+		values["property"] = property
+	}
+	if m.err != nil {
+		values["error"] = m.err.Error()
+	}
+	if m.replyTo != "" {
+		values["reply_to"] = m.replyTo
+	}
+	return values
+}
+
+// Decode the message fields of a stream entry.
+func (m *redisMessage) decode(values map[string]interface{}) {
+	field := func(key string) string {
+		val, _ := values[key].(string)
+		return val
+	}
+
+	m.correlationId = field("correlation_id")
+	m.from = field("from")
+	m.to = field("to")
+	m.replyTo = field("reply_to")
+	m.property = make(usrv.Property, 0)
+	if property := field("property"); property != "" {
+		json.Unmarshal([]byte(property), &m.property)
+	}
+	if content := field("content"); content != "" {
+		m.content = []byte(content)
+	}
+	m.err = frameError(field("error"))
+}
+
+type RedisConfig map[string]string
+
+func NewRedisConfig(addr string) RedisConfig {
+	return RedisConfig{
+		"addr": addr,
+	}
+}
+
+// A transport that exchanges messages via Redis Streams.
+//
+// Each service endpoint is backed by a "<prefix>:<service>/<endpoint>"
+// stream that is consumed by a consumer group shared by all transports bound
+// to the endpoint, so that requests are load balanced between service
+// replicas. Each transport receives replies to its requests via a private
+// "<prefix>:replies:<consumer>" stream.
+//
+// Requests that are delivered to a consumer but remain unacknowledged for
+// longer than the claim timeout (e.g. because the consumer crashed) are
+// reclaimed and processed by another consumer of the group, unless the
+// sender has already given up waiting for the reply. Consumers periodically
+// refresh the requests that their endpoints are still processing so that
+// slow handlers are not mistaken for crashed consumers; all consumers of a
+// group should therefore use the same claim timeout.
+type RedisTransport struct {
+	logger       usrv.Logger
+	options      *redis.Options
+	streamPrefix string
+	consumer     string
+	claimIdle    time.Duration
+
+	// A mutex for synchronized access to the client and the stream readers
+	sync.Mutex
+	client *redis.Client
+
+	// Closed when the transport is closed to stop the stream readers
+	closeChan chan struct{}
+	readers   sync.WaitGroup
+
+	// Reply channels for in-flight requests
+	pendingMutex  sync.Mutex
+	pending       map[string]chan *redisMessage
+	cancelChans   map[usrv.Message]chan struct{}
+	replyReaderOn bool
+
+	// Entry ids of requests that were delivered to bound endpoints but not
+	// yet replied to, grouped by endpoint stream
+	inflightMutex sync.Mutex
+	inflight      map[string]map[string]struct{}
+
+	// Expiry times for endpoint streams that are known to have a consumer group
+	groupMutex sync.Mutex
+	groups     map[string]time.Time
+}
+
+func NewRedis() *RedisTransport {
+	return &RedisTransport{
+		logger:       usrv.NullLogger,
+		options:      &redis.Options{Addr: "localhost:6379"},
+		streamPrefix: "usrv",
+		consumer:     uuid.New(),
+		claimIdle:    30 * time.Second,
+		closeChan:    make(chan struct{}, 0),
+		pending:      make(map[string]chan *redisMessage, 0),
+		cancelChans:  make(map[usrv.Message]chan struct{}, 0),
+		inflight:     make(map[string]map[string]struct{}, 0),
+		groups:       make(map[string]time.Time, 0),
+	}
+}
+
+func (t *RedisTransport) SetLogger(logger usrv.Logger) {
+	t.logger = logger
+}
+
+// Configure the transport. The following params are supported:
+//   - addr: the address of the redis server (default: localhost:6379)
+//   - password: the password for authenticating with the redis server
+//   - db: the redis database to use (default: 0)
+//   - streamPrefix: the prefix for stream keys (default: usrv)
+//   - claimIdle: the time after which unacknowledged requests are reclaimed
+//     from crashed consumers (default: 30s)
+//
+// Changing the configuration closes any existing connection; endpoints need
+// to be bound again.
+func (t *RedisTransport) Config(params map[string]string) error {
+	options := &redis.Options{
+		Addr:     "localhost:6379",
+		Password: params["password"],
+	}
+	if addr := params["addr"]; addr != "" {
+		options.Addr = addr
+	}
+	if dbVal := params["db"]; dbVal != "" {
+		db, err := strconv.Atoi(dbVal)
+		if err != nil {
+			return err
+		}
+		options.DB = db
+	}
+
+	claimIdle := 30 * time.Second
+	if claimIdleVal := params["claimIdle"]; claimIdleVal != "" {
+		var err error
+		claimIdle, err = time.ParseDuration(claimIdleVal)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.Close()
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.options = options
+	t.claimIdle = claimIdle
+	t.streamPrefix = "usrv"
+	if streamPrefix := params["streamPrefix"]; streamPrefix != "" {
+		t.streamPrefix = streamPrefix
+	}
+
+	t.logger.Info("Configuration changed", "addr", options.Addr, "db", options.DB, "streamPrefix", t.streamPrefix)
+	return nil
+}
+
+// Close the transport. The stream readers and the connection to the redis
+// server are closed. Requests that were delivered to bound endpoints but not
+// yet replied to remain pending and are eventually reclaimed by other
+// consumers.
+func (t *RedisTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.client == nil {
+		return nil
+	}
+
+	close(t.closeChan)
+	t.readers.Wait()
+	t.closeChan = make(chan struct{}, 0)
+
+	t.pendingMutex.Lock()
+	t.replyReaderOn = false
+	t.pendingMutex.Unlock()
+
+	t.inflightMutex.Lock()
+	t.inflight = make(map[string]map[string]struct{}, 0)
+	t.inflightMutex.Unlock()
+
+	t.groupMutex.Lock()
+	t.groups = make(map[string]time.Time, 0)
+	t.groupMutex.Unlock()
+
+	err := t.client.Close()
+	t.client = nil
+	return err
+}
+
+// Bind service endpoint. The endpoint stream and its consumer group are
+// created if they do not exist.
+func (t *RedisTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	client := t.connect()
+	stream := t.endpointStream(service, endpoint)
+	group := fmt.Sprintf("%s/%s", service, endpoint)
+	err := client.XGroupCreateMkStream(context.Background(), stream, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	msgChan := make(chan usrv.Message, 0)
+	t.readers.Add(1)
+	go t.readRequests(client, stream, group, msgChan, t.closeChan)
+
+	return msgChan, nil
+}
+
+func (t *RedisTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*redisMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	t.Lock()
+	client := t.connect()
+	closeChan := t.closeChan
+	t.Unlock()
+
+	if msg.isReply {
+		t.sendReply(client, msg)
+		return nil
+	}
+
+	replyChan := make(chan *redisMessage, 1)
+	cancelChan := make(chan struct{}, 0)
+	t.pendingMutex.Lock()
+	t.pending[msg.correlationId] = replyChan
+	t.cancelChans[m] = cancelChan
+	if !t.replyReaderOn {
+		t.replyReaderOn = true
+		t.readers.Add(1)
+		go t.readReplies(client, closeChan)
+	}
+	t.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
+	go func() {
+		resMsg := &redisMessage{
+			from:          msg.to,
+			to:            msg.from,
+			property:      make(usrv.Property, 0),
+			correlationId: msg.correlationId,
+		}
+
+		defer func() {
+			t.pendingMutex.Lock()
+			delete(t.pending, msg.correlationId)
+			delete(t.cancelChans, m)
+			t.pendingMutex.Unlock()
+
+			resChan <- resMsg
+			close(resChan)
+		}()
+
+		var timeoutChan <-chan time.Time
+		var deadline int64
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
+			deadline = time.Now().Add(timeout).UnixNano() / int64(time.Millisecond)
+		}
+
+		err := t.sendRequest(client, msg, deadline)
+		if err != nil {
+			if err != usrv.ErrServiceUnavailable {
+				t.logger.Error(
+					"Redis request failed",
+					"from", msg.from,
+					"to", msg.to,
+					"err", err.Error(),
+				)
+			}
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		select {
+		case reply := <-replyChan:
+			resMsg.property = reply.property
+			resMsg.SetContent(reply.content, reply.err)
+		case <-timeoutChan:
+			resMsg.SetContent(nil, usrv.ErrTimeout)
+		case <-cancelChan:
+			resMsg.SetContent(nil, usrv.ErrCancelled)
+		case <-closeChan:
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+		}
+	}()
+
+	return resChan
+}
+
+// Cancel an in-flight request.
+func (t *RedisTransport) Cancel(m usrv.Message) {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	if cancelChan, found := t.cancelChans[m]; found {
+		close(cancelChan)
+		delete(t.cancelChans, m)
+	}
+}
+
+// Create a message to be delivered to a target endpoint
+func (t *RedisTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return &redisMessage{
+		from:          from,
+		to:            fmt.Sprintf("%s/%s", toService, toEndpoint),
+		property:      make(usrv.Property, 0),
+		correlationId: uuid.New(),
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *RedisTransport) ReplyTo(msg usrv.Message) usrv.Message {
+	reqMsg, ok := msg.(*redisMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	return &redisMessage{
+		from:          reqMsg.to,
+		to:            reqMsg.from,
+		property:      make(usrv.Property, 0),
+		correlationId: reqMsg.correlationId,
+		replyTo:       reqMsg.replyTo,
+		stream:        reqMsg.stream,
+		group:         reqMsg.group,
+		entryId:       reqMsg.entryId,
+		isReply:       true,
+	}
+}
+
+// Add a request to the stream of the endpoint it is addressed to. Returns
+// ErrServiceUnavailable if no consumer group has been created for the endpoint.
+func (t *RedisTransport) sendRequest(client *redis.Client, msg *redisMessage, deadline int64) error {
+	ctx := context.Background()
+	service, endpoint := splitStreamAddress(msg.to)
+	stream := t.endpointStream(service, endpoint)
+
+	if err := t.checkGroup(ctx, client, stream); err != nil {
+		return err
+	}
+
+	values := msg.values()
+	values["reply_to"] = t.replyStream()
+	values["deadline"] = deadline
+	return client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: values,
+	}).Err()
+}
+
+// Add a reply to the reply stream of the sender and acknowledge the request.
+func (t *RedisTransport) sendReply(client *redis.Client, msg *redisMessage) {
+	ctx := context.Background()
+	pipe := client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: msg.replyTo,
+		Values: msg.values(),
+	})
+	pipe.Expire(ctx, msg.replyTo, redisReplyTTL)
+	pipe.XAck(ctx, msg.stream, msg.group, msg.entryId)
+	pipe.XDel(ctx, msg.stream, msg.entryId)
+
+	t.inflightMutex.Lock()
+	delete(t.inflight[msg.stream], msg.entryId)
+	t.inflightMutex.Unlock()
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.logger.Error(
+			"Failed to send reply",
+			"from", msg.from,
+			"to", msg.to,
+			"err", err.Error(),
+		)
+	}
+}
+
+// Read requests from an endpoint stream and deliver them to msgChan until
+// closeChan is closed. Pending requests of crashed consumers are reclaimed
+// periodically while requests that are still being processed are refreshed.
+func (t *RedisTransport) readRequests(client *redis.Client, stream, group string, msgChan chan usrv.Message, closeChan chan struct{}) {
+	defer t.readers.Done()
+
+	ctx := context.Background()
+	claimTicker := time.NewTicker(t.claimInterval())
+	defer claimTicker.Stop()
+
+	deliver := func(entries []redis.XMessage) bool {
+		for _, entry := range entries {
+			reqMsg := &redisMessage{
+				stream:  stream,
+				group:   group,
+				entryId: entry.ID,
+			}
+			reqMsg.decode(entry.Values)
+
+			// Drop requests whose sender has already given up
+			deadline, _ := strconv.ParseInt(fmt.Sprint(entry.Values["deadline"]), 10, 64)
+			if deadline > 0 && time.Now().UnixNano()/int64(time.Millisecond) > deadline {
+				client.XAck(ctx, stream, group, entry.ID)
+				client.XDel(ctx, stream, entry.ID)
+				continue
+			}
+
+			t.inflightMutex.Lock()
+			if t.inflight[stream] == nil {
+				t.inflight[stream] = make(map[string]struct{}, 0)
+			}
+			t.inflight[stream][entry.ID] = struct{}{}
+			t.inflightMutex.Unlock()
+
+			select {
+			case msgChan <- reqMsg:
+			case <-closeChan:
+				t.inflightMutex.Lock()
+				delete(t.inflight[stream], entry.ID)
+				t.inflightMutex.Unlock()
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-closeChan:
+			return
+		case <-claimTicker.C:
+			t.refreshInflight(client, stream, group)
+			entries, err := t.claimPending(client, stream, group)
+			if err != nil {
+				t.logger.Error("Failed to reclaim pending requests", "stream", stream, "err", err.Error())
+				continue
+			}
+			if !deliver(entries) {
+				return
+			}
+			continue
+		default:
+		}
+
+		streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: t.consumer,
+			Streams:  []string{stream, ">"},
+			Count:    10,
+			Block:    redisBlockTimeout,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			select {
+			case <-closeChan:
+				return
+			case <-time.After(redisBlockTimeout):
+			}
+			t.logger.Error("Failed to read requests", "stream", stream, "err", err.Error())
+			continue
+		}
+
+		for _, s := range streams {
+			if !deliver(s.Messages) {
+				return
+			}
+		}
+	}
+}
+
+// Read replies from the reply stream of the transport and dispatch them to
+// the matching in-flight requests until closeChan is closed.
+func (t *RedisTransport) readReplies(client *redis.Client, closeChan chan struct{}) {
+	defer t.readers.Done()
+
+	ctx := context.Background()
+	stream := t.replyStream()
+	lastId := "0-0"
+	for {
+		select {
+		case <-closeChan:
+			return
+		default:
+		}
+
+		streams, err := client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{stream, lastId},
+			Count:   100,
+			Block:   redisBlockTimeout,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			select {
+			case <-closeChan:
+				return
+			case <-time.After(redisBlockTimeout):
+			}
+			t.logger.Error("Failed to read replies", "stream", stream, "err", err.Error())
+			continue
+		}
+
+		for _, s := range streams {
+			ids := make([]string, 0, len(s.Messages))
+			for _, entry := range s.Messages {
+				lastId = entry.ID
+				ids = append(ids, entry.ID)
+
+				reply := &redisMessage{}
+				reply.decode(entry.Values)
+
+				t.pendingMutex.Lock()
+				replyChan, found := t.pending[reply.correlationId]
+				delete(t.pending, reply.correlationId)
+				t.pendingMutex.Unlock()
+
+				if found {
+					replyChan <- reply
+				}
+			}
+			client.XDel(ctx, stream, ids...)
+		}
+	}
+}
+
+// Reset the idle time of the requests that are still being processed by the
+// endpoint so that they are not reclaimed by other consumers.
+func (t *RedisTransport) refreshInflight(client *redis.Client, stream, group string) {
+	t.inflightMutex.Lock()
+	ids := make([]string, 0, len(t.inflight[stream]))
+	for id := range t.inflight[stream] {
+		ids = append(ids, id)
+	}
+	t.inflightMutex.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	err := client.XClaimJustID(context.Background(), &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: t.consumer,
+		Messages: ids,
+	}).Err()
+	if err != nil {
+		t.logger.Error("Failed to refresh pending requests", "stream", stream, "err", err.Error())
+	}
+}
+
+// Claim the requests of other consumers of the group that have not been
+// acknowledged for longer than the claim timeout. Requests pending for this
+// consumer are never reclaimed as they are still being processed.
+func (t *RedisTransport) claimPending(client *redis.Client, stream, group string) ([]redis.XMessage, error) {
+	ctx := context.Background()
+	pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Idle:   t.claimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  10,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(pending))
+	for _, entry := range pending {
+		if entry.Consumer != t.consumer {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// Entries that were refreshed by their consumer in the meantime are
+	// not claimed
+	return client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: t.consumer,
+		MinIdle:  t.claimIdle,
+		Messages: ids,
+	}).Result()
+}
+
+// Check that a consumer group has been created for an endpoint stream.
+// Returns ErrServiceUnavailable if the stream has no consumer group. Streams
+// with a consumer group are cached so that they are not looked up for each
+// request.
+func (t *RedisTransport) checkGroup(ctx context.Context, client *redis.Client, stream string) error {
+	t.groupMutex.Lock()
+	expiry, found := t.groups[stream]
+	t.groupMutex.Unlock()
+	if found && time.Now().Before(expiry) {
+		return nil
+	}
+
+	groups, err := client.XInfoGroups(ctx, stream).Result()
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		return usrv.ErrServiceUnavailable
+	} else if err != nil {
+		return err
+	} else if len(groups) == 0 {
+		return usrv.ErrServiceUnavailable
+	}
+
+	t.groupMutex.Lock()
+	t.groups[stream] = time.Now().Add(redisGroupTTL)
+	t.groupMutex.Unlock()
+	return nil
+}
+
+// Get the interval for checking for pending requests of crashed consumers.
+func (t *RedisTransport) claimInterval() time.Duration {
+	interval := t.claimIdle / 2
+	if interval < redisBlockTimeout {
+		interval = redisBlockTimeout
+	}
+	return interval
+}
+
+// Get the stream key for a service endpoint.
+func (t *RedisTransport) endpointStream(service string, endpoint string) string {
+	return fmt.Sprintf("%s:%s/%s", t.streamPrefix, service, endpoint)
+}
+
+// Get the key of the stream for replies to requests sent by this transport.
+func (t *RedisTransport) replyStream() string {
+	return fmt.Sprintf("%s:replies:%s", t.streamPrefix, t.consumer)
+}
+
+// Ensure that the transport has a redis client. This method must be called
+// while holding the transport lock.
+func (t *RedisTransport) connect() *redis.Client {
+	if t.client == nil {
+		t.client = redis.NewClient(t.options)
+	}
+	return t.client
+}
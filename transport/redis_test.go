@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"github.com/alicebob/miniredis/v2"
+	"golang.org/x/net/context"
+)
+
+func TestRedisTransport(t *testing.T) {
+	redisSrv := miniredis.RunT(t)
+
+	usrvtest.RunTransportSuite(t, "srv", func() usrv.Transport {
+		tr := NewRedis()
+		tr.Config(NewRedisConfig(redisSrv.Addr()))
+		return tr
+	})
+}
+
+func TestRedisTransportReclaimsPendingRequests(t *testing.T) {
+	redisSrv := miniredis.RunT(t)
+
+	// A consumer that receives a request and crashes before replying
+	crashedTr := NewRedis()
+	crashedTr.Config(NewRedisConfig(redisSrv.Addr()))
+	reqChan, err := crashedTr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientTr := NewRedis()
+	clientTr.Config(NewRedisConfig(redisSrv.Addr()))
+	defer clientTr.Close()
+
+	reqMsg := clientTr.MessageTo("test", "srv", "ep1")
+	reqMsg.SetContent([]byte("hello"), nil)
+	resChan := clientTr.Send(reqMsg, 5*time.Second, true)
+
+	select {
+	case <-reqChan:
+		crashedTr.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for request to be delivered")
+	}
+
+	// Another replica should reclaim the pending request
+	tr := NewRedis()
+	err = tr.Config(RedisConfig{
+		"addr":      redisSrv.Addr(),
+		"claimIdle": "200ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	reqChan, err = tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		reqMsg := <-reqChan
+		content, _ := reqMsg.Content()
+		resMsg := tr.ReplyTo(reqMsg)
+		resMsg.SetContent(append([]byte("reclaimed:"), content...), nil)
+		tr.Send(resMsg, 0, false)
+	}()
+
+	content, err := (<-resChan).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "reclaimed:hello"; string(content) != exp {
+		t.Fatalf("Expected reply %q; got %q", exp, string(content))
+	}
+
+	// Acknowledged requests should be removed from the endpoint stream
+	if entries, _ := redisSrv.Stream("usrv:srv/ep1"); len(entries) != 0 {
+		t.Fatalf("Expected endpoint stream to be empty; got %d entries", len(entries))
+	}
+}
+
+func TestRedisTransportSlowHandlers(t *testing.T) {
+	redisSrv := miniredis.RunT(t)
+
+	// Two replicas of a service whose handler takes longer than the claim timeout
+	delivered := make(chan string, 10)
+	for i := 0; i < 2; i++ {
+		tr := NewRedis()
+		err := tr.Config(RedisConfig{
+			"addr":      redisSrv.Addr(),
+			"claimIdle": "200ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+
+		reqChan, err := tr.Bind("srv", "ep1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(tr *RedisTransport) {
+			for reqMsg := range reqChan {
+				delivered <- reqMsg.CorrelationId()
+				time.Sleep(600 * time.Millisecond)
+				resMsg := tr.ReplyTo(reqMsg)
+				resMsg.SetContent([]byte("done"), nil)
+				tr.Send(resMsg, 0, false)
+			}
+		}(tr)
+	}
+
+	clientTr := NewRedis()
+	clientTr.Config(NewRedisConfig(redisSrv.Addr()))
+	defer clientTr.Close()
+
+	reqMsg := clientTr.MessageTo("test", "srv", "ep1")
+	if _, err := (<-clientTr.Send(reqMsg, 5*time.Second, true)).Content(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request should neither be reclaimed by the consumer processing it
+	// nor by the other replica
+	<-delivered
+	select {
+	case correlationId := <-delivered:
+		t.Fatalf("Expected request to be delivered once; got another delivery of %s", correlationId)
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestRedisTransportDropsExpiredRequests(t *testing.T) {
+	redisSrv := miniredis.RunT(t)
+
+	tr := NewRedis()
+	tr.Config(NewRedisConfig(redisSrv.Addr()))
+	defer tr.Close()
+
+	// Create the endpoint consumer group without consuming requests
+	client := tr.connect()
+	if err := client.XGroupCreateMkStream(context.Background(), "usrv:srv/ep1", "srv/ep1", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg := tr.MessageTo("test", "srv", "ep1")
+	if _, err := (<-tr.Send(reqMsg, 10*time.Millisecond, true)).Content(); err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", err)
+	}
+
+	// The expired request should be dropped instead of being delivered
+	reqChan, err := tr.Bind("srv", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reqMsg := <-reqChan:
+		t.Fatalf("Expected expired request to be dropped; got request %s", reqMsg.CorrelationId())
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestRedisTransportConfigErrors(t *testing.T) {
+	tr := NewRedis()
+	spec := []RedisConfig{
+		{"db": "zero"},
+		{"claimIdle": "forever"},
+	}
+	for idx, params := range spec {
+		if err := tr.Config(params); err == nil {
+			t.Fatalf("[spec %d] Expected an error", idx)
+		}
+	}
+}
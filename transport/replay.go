@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Configuration options for Replay.
+type ReplayConfig struct {
+	// The timeout for each replayed request (default: 1s).
+	Timeout time.Duration
+
+	// Reply properties that are excluded from the comparison (e.g.
+	// properties whose values differ between runs).
+	IgnoreProperties []string
+}
+
+// The outcome of replaying a recorded exchange.
+type ReplayResult struct {
+	// The recorded exchange.
+	Exchange RecordedExchange
+
+	// The reply received when the request was replayed.
+	Reply RecordedMessage
+
+	// A description of each difference between the recorded and the
+	// replayed reply. Empty if the replies match.
+	Diff []string
+}
+
+// Check whether the replayed reply matches the recorded one.
+func (r *ReplayResult) Matches() bool {
+	return len(r.Diff) == 0
+}
+
+// Read a recording in JSON-lines format, as written by a Recorder.
+func ReadRecording(reader io.Reader) ([]RecordedExchange, error) {
+	exchanges := make([]RecordedExchange, 0)
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var exchange RecordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		exchanges = append(exchanges, exchange)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return exchanges, nil
+}
+
+// Re-send recorded requests through transport in their recorded order and
+// compare the replies against the recorded ones. Typically, transport is an
+// InMemTransport with a Server bound to the recorded service endpoints.
+//
+// Exchanges recorded on both the client and the server side of the same
+// transport are only replayed once.
+func Replay(transport usrv.Transport, exchanges []RecordedExchange, config ReplayConfig) []ReplayResult {
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+
+	ignored := make(map[string]bool, len(config.IgnoreProperties))
+	for _, key := range config.IgnoreProperties {
+		ignored[key] = true
+	}
+
+	results := make([]ReplayResult, 0, len(exchanges))
+	replayed := make(map[string]bool, 0)
+	for _, exchange := range exchanges {
+		key := exchange.Service + "/" + exchange.Endpoint + "/" + exchange.CorrelationId
+		if replayed[key] {
+			continue
+		}
+		replayed[key] = true
+
+		req := transport.MessageTo(exchange.From, exchange.Service, exchange.Endpoint)
+		for k, v := range exchange.Request.Property {
+			req.Property().Set(k, v)
+		}
+		req.SetContent(exchange.Request.Content, nil)
+
+		reply := recordMessage(<-transport.Send(req, config.Timeout, true))
+		results = append(results, ReplayResult{
+			Exchange: exchange,
+			Reply:    reply,
+			Diff:     diffReplies(exchange.Reply, reply, ignored),
+		})
+	}
+
+	return results
+}
+
+// Describe the differences between a recorded and a replayed reply. JSON
+// payloads are compared semantically so that field ordering does not matter.
+func diffReplies(expected, actual RecordedMessage, ignored map[string]bool) []string {
+	diff := make([]string, 0)
+
+	if expected.Error != actual.Error {
+		diff = append(diff, fmt.Sprintf("error: expected %q; got %q", expected.Error, actual.Error))
+	}
+
+	if !equalPayloads(expected.Content, actual.Content) {
+		diff = append(diff, fmt.Sprintf("content: expected %q; got %q", expected.Content, actual.Content))
+	}
+
+	keys := make([]string, 0)
+	for k := range expected.Property {
+		keys = append(keys, k)
+	}
+	for k := range actual.Property {
+		if _, found := expected.Property[k]; !found {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if ignored[k] {
+			continue
+		}
+		if expVal, actVal := expected.Property.Get(k), actual.Property.Get(k); expVal != actVal {
+			diff = append(diff, fmt.Sprintf("property %q: expected %q; got %q", k, expVal, actVal))
+		}
+	}
+
+	return diff
+}
+
+// Compare two payloads. If both are valid JSON documents they are compared
+// semantically; otherwise they are compared byte by byte.
+func equalPayloads(expected, actual []byte) bool {
+	if bytes.Equal(expected, actual) {
+		return true
+	}
+
+	var expDoc, actDoc interface{}
+	if json.Unmarshal(expected, &expDoc) != nil || json.Unmarshal(actual, &actDoc) != nil {
+		return false
+	}
+	return reflect.DeepEqual(expDoc, actDoc)
+}
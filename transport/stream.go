@@ -0,0 +1,571 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/achilleasa/usrv"
+)
+
+var errDuplicateCorrelationId = errors.New("A request with the same correlation id is already in flight")
+
+// Tunable settings for stream-based transports.
+type streamSettings struct {
+	// The max size of frames sent or received over a connection
+	maxFrameSize int
+
+	// The max number of incoming requests per connection that may be
+	// waiting for delivery to their endpoint. Once reached, no further
+	// requests are read from the connection until a request is delivered.
+	maxInFlight int
+
+	// The time allowed for writing a frame to a connection
+	writeTimeout time.Duration
+}
+
+// Get the default settings for stream-based transports.
+func defaultStreamSettings() streamSettings {
+	return streamSettings{
+		maxFrameSize: defaultMaxFrameSize,
+		maxInFlight:  128,
+		writeTimeout: 10 * time.Second,
+	}
+}
+
+// Parse the tunable settings from the transport config params. Settings that
+// are not specified use their default value.
+func parseStreamSettings(params map[string]string) (streamSettings, error) {
+	settings := defaultStreamSettings()
+
+	ints := map[string]*int{
+		"maxFrameSize": &settings.maxFrameSize,
+		"maxInFlight":  &settings.maxInFlight,
+	}
+	for key, dst := range ints {
+		if val := params[key]; val != "" {
+			num, err := strconv.Atoi(val)
+			if err != nil || num <= 0 {
+				return settings, fmt.Errorf("Invalid %s '%s'; expected a positive integer", key, val)
+			}
+			*dst = num
+		}
+	}
+
+	if val := params["writeTimeout"]; val != "" {
+		duration, err := time.ParseDuration(val)
+		if err != nil {
+			return settings, fmt.Errorf("Invalid writeTimeout '%s': %s", val, err.Error())
+		}
+		settings.writeTimeout = duration
+	}
+
+	return settings, nil
+}
+
+// Write a frame to a connection, failing if the write does not complete
+// within the configured write timeout. The caller must serialize writes.
+func writeConnFrame(conn net.Conn, f *frame, settings streamSettings) error {
+	if settings.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	return writeFrame(conn, f, settings.maxFrameSize)
+}
+
+// The internal message type used by stream-based transports. Messages are
+// addressed to "service/endpoint".
+type streamMessage struct {
+	from          string
+	to            string
+	property      usrv.Property
+	correlationId string
+	content       []byte
+	err           error
+
+	isReply bool
+
+	// The connection that the request was received from
+	conn *serverConn
+}
+
+func (m *streamMessage) From() string {
+	return m.from
+}
+func (m *streamMessage) To() string {
+	return m.to
+}
+func (m *streamMessage) Property() usrv.Property {
+	return m.property
+}
+func (m *streamMessage) CorrelationId() string {
+	return m.correlationId
+}
+func (m *streamMessage) Content() ([]byte, error) {
+	return m.content, m.err
+}
+func (m *streamMessage) SetContent(content []byte, err error) {
+	m.content, m.err = content, err
+}
+
+// Create a message to be delivered to a target endpoint.
+func newStreamMessage(from string, toService string, toEndpoint string) *streamMessage {
+	return &streamMessage{
+		from:          from,
+		to:            fmt.Sprintf("%s/%s", toService, toEndpoint),
+		property:      make(usrv.Property, 0),
+		correlationId: uuid.New(),
+	}
+}
+
+// Create a message that serves as a reply to an incoming message.
+func newStreamReply(msg usrv.Message) *streamMessage {
+	reqMsg, ok := msg.(*streamMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	return &streamMessage{
+		from:          reqMsg.to,
+		to:            reqMsg.from,
+		property:      make(usrv.Property, 0),
+		correlationId: reqMsg.correlationId,
+		isReply:       true,
+		conn:          reqMsg.conn,
+	}
+}
+
+// Split a "service/endpoint" address into its service and endpoint parts.
+func splitStreamAddress(to string) (service string, endpoint string) {
+	idx := strings.LastIndex(to, "/")
+	if idx == -1 {
+		return to, ""
+	}
+	return to[:idx], to[idx+1:]
+}
+
+// A server-side connection. Replies may be written concurrently by multiple
+// endpoint handlers.
+type serverConn struct {
+	conn     net.Conn
+	settings streamSettings
+
+	// If set, the sender of each request is the verified identity of the
+	// peer (empty for unverified peers) instead of the sender specified by
+	// the request.
+	authenticated bool
+	peer          string
+
+	// A mutex for serializing writes to the connection
+	sync.Mutex
+}
+
+func (c *serverConn) writeFrame(f *frame) error {
+	c.Lock()
+	defer c.Unlock()
+
+	return writeConnFrame(c.conn, f, c.settings)
+}
+
+// Write a reply to the connection that its request was received from. If the
+// reply cannot be encoded (e.g. its content is too large), the request fails
+// with ErrInternal. If the reply cannot be written, the connection is closed
+// so that the client aborts its in-flight requests.
+func (c *serverConn) reply(logger usrv.Logger, msg *streamMessage) {
+	err := c.writeFrame(&frame{
+		kind:          frameReply,
+		correlationId: msg.correlationId,
+		from:          msg.from,
+		to:            msg.to,
+		property:      msg.property,
+		err:           errorString(msg.err),
+		content:       msg.content,
+	})
+	if err == errFrameTooLarge {
+		logger.Error(
+			"Failed to encode reply",
+			"from", msg.from,
+			"to", msg.to,
+			"err", err.Error(),
+		)
+		err = c.writeFrame(&frame{
+			kind:          frameReply,
+			correlationId: msg.correlationId,
+			from:          msg.from,
+			to:            msg.to,
+			err:           usrv.ErrInternal.Error(),
+		})
+	}
+	if err != nil {
+		logger.Error(
+			"Failed to send reply",
+			"from", msg.from,
+			"to", msg.to,
+			"err", err.Error(),
+		)
+		c.conn.Close()
+	}
+}
+
+// Read request frames from a connection and deliver them to the channel
+// returned by lookup until the connection fails or closeChan is closed.
+func (c *serverConn) serve(logger usrv.Logger, lookup func(to string) (chan usrv.Message, bool), closeChan chan struct{}) {
+	// Limit the number of requests waiting for delivery
+	inFlight := make(chan struct{}, c.settings.maxInFlight)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		f, err := readFrame(reader, c.settings.maxFrameSize)
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-closeChan:
+				default:
+					logger.Error("Failed to read request", "remote", c.conn.RemoteAddr().String(), "err", err.Error())
+				}
+			}
+			return
+		}
+		if f.kind != frameRequest {
+			continue
+		}
+
+		reqMsg := &streamMessage{
+			from:          f.from,
+			to:            f.to,
+			property:      f.property,
+			correlationId: f.correlationId,
+			content:       f.content,
+			conn:          c,
+		}
+		if c.authenticated {
+			reqMsg.from = c.peer
+		}
+
+		msgChan, found := lookup(f.to)
+		if !found {
+			resMsg := newStreamReply(reqMsg)
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			c.reply(logger, resMsg)
+			continue
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		case <-closeChan:
+			return
+		}
+
+		// Deliver asynchronously so that slow endpoints do not stall
+		// other requests multiplexed over the same connection.
+		go func() {
+			defer func() { <-inFlight }()
+
+			select {
+			case msgChan <- reqMsg:
+			case <-closeChan:
+			}
+		}()
+	}
+}
+
+// A client-side connection that multiplexes concurrent requests. Replies are
+// matched to requests by their correlation id.
+type clientConn struct {
+	conn     net.Conn
+	settings streamSettings
+
+	// A mutex for serializing writes to the connection
+	writeMutex sync.Mutex
+
+	// Reply channels for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[string]chan *frame
+	closed       bool
+}
+
+// Send a request frame and return a channel that emits its reply. The
+// channel is closed without emitting a reply if the connection fails.
+// Requests whose correlation id matches another in-flight request are
+// rejected as their replies could not be told apart.
+func (c *clientConn) roundTrip(f *frame) (<-chan *frame, error) {
+	replyChan := make(chan *frame, 1)
+
+	c.pendingMutex.Lock()
+	if c.closed {
+		c.pendingMutex.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	if _, found := c.pending[f.correlationId]; found {
+		c.pendingMutex.Unlock()
+		return nil, errDuplicateCorrelationId
+	}
+	c.pending[f.correlationId] = replyChan
+	c.pendingMutex.Unlock()
+
+	c.writeMutex.Lock()
+	err := writeConnFrame(c.conn, f, c.settings)
+	c.writeMutex.Unlock()
+
+	if err != nil {
+		c.forget(f.correlationId)
+		c.conn.Close()
+		return nil, err
+	}
+	return replyChan, nil
+}
+
+// Stop waiting for the reply to a request.
+func (c *clientConn) forget(correlationId string) {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	delete(c.pending, correlationId)
+}
+
+// Check whether the connection has failed.
+func (c *clientConn) isClosed() bool {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	return c.closed
+}
+
+// Dispatch reply frames to the matching in-flight requests until the
+// connection fails. Any requests still in flight are then aborted.
+func (c *clientConn) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		f, err := readFrame(reader, c.settings.maxFrameSize)
+		if err != nil {
+			break
+		}
+		if f.kind != frameReply {
+			continue
+		}
+
+		c.pendingMutex.Lock()
+		replyChan, found := c.pending[f.correlationId]
+		delete(c.pending, f.correlationId)
+		c.pendingMutex.Unlock()
+
+		if found {
+			replyChan <- f
+		}
+	}
+
+	c.conn.Close()
+
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	c.closed = true
+	for correlationId, replyChan := range c.pending {
+		close(replyChan)
+		delete(c.pending, correlationId)
+	}
+}
+
+// The client side of a stream-based transport. It maintains a persistent
+// connection per remote address and multiplexes requests over it.
+type streamClient struct {
+	// Open a connection to a remote address
+	dial func(addr string) (net.Conn, error)
+
+	// A mutex for synchronized access to the client connections and settings
+	connMutex sync.Mutex
+	conns     map[string]*clientConn
+	settings  streamSettings
+
+	// Channels that are closed when an in-progress dial completes
+	dialing map[string]chan struct{}
+
+	// Cancellation channels for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]chan struct{}
+}
+
+func newStreamClient(dial func(addr string) (net.Conn, error), settings streamSettings) *streamClient {
+	return &streamClient{
+		dial:     dial,
+		settings: settings,
+		conns:    make(map[string]*clientConn, 0),
+		dialing:  make(map[string]chan struct{}, 0),
+		pending:  make(map[usrv.Message]chan struct{}, 0),
+	}
+}
+
+// Change the settings used by connections that are dialed afterwards.
+func (c *streamClient) setSettings(settings streamSettings) {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	c.settings = settings
+}
+
+// Send a request to the server at addr and return a channel that emits the reply.
+func (c *streamClient) send(logger usrv.Logger, m usrv.Message, addr string, timeout time.Duration) <-chan usrv.Message {
+	msg := m.(*streamMessage)
+
+	cancelChan := make(chan struct{}, 0)
+	c.pendingMutex.Lock()
+	c.pending[m] = cancelChan
+	c.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
+	go func() {
+		resMsg := &streamMessage{
+			from:          msg.to,
+			to:            msg.from,
+			property:      make(usrv.Property, 0),
+			correlationId: msg.correlationId,
+		}
+
+		defer func() {
+			c.pendingMutex.Lock()
+			delete(c.pending, m)
+			c.pendingMutex.Unlock()
+
+			resChan <- resMsg
+			close(resChan)
+		}()
+
+		var timeoutChan <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
+		}
+
+		conn, err := c.conn(addr)
+		var replyChan <-chan *frame
+		if err == nil {
+			replyChan, err = conn.roundTrip(&frame{
+				kind:          frameRequest,
+				correlationId: msg.correlationId,
+				from:          msg.from,
+				to:            msg.to,
+				property:      msg.property,
+				content:       msg.content,
+			})
+		}
+		if err == errDuplicateCorrelationId {
+			resMsg.SetContent(nil, err)
+			return
+		} else if err != nil {
+			logger.Error(
+				"Request failed",
+				"from", msg.from,
+				"to", msg.to,
+				"err", err.Error(),
+			)
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		select {
+		case f, ok := <-replyChan:
+			if !ok {
+				resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+				return
+			}
+			resMsg.property = f.property
+			resMsg.SetContent(f.content, frameError(f.err))
+		case <-timeoutChan:
+			conn.forget(msg.correlationId)
+			resMsg.SetContent(nil, usrv.ErrTimeout)
+		case <-cancelChan:
+			conn.forget(msg.correlationId)
+			resMsg.SetContent(nil, usrv.ErrCancelled)
+		}
+	}()
+
+	return resChan
+}
+
+// Cancel an in-flight request.
+func (c *streamClient) cancel(m usrv.Message) {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	if cancelChan, found := c.pending[m]; found {
+		close(cancelChan)
+		delete(c.pending, m)
+	}
+}
+
+// Close all client connections.
+func (c *streamClient) close() {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	for addr, conn := range c.conns {
+		conn.conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+// Get a connection to the server at addr, dialing a new connection if needed.
+// Dialing happens without holding the connection lock so that a slow server
+// does not block requests to other servers; concurrent requests to the same
+// server wait for the in-progress dial instead of dialing again.
+func (c *streamClient) conn(addr string) (*clientConn, error) {
+	c.connMutex.Lock()
+	for {
+		if conn, found := c.conns[addr]; found {
+			if !conn.isClosed() {
+				c.connMutex.Unlock()
+				return conn, nil
+			}
+			delete(c.conns, addr)
+		}
+
+		dialChan, found := c.dialing[addr]
+		if !found {
+			break
+		}
+		c.connMutex.Unlock()
+		<-dialChan
+		c.connMutex.Lock()
+	}
+
+	dialChan := make(chan struct{}, 0)
+	c.dialing[addr] = dialChan
+	settings := c.settings
+	c.connMutex.Unlock()
+
+	netConn, err := c.dial(addr)
+
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	delete(c.dialing, addr)
+	close(dialChan)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &clientConn{
+		conn:     netConn,
+		settings: settings,
+		pending:  make(map[string]chan *frame, 0),
+	}
+	c.conns[addr] = conn
+	go conn.readLoop()
+
+	return conn, nil
+}
+
+// Get the message of an error or an empty string if err is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
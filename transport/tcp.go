@@ -0,0 +1,339 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+var (
+	errMissingPort = errors.New("A port must be configured before binding endpoints")
+)
+
+type TcpConfig map[string]string
+
+func NewTcpConfig(serverPort int) TcpConfig {
+	return TcpConfig{
+		"port": fmt.Sprint(serverPort),
+	}
+}
+
+// Create a configuration for TLS. The server presents the supplied certificate
+// and outgoing connections verify server certificates against the CA bundle
+// in rootCAFile.
+func NewTcpTlsConfig(serverPort int, certFile, certKeyFile, rootCAFile string) TcpConfig {
+	return TcpConfig{
+		"port":        fmt.Sprint(serverPort),
+		"certFile":    certFile,
+		"certKeyFile": certKeyFile,
+		"rootCAFile":  rootCAFile,
+	}
+}
+
+// A transport that exchanges length-prefixed binary frames over persistent
+// TCP connections. Concurrent requests to the same server are multiplexed
+// over a single connection.
+//
+// Services are addressed using their "host:port" address. Servers route
+// incoming requests to the endpoint bound with a matching service address and
+// endpoint name, so services must be bound using the address that clients
+// use to reach them.
+type TcpTransport struct {
+	logger      usrv.Logger
+	port        int
+	certFile    string
+	certKeyFile string
+	settings    streamSettings
+	dialer      *net.Dialer
+
+	// TLS settings for the server; used to verify client certificates
+	tlsConfig *tls.Config
+
+	// TLS settings for outgoing connections
+	clientTlsConfig *tls.Config
+	useTls          bool
+
+	// A mutex for synchronized access to the listener and the bound endpoints
+	sync.Mutex
+	listener    net.Listener
+	msgChans    map[string]chan usrv.Message
+	serverConns map[*serverConn]struct{}
+	closeChan   chan struct{}
+
+	client *streamClient
+}
+
+func NewTcp() *TcpTransport {
+	t := &TcpTransport{
+		logger:      usrv.NullLogger,
+		settings:    defaultStreamSettings(),
+		dialer:      &net.Dialer{Timeout: defaultDialTimeout},
+		msgChans:    make(map[string]chan usrv.Message, 0),
+		serverConns: make(map[*serverConn]struct{}, 0),
+	}
+	t.client = newStreamClient(t.dial, t.settings)
+	return t
+}
+
+func (t *TcpTransport) SetLogger(logger usrv.Logger) {
+	t.logger = logger
+}
+
+// Configure the transport. The following params are supported:
+//   - port: the port to listen on for incoming connections
+//   - certFile, certKeyFile: serve TLS connections using this certificate
+//   - clientCAFile, clientAuth: verify client certificates (see NewMutualTlsConfig)
+//   - clientCertFile, clientCertKeyFile, rootCAFile: use TLS for outgoing
+//     connections, presenting a client certificate and/or verifying server
+//     certificates against a custom CA bundle
+//   - maxFrameSize: the max size of frames sent or received (default: 4MB)
+//   - maxInFlight: the max number of requests per incoming connection waiting
+//     for delivery to their endpoint (default: 128)
+//   - writeTimeout: the time allowed for writing a frame (default: 10s)
+//   - dialTimeout: the timeout for establishing connections (default: 1s)
+//
+// If client certificate verification is enabled (clientCAFile), the sender of
+// incoming requests is the identity of the verified client certificate. With
+// clientAuth set to optional, requests without a certificate have an empty
+// sender.
+//
+// The frame settings apply to connections established after Config is invoked.
+func (t *TcpTransport) Config(params map[string]string) error {
+	settings, err := parseStreamSettings(params)
+	if err != nil {
+		return err
+	}
+	dialer, err := newDialer(params)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	t.settings = settings
+	t.dialer = dialer
+	t.Unlock()
+	t.client.setSettings(settings)
+
+	t.certFile = ""
+	t.certKeyFile = ""
+	t.tlsConfig = nil
+	t.clientTlsConfig = nil
+	t.useTls = false
+
+	portVal, portDefined := params["port"]
+	if portDefined {
+		port, err := strconv.Atoi(portVal)
+		if err != nil {
+			return err
+		}
+		t.port = port
+	}
+
+	certFile := params["certFile"]
+	certKeyFile := params["certKeyFile"]
+	if certFile != "" && certKeyFile != "" {
+		t.certFile = certFile
+		t.certKeyFile = certKeyFile
+		t.useTls = true
+
+		tlsConfig, err := newServerTlsConfig(params)
+		if err != nil {
+			return err
+		}
+		t.tlsConfig = tlsConfig
+	}
+
+	clientTlsConfig, err := newClientTlsConfig(params)
+	if err != nil {
+		return err
+	}
+	if clientTlsConfig != nil {
+		t.clientTlsConfig = clientTlsConfig
+		t.useTls = true
+	}
+
+	if portDefined {
+		t.logger.Info("Configuration changed", "port", t.port, "tls", t.useTls)
+		return t.listen()
+	}
+
+	return nil
+}
+
+// Close the transport. The listener and all open connections are closed and
+// all endpoints are unbound.
+func (t *TcpTransport) Close() error {
+	t.Lock()
+	if t.listener != nil {
+		t.listener.Close()
+		close(t.closeChan)
+		t.listener = nil
+	}
+	for conn := range t.serverConns {
+		conn.conn.Close()
+	}
+	t.serverConns = make(map[*serverConn]struct{}, 0)
+	t.msgChans = make(map[string]chan usrv.Message, 0)
+	t.Unlock()
+
+	t.client.close()
+
+	return nil
+}
+
+func (t *TcpTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	err := t.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	key := fmt.Sprintf("%s/%s", service, endpoint)
+	t.msgChans[key] = make(chan usrv.Message, 0)
+	return t.msgChans[key], nil
+}
+
+func (t *TcpTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*streamMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	if msg.isReply {
+		msg.conn.reply(t.logger, msg)
+		return nil
+	}
+
+	addr, _ := splitStreamAddress(msg.to)
+	return t.client.send(t.logger, msg, addr, timeout)
+}
+
+// Cancel an in-flight request.
+func (t *TcpTransport) Cancel(m usrv.Message) {
+	t.client.cancel(m)
+}
+
+// Create a message to be delivered to a target endpoint
+func (t *TcpTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return newStreamMessage(from, toService, toEndpoint)
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *TcpTransport) ReplyTo(msg usrv.Message) usrv.Message {
+	return newStreamReply(msg)
+}
+
+// Open a connection to a remote server.
+func (t *TcpTransport) dial(addr string) (net.Conn, error) {
+	t.Lock()
+	dialer := t.dialer
+	t.Unlock()
+
+	if !t.useTls {
+		return dialer.Dial("tcp", addr)
+	}
+
+	tlsConfig := t.clientTlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
+
+// Ensure that the transport is listening for incoming connections.
+func (t *TcpTransport) listen() error {
+	t.Lock()
+	defer t.Unlock()
+
+	// Already listening
+	if t.listener != nil {
+		return nil
+	}
+
+	if t.port == 0 {
+		return errMissingPort
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", t.port))
+	if err != nil {
+		return err
+	}
+
+	if t.certFile != "" && t.certKeyFile != "" {
+		listener, err = newTlsListener(listener, t.certFile, t.certKeyFile, t.tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.listener = listener
+	t.closeChan = make(chan struct{}, 0)
+	go t.accept(listener, t.closeChan)
+
+	return nil
+}
+
+// Accept incoming connections until the listener is closed.
+func (t *TcpTransport) accept(listener net.Listener, closeChan chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-closeChan:
+			default:
+				t.logger.Error("Tcp listener exited", "err", err.Error())
+			}
+			return
+		}
+
+		t.Lock()
+		sc := &serverConn{
+			conn:          conn,
+			settings:      t.settings,
+			authenticated: t.tlsConfig != nil,
+		}
+		t.serverConns[sc] = struct{}{}
+		t.Unlock()
+
+		go t.serve(sc, closeChan)
+	}
+}
+
+// Serve requests received over an incoming connection.
+func (t *TcpTransport) serve(sc *serverConn, closeChan chan struct{}) {
+	defer func() {
+		sc.conn.Close()
+		t.Lock()
+		delete(t.serverConns, sc)
+		t.Unlock()
+	}()
+
+	// If client certificates are verified, the sender is the identity of
+	// the verified certificate and never the sender specified by requests.
+	if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			t.logger.Error("Tls handshake failed", "remote", sc.conn.RemoteAddr().String(), "err", err.Error())
+			return
+		}
+		state := tlsConn.ConnectionState()
+		sc.peer = peerIdentity(&state)
+	}
+
+	sc.serve(t.logger, t.lookup, closeChan)
+}
+
+// Get the channel of the endpoint that a request is addressed to.
+func (t *TcpTransport) lookup(to string) (chan usrv.Message, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	msgChan, found := t.msgChans[to]
+	return msgChan, found
+}
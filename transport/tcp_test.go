@@ -0,0 +1,469 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func TestTcpTransport(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "localhost:8090", func() usrv.Transport {
+		tr := NewTcp()
+		tr.Config(NewTcpConfig(8090))
+		return tr
+	})
+}
+
+func TestTcpTransportMultiplexing(t *testing.T) {
+	tr := NewTcp()
+	if err := tr.Config(NewTcpConfig(8091)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("localhost:8091", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reply in reverse order so that replies are interleaved
+	numReqs := 10
+	go func() {
+		reqs := make([]usrv.Message, 0, numReqs)
+		for reqMsg := range reqChan {
+			reqs = append(reqs, reqMsg)
+			if len(reqs) < numReqs {
+				continue
+			}
+			for idx := len(reqs) - 1; idx >= 0; idx-- {
+				content, _ := reqs[idx].Content()
+				resMsg := tr.ReplyTo(reqs[idx])
+				resMsg.SetContent(content, nil)
+				tr.Send(resMsg, 0, false)
+			}
+			return
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(numReqs)
+	for i := 0; i < numReqs; i++ {
+		go func(i int) {
+			defer wg.Done()
+			reqMsg := tr.MessageTo("test", "localhost:8091", "echo")
+			reqMsg.SetContent([]byte(fmt.Sprint(i)), nil)
+			content, err := (<-tr.Send(reqMsg, 5*time.Second, true)).Content()
+			if err != nil {
+				t.Errorf("[req %d] %v", i, err)
+				return
+			}
+			if string(content) != fmt.Sprint(i) {
+				t.Errorf("[req %d] Expected reply %d; got %s", i, i, string(content))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tr.client.connMutex.Lock()
+	numConns := len(tr.client.conns)
+	tr.client.connMutex.Unlock()
+	if numConns != 1 {
+		t.Fatalf("Expected requests to share a single connection; got %d connections", numConns)
+	}
+}
+
+func TestTcpTransportMutualTls(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	srvTr := NewTcp()
+	err := srvTr.Config(NewMutualTlsConfig(
+		8092,
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8092", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Client presenting a certificate signed by the CA
+	clientTr := NewTcp()
+	err = clientTr.Config(TcpConfig{
+		"clientCertFile":    filepath.Join(dir, "client.pem"),
+		"clientCertKeyFile": filepath.Join(dir, "client-key.pem"),
+		"rootCAFile":        filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientTr.Close()
+
+	reqMsg := clientTr.MessageTo("spoofed", "localhost:8092", "ep1")
+	content, err := (<-clientTr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "api.example"; string(content) != exp {
+		t.Fatalf("Expected sender to be the verified certificate identity %s; got %s", exp, string(content))
+	}
+
+	// Client without a certificate
+	anonTr := NewTcp()
+	err = anonTr.Config(TcpConfig{
+		"rootCAFile": filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonTr.Close()
+
+	reqMsg = anonTr.MessageTo("test", "localhost:8092", "ep1")
+	_, err = (<-anonTr.Send(reqMsg, time.Second, true)).Content()
+	if err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestTcpTransportOptionalClientAuth(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	config := NewMutualTlsConfig(
+		8113,
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+	)
+	config["clientAuth"] = "optional"
+
+	srvTr := NewTcp()
+	if err := srvTr.Config(config); err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8113", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Callers without a certificate must not be able to choose their sender
+	anonTr := NewTcp()
+	err = anonTr.Config(TcpConfig{
+		"rootCAFile": filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonTr.Close()
+
+	reqMsg := anonTr.MessageTo("spoofed", "localhost:8113", "ep1")
+	content, err := (<-anonTr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("Expected sender of unverified caller to be empty; got %s", string(content))
+	}
+}
+
+func TestTcpTransportSettingsConfigErrors(t *testing.T) {
+	tr := NewTcp()
+	defer tr.Close()
+
+	specs := []TcpConfig{
+		{"maxFrameSize": "big"},
+		{"maxFrameSize": "0"},
+		{"maxInFlight": "-1"},
+		{"writeTimeout": "10"},
+		{"dialTimeout": "soon"},
+	}
+	for idx, spec := range specs {
+		if err := tr.Config(spec); err == nil {
+			t.Fatalf("[spec %d] Expected config %v to be rejected", idx, spec)
+		}
+	}
+}
+
+func TestStreamClientConcurrentDials(t *testing.T) {
+	slowDial := make(chan struct{}, 0)
+	dialCount := make(map[string]int, 0)
+	var dialMutex sync.Mutex
+
+	client := newStreamClient(func(addr string) (net.Conn, error) {
+		dialMutex.Lock()
+		dialCount[addr]++
+		dialMutex.Unlock()
+
+		if addr == "slow" {
+			<-slowDial
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}, defaultStreamSettings())
+	defer client.close()
+
+	slowConns := make(chan *clientConn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := client.conn("slow")
+			if err != nil {
+				t.Error(err)
+			}
+			slowConns <- conn
+		}()
+	}
+
+	// A slow dial should not block connecting to other servers
+	fastConn := make(chan error, 1)
+	go func() {
+		_, err := client.conn("fast")
+		fastConn <- err
+	}()
+	select {
+	case err := <-fastConn:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for connection while another server was being dialed")
+	}
+
+	// Concurrent requests to the same server should share its connection
+	close(slowDial)
+	if conn1, conn2 := <-slowConns, <-slowConns; conn1 != conn2 {
+		t.Fatal("Expected concurrent requests to the same server to share a connection")
+	}
+
+	dialMutex.Lock()
+	defer dialMutex.Unlock()
+	if dialCount["slow"] != 1 {
+		t.Fatalf("Expected slow server to be dialed once; got %d", dialCount["slow"])
+	}
+}
+
+func TestTcpTransportBindWithoutPort(t *testing.T) {
+	tr := NewTcp()
+	defer tr.Close()
+
+	if _, err := tr.Bind("localhost", "ep1"); err != errMissingPort {
+		t.Fatalf("Expected to get errMissingPort; got %v", err)
+	}
+}
+
+func TestTcpTransportOversizedReply(t *testing.T) {
+	tr := NewTcp()
+	err := tr.Config(TcpConfig{
+		"port":         "8107",
+		"maxFrameSize": "1024",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("localhost:8107", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := tr.ReplyTo(reqMsg)
+			if reqMsg.Property().Get("oversized") != "" {
+				resMsg.SetContent(make([]byte, 1024), nil)
+			} else {
+				resMsg.SetContent([]byte("OK"), nil)
+			}
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Replies that cannot be encoded should fail the request instead of
+	// leaving it pending forever
+	reqMsg := tr.MessageTo("test", "localhost:8107", "ep1")
+	reqMsg.Property().Set("oversized", "true")
+	select {
+	case resMsg := <-tr.Send(reqMsg, 0, true):
+		if _, err := resMsg.Content(); err != usrv.ErrInternal {
+			t.Fatalf("Expected to get ErrInternal; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for reply")
+	}
+
+	// The connection should remain usable
+	reqMsg = tr.MessageTo("test", "localhost:8107", "ep1")
+	content, err := (<-tr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "OK" {
+		t.Fatalf("Expected reply 'OK'; got %q", string(content))
+	}
+}
+
+func TestTcpTransportDuplicateCorrelationId(t *testing.T) {
+	tr := NewTcp()
+	if err := tr.Config(NewTcpConfig(8108)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("localhost:8108", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqMsg := tr.MessageTo("test", "localhost:8108", "ep1")
+	resChan := tr.Send(reqMsg, time.Second, true)
+	received := <-reqChan
+
+	// A second request with the same correlation id must not replace the
+	// in-flight one
+	if _, err := (<-tr.Send(reqMsg, time.Second, true)).Content(); err != errDuplicateCorrelationId {
+		t.Fatalf("Expected to get errDuplicateCorrelationId; got %v", err)
+	}
+
+	resMsg := tr.ReplyTo(received)
+	resMsg.SetContent([]byte("OK"), nil)
+	tr.Send(resMsg, 0, false)
+
+	content, err := (<-resChan).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "OK" {
+		t.Fatalf("Expected reply 'OK'; got %q", string(content))
+	}
+}
+
+func TestTcpTransportBindKeys(t *testing.T) {
+	tr := NewTcp()
+	if err := tr.Config(NewTcpConfig(8109)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Endpoints with the same name bound by different services must not
+	// replace each other
+	for _, service := range []string{"localhost:8109", "127.0.0.1:8109"} {
+		reqChan, err := tr.Bind(service, "ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(service string) {
+			for reqMsg := range reqChan {
+				resMsg := tr.ReplyTo(reqMsg)
+				resMsg.SetContent([]byte(service), nil)
+				tr.Send(resMsg, 0, false)
+			}
+		}(service)
+	}
+
+	for _, service := range []string{"localhost:8109", "127.0.0.1:8109"} {
+		reqMsg := tr.MessageTo("test", service, "ping")
+		content, err := (<-tr.Send(reqMsg, time.Second, true)).Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != service {
+			t.Fatalf("Expected request to be served by %s; got %s", service, string(content))
+		}
+	}
+}
+
+func TestFrameEncoding(t *testing.T) {
+	f := &frame{
+		kind:          frameReply,
+		correlationId: "123",
+		from:          "localhost:8090/ep1",
+		to:            "test",
+		property:      usrv.Property{"foo": "bar", "empty": ""},
+		err:           usrv.ErrTimeout.Error(),
+		content:       []byte("Hello"),
+	}
+
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, f, defaultMaxFrameSize); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	decoded, err := readFrame(bufio.NewReader(bytes.NewReader(encoded)), defaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.kind != f.kind || decoded.correlationId != f.correlationId || decoded.from != f.from || decoded.to != f.to {
+		t.Fatalf("Expected decoded frame header to match; got %+v", decoded)
+	}
+	if len(decoded.property) != 2 || decoded.property.Get("foo") != "bar" {
+		t.Fatalf("Expected decoded properties to match; got %v", decoded.property)
+	}
+	if !bytes.Equal(decoded.content, f.content) {
+		t.Fatalf("Expected decoded content to be %q; got %q", f.content, decoded.content)
+	}
+	if frameError(decoded.err) != usrv.ErrTimeout {
+		t.Fatalf("Expected decoded error to be ErrTimeout; got %v", frameError(decoded.err))
+	}
+
+	// Frames exceeding the size limit
+	_, err = readFrame(bufio.NewReader(bytes.NewReader(encoded)), len(encoded)-5)
+	if err != errFrameTooLarge {
+		t.Fatalf("Expected to get errFrameTooLarge; got %v", err)
+	}
+	if err = writeFrame(&buf, f, len(encoded)-5); err != errFrameTooLarge {
+		t.Fatalf("Expected to get errFrameTooLarge; got %v", err)
+	}
+
+	// Frames whose size prefix exceeds the available data
+	_, err = readFrame(bufio.NewReader(bytes.NewReader(encoded[:len(encoded)-1])), defaultMaxFrameSize)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected to get io.ErrUnexpectedEOF; got %v", err)
+	}
+
+	// Truncated frame body
+	encoded[3] -= byte(len(f.content) + 1)
+	_, err = readFrame(bufio.NewReader(bytes.NewReader(encoded[:len(encoded)-len(f.content)-1])), defaultMaxFrameSize)
+	if err != errInvalidFrame {
+		t.Fatalf("Expected to get errInvalidFrame; got %v", err)
+	}
+
+	// Oversized strings
+	err = writeFrame(&buf, &frame{kind: frameRequest, to: string(make([]byte, 1<<16))}, defaultMaxFrameSize)
+	if err != errFrameTooLarge {
+		t.Fatalf("Expected to get errFrameTooLarge; got %v", err)
+	}
+}
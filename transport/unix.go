@@ -0,0 +1,381 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+var (
+	errInvalidServiceName = errors.New("Service names must not contain path separators")
+	errInsecureDirMode    = errors.New("dirMode must not grant write access to group or others")
+)
+
+type UnixConfig map[string]string
+
+func NewUnixConfig(socketDir string) UnixConfig {
+	return UnixConfig{
+		"socketDir": socketDir,
+	}
+}
+
+// A transport that exchanges length-prefixed binary frames over Unix domain
+// sockets. It uses the same framing and request multiplexing as TcpTransport
+// and is intended for services running on the same host.
+//
+// Each service that binds endpoints listens on a socket named after the
+// service ("<service>.sock") inside the socket directory. Access to a service
+// is controlled via the permissions of its socket file. The socket directory
+// must be owned by the user running the service and must not be a symlink or
+// be writable by group or others, so that other users cannot replace sockets.
+type UnixTransport struct {
+	logger     usrv.Logger
+	socketDir  string
+	socketMode os.FileMode
+	dirMode    os.FileMode
+	settings   streamSettings
+	dialer     *net.Dialer
+
+	// A mutex for synchronized access to the listeners and the bound endpoints
+	sync.Mutex
+	listeners   map[string]net.Listener
+	msgChans    map[string]chan usrv.Message
+	serverConns map[*serverConn]struct{}
+	closeChan   chan struct{}
+
+	client *streamClient
+}
+
+func NewUnix() *UnixTransport {
+	t := &UnixTransport{
+		logger:      usrv.NullLogger,
+		socketDir:   defaultSocketDir(),
+		socketMode:  0600,
+		dirMode:     0700,
+		settings:    defaultStreamSettings(),
+		dialer:      &net.Dialer{Timeout: defaultDialTimeout},
+		listeners:   make(map[string]net.Listener, 0),
+		msgChans:    make(map[string]chan usrv.Message, 0),
+		serverConns: make(map[*serverConn]struct{}, 0),
+		closeChan:   make(chan struct{}, 0),
+	}
+	t.client = newStreamClient(t.dial, t.settings)
+	return t
+}
+
+func (t *UnixTransport) SetLogger(logger usrv.Logger) {
+	t.logger = logger
+}
+
+// Configure the transport. The following params are supported:
+//   - socketDir: the directory containing the service sockets (default: $XDG_RUNTIME_DIR/usrv
+//     or $TMPDIR/usrv-<uid> if XDG_RUNTIME_DIR is not set)
+//   - socketMode: the octal permissions of created sockets (default: 0600)
+//   - dirMode: the octal permissions used when creating the socket directory; it
+//     must not grant write access to group or others (default: 0700)
+//   - maxFrameSize, maxInFlight, writeTimeout, dialTimeout: connection settings
+//     (see TcpTransport.Config)
+//
+// Changes only apply to services bound after Config is invoked.
+func (t *UnixTransport) Config(params map[string]string) error {
+	socketMode, err := parseFileMode(params, "socketMode", 0600)
+	if err != nil {
+		return err
+	}
+	dirMode, err := parseFileMode(params, "dirMode", 0700)
+	if err != nil {
+		return err
+	}
+	if dirMode&0022 != 0 {
+		return errInsecureDirMode
+	}
+	settings, err := parseStreamSettings(params)
+	if err != nil {
+		return err
+	}
+	dialer, err := newDialer(params)
+	if err != nil {
+		return err
+	}
+	t.client.setSettings(settings)
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.socketDir = defaultSocketDir()
+	if socketDir := params["socketDir"]; socketDir != "" {
+		t.socketDir = socketDir
+	}
+	t.socketMode = socketMode
+	t.dirMode = dirMode
+	t.settings = settings
+	t.dialer = dialer
+
+	t.logger.Info("Configuration changed", "socketDir", t.socketDir, "socketMode", fmt.Sprintf("%#o", t.socketMode))
+	return nil
+}
+
+// Close the transport. All listeners and open connections are closed, the
+// service sockets are removed and all endpoints are unbound.
+func (t *UnixTransport) Close() error {
+	t.Lock()
+	for service, listener := range t.listeners {
+		listener.Close()
+		delete(t.listeners, service)
+	}
+	close(t.closeChan)
+	t.closeChan = make(chan struct{}, 0)
+	for conn := range t.serverConns {
+		conn.conn.Close()
+	}
+	t.serverConns = make(map[*serverConn]struct{}, 0)
+	t.msgChans = make(map[string]chan usrv.Message, 0)
+	t.Unlock()
+
+	t.client.close()
+
+	return nil
+}
+
+// Bind service endpoint. The service socket is created when the first
+// endpoint of the service is bound.
+func (t *UnixTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, found := t.listeners[service]; !found {
+		listener, err := t.listen(service)
+		if err != nil {
+			return nil, err
+		}
+		t.listeners[service] = listener
+		go t.accept(listener, t.closeChan)
+	}
+
+	key := fmt.Sprintf("%s/%s", service, endpoint)
+	t.msgChans[key] = make(chan usrv.Message, 0)
+	return t.msgChans[key], nil
+}
+
+func (t *UnixTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*streamMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	if msg.isReply {
+		msg.conn.reply(t.logger, msg)
+		return nil
+	}
+
+	service, _ := splitStreamAddress(msg.to)
+	return t.client.send(t.logger, msg, service, timeout)
+}
+
+// Cancel an in-flight request.
+func (t *UnixTransport) Cancel(m usrv.Message) {
+	t.client.cancel(m)
+}
+
+// Create a message to be delivered to a target endpoint
+func (t *UnixTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return newStreamMessage(from, toService, toEndpoint)
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *UnixTransport) ReplyTo(msg usrv.Message) usrv.Message {
+	return newStreamReply(msg)
+}
+
+// Open a connection to the socket of a service.
+func (t *UnixTransport) dial(service string) (net.Conn, error) {
+	t.Lock()
+	socketDir := t.socketDir
+	dialer := t.dialer
+	t.Unlock()
+
+	path, err := serviceSocketPath(socketDir, service)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial("unix", path)
+}
+
+// Create the socket for a service and apply the configured permissions. A
+// leftover socket from a service that exited without cleaning up is replaced.
+// This method must be called while holding the transport lock.
+func (t *UnixTransport) listen(service string) (net.Listener, error) {
+	path, err := serviceSocketPath(t.socketDir, service)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(t.socketDir, t.dirMode); err != nil {
+		return nil, err
+	}
+	if err := checkSocketDir(t.socketDir); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		conn, err := t.dialer.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := listenUnixSocket(path, t.socketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	t.logger.Info("Listening for requests", "service", service, "socket", path)
+	return listener, nil
+}
+
+// A listener for a socket that was created at a different path and then
+// moved into place. The socket is removed when the listener is closed.
+type unixSocketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Create a listening Unix socket with the supplied permissions. The socket is
+// created inside a private temporary directory and only linked into path
+// after its permissions have been applied, so that it is never reachable with
+// more permissive access. Linking fails if path already exists.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(path), ".usrv-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, "s")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Link(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &unixSocketListener{Listener: listener, path: path}, nil
+}
+
+// Accept incoming connections until the listener is closed.
+func (t *UnixTransport) accept(listener net.Listener, closeChan chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-closeChan:
+			default:
+				t.logger.Error("Unix listener exited", "err", err.Error())
+			}
+			return
+		}
+
+		t.Lock()
+		sc := &serverConn{conn: conn, settings: t.settings}
+		t.serverConns[sc] = struct{}{}
+		t.Unlock()
+
+		go func() {
+			sc.serve(t.logger, t.lookup, closeChan)
+
+			sc.conn.Close()
+			t.Lock()
+			delete(t.serverConns, sc)
+			t.Unlock()
+		}()
+	}
+}
+
+// Get the channel of the endpoint that a request is addressed to.
+func (t *UnixTransport) lookup(to string) (chan usrv.Message, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	msgChan, found := t.msgChans[to]
+	return msgChan, found
+}
+
+// Get the default socket directory. It is private to the user running the
+// process so that other users cannot tamper with the service sockets.
+func defaultSocketDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "usrv")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("usrv-%d", os.Geteuid()))
+}
+
+// Ensure that other users cannot create, replace or remove sockets inside
+// the socket directory. The directory must not be a symlink, must be owned by
+// the effective user of the process and must not be writable by group or
+// others.
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("Socket directory %s must not be a symlink", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Socket directory %s is not a directory", dir)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("Socket directory %s must not be writable by group or others", dir)
+	}
+	return checkOwner(dir, info)
+}
+
+// Get the path of the socket for a service. Service names that would resolve
+// to a path outside socketDir are rejected.
+func serviceSocketPath(socketDir string, service string) (string, error) {
+	if service == "" || service == "." || service == ".." || strings.ContainsAny(service, `/\`) {
+		return "", errInvalidServiceName
+	}
+	return filepath.Join(socketDir, service+".sock"), nil
+}
+
+// Parse an octal file mode parameter, falling back to defaultMode if the
+// parameter is not set.
+func parseFileMode(params map[string]string, key string, defaultMode os.FileMode) (os.FileMode, error) {
+	val := params[key]
+	if val == "" {
+		return defaultMode, nil
+	}
+
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("Invalid %s '%s'; expected octal permissions", key, val)
+	}
+	return os.FileMode(mode), nil
+}
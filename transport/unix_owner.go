@@ -0,0 +1,21 @@
+//go:build unix
+
+package transport
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Ensure that a directory is owned by the effective user of the process.
+func checkOwner(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("Socket directory %s is owned by uid %d instead of %d", path, stat.Uid, os.Geteuid())
+	}
+	return nil
+}
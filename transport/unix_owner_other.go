@@ -0,0 +1,12 @@
+//go:build !unix
+
+package transport
+
+import (
+	"os"
+)
+
+// File ownership is not available on this platform.
+func checkOwner(path string, info os.FileInfo) error {
+	return nil
+}
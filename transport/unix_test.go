@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+)
+
+func TestUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usrv-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usrvtest.RunTransportSuite(t, "srv", func() usrv.Transport {
+		tr := NewUnix()
+		tr.Config(NewUnixConfig(dir))
+		return tr
+	})
+}
+
+func TestUnixTransportPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usrv-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketDir := filepath.Join(dir, "sockets")
+	tr := NewUnix()
+	err = tr.Config(UnixConfig{
+		"socketDir":  socketDir,
+		"socketMode": "0660",
+		"dirMode":    "0750",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if _, err := tr.Bind("srv", "ep1"); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := []struct {
+		path    string
+		expMode os.FileMode
+	}{
+		{socketDir, 0750},
+		{filepath.Join(socketDir, "srv.sock"), 0660},
+	}
+	for _, s := range spec {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != s.expMode {
+			t.Fatalf("Expected %s to have mode %#o; got %#o", s.path, s.expMode, info.Mode().Perm())
+		}
+	}
+
+	// The temporary directory used for creating the socket should be removed
+	entries, err := ioutil.ReadDir(socketDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected socket directory to only contain the service socket; got %d entries", len(entries))
+	}
+
+	// Closing the transport should remove the socket
+	tr.Close()
+	if _, err := os.Stat(filepath.Join(socketDir, "srv.sock")); !os.IsNotExist(err) {
+		t.Fatalf("Expected socket to be removed on close; got %v", err)
+	}
+}
+
+func TestUnixTransportSocketInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usrv-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leave behind a stale socket without a listener
+	listener, err := net.Listen("unix", filepath.Join(dir, "srv.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	tr1 := NewUnix()
+	tr1.Config(NewUnixConfig(dir))
+	defer tr1.Close()
+	if _, err := tr1.Bind("srv", "ep1"); err != nil {
+		t.Fatalf("Expected stale socket to be replaced; got %v", err)
+	}
+
+	tr2 := NewUnix()
+	tr2.Config(NewUnixConfig(dir))
+	defer tr2.Close()
+	if _, err := tr2.Bind("srv", "ep1"); err == nil {
+		t.Fatal("Expected binding a service whose socket is in use to fail")
+	}
+}
+
+func TestUnixTransportInvalidServiceName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usrv-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := NewUnix()
+	tr.Config(NewUnixConfig(dir))
+	defer tr.Close()
+
+	for _, service := range []string{"", "..", "../srv", "a/b"} {
+		if _, err := tr.Bind(service, "ep1"); err != errInvalidServiceName {
+			t.Fatalf("[service %q] Expected to get errInvalidServiceName; got %v", service, err)
+		}
+	}
+
+	reqMsg := tr.MessageTo("test", "../srv", "ep1")
+	_, err = (<-tr.Send(reqMsg, time.Second, true)).Content()
+	if err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+}
+
+func TestUnixTransportConfigErrors(t *testing.T) {
+	tr := NewUnix()
+	for _, mode := range []string{"rw", "0999", "01777"} {
+		if err := tr.Config(UnixConfig{"socketMode": mode}); err == nil {
+			t.Fatalf("[mode %s] Expected an error for invalid socket mode", mode)
+		}
+	}
+	for _, mode := range []string{"0770", "0702"} {
+		if err := tr.Config(UnixConfig{"dirMode": mode}); err != errInsecureDirMode {
+			t.Fatalf("[mode %s] Expected errInsecureDirMode; got %v", mode, err)
+		}
+	}
+}
+
+func TestUnixTransportInsecureSocketDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usrv-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory that other users can write to
+	sharedDir := filepath.Join(dir, "shared")
+	if err := os.Mkdir(sharedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sharedDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink to a private directory
+	privateDir := filepath.Join(dir, "private")
+	if err := os.Mkdir(privateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	linkDir := filepath.Join(dir, "link")
+	if err := os.Symlink(privateDir, linkDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, socketDir := range []string{sharedDir, linkDir} {
+		tr := NewUnix()
+		if err := tr.Config(NewUnixConfig(socketDir)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tr.Bind("srv", "ep1"); err == nil {
+			tr.Close()
+			t.Fatalf("[dir %s] Expected bind to fail for insecure socket directory", socketDir)
+		}
+	}
+
+	// Sockets should be created with the requested permissions and must
+	// not replace existing files
+	listener, err := listenUnixSocket(filepath.Join(privateDir, "srv.sock"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(filepath.Join(privateDir, "srv.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("Expected socket to be created with mode 0600; got %#o", mode)
+	}
+	if _, err := listenUnixSocket(filepath.Join(privateDir, "srv.sock"), 0600); err == nil {
+		t.Fatal("Expected listening on an existing socket path to fail")
+	}
+}
+
+func TestUnixTransportDefaultSocketDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if dir := defaultSocketDir(); dir != "/run/user/1000/usrv" {
+		t.Fatalf("Expected default socket dir to be inside XDG_RUNTIME_DIR; got %s", dir)
+	}
+
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	if exp, dir := filepath.Join(os.TempDir(), fmt.Sprintf("usrv-%d", os.Geteuid())), defaultSocketDir(); dir != exp {
+		t.Fatalf("Expected default socket dir to be %s; got %s", exp, dir)
+	}
+}
@@ -0,0 +1,749 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	httpPkg "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/achilleasa/usrv"
+	"github.com/gorilla/websocket"
+)
+
+// Envelope types exchanged over WebSocket connections.
+const (
+	wsRequest = "request"
+	wsReply   = "reply"
+)
+
+// The JSON envelope for messages exchanged over WebSocket connections. Each
+// envelope is sent as a separate text message so that browser clients can
+// process it with JSON.parse; the content is base64-encoded.
+type wsEnvelope struct {
+	Type          string        `json:"type"`
+	CorrelationId string        `json:"id"`
+	From          string        `json:"from,omitempty"`
+	To            string        `json:"to,omitempty"`
+	Property      usrv.Property `json:"property,omitempty"`
+	Content       []byte        `json:"content,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// The internal message type used by the websocket transport.
+type wsMessage struct {
+	from          string
+	to            string
+	property      usrv.Property
+	correlationId string
+	content       []byte
+	err           error
+
+	isReply bool
+
+	// The connection that the request was received from
+	conn *wsConn
+}
+
+func (m *wsMessage) From() string {
+	return m.from
+}
+func (m *wsMessage) To() string {
+	return m.to
+}
+func (m *wsMessage) Property() usrv.Property {
+	return m.property
+}
+func (m *wsMessage) CorrelationId() string {
+	return m.correlationId
+}
+func (m *wsMessage) Content() ([]byte, error) {
+	return m.content, m.err
+}
+func (m *wsMessage) SetContent(content []byte, err error) {
+	m.content, m.err = content, err
+}
+
+type WebSocketConfig map[string]string
+
+func NewWebSocketConfig(serverPort int) WebSocketConfig {
+	return WebSocketConfig{
+		"port": fmt.Sprint(serverPort),
+	}
+}
+
+// Create a configuration for a transport that only connects to servers. The
+// peer name identifies the transport to the servers it connects to so that
+// they can send requests to its bound endpoints.
+func NewWebSocketClientConfig(peer string) WebSocketConfig {
+	return WebSocketConfig{
+		"peer": peer,
+	}
+}
+
+// A WebSocket connection. Both sides of the connection may send requests
+// over it; replies are matched to requests by their correlation id.
+type wsConn struct {
+	conn *websocket.Conn
+
+	// The key of the connection in the transport connection maps
+	peer string
+
+	// Set for connections accepted by the server
+	inbound bool
+
+	// If set, the sender of each request is the verified certificate
+	// identity of the client (empty for unverified clients) instead of the
+	// sender specified by the request
+	authenticated bool
+	identity      string
+
+	// A mutex for serializing writes to the connection
+	writeMutex sync.Mutex
+
+	// Reply channels for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[string]chan *wsEnvelope
+	closed       bool
+
+	// Closed once the connection fails
+	done chan struct{}
+}
+
+func (c *wsConn) write(env *wsEnvelope) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.conn.WriteJSON(env)
+}
+
+// Send a request and return a channel that emits its reply. The channel is
+// closed without emitting a reply if the connection fails.
+func (c *wsConn) roundTrip(env *wsEnvelope) (<-chan *wsEnvelope, error) {
+	replyChan := make(chan *wsEnvelope, 1)
+
+	c.pendingMutex.Lock()
+	if c.closed {
+		c.pendingMutex.Unlock()
+		return nil, websocket.ErrCloseSent
+	}
+	c.pending[env.CorrelationId] = replyChan
+	c.pendingMutex.Unlock()
+
+	if err := c.write(env); err != nil {
+		c.forget(env.CorrelationId)
+		c.conn.Close()
+		return nil, err
+	}
+	return replyChan, nil
+}
+
+// Stop waiting for the reply to a request.
+func (c *wsConn) forget(correlationId string) {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	delete(c.pending, correlationId)
+}
+
+// Check whether the connection has failed.
+func (c *wsConn) isClosed() bool {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	return c.closed
+}
+
+// A transport that exchanges JSON messages over persistent WebSocket
+// connections. Concurrent requests are multiplexed over a single connection
+// per peer.
+//
+// Connections are bidirectional: besides replying to requests, a server may
+// send requests to endpoints bound by the clients connected to it. Clients
+// identify themselves using the "peer" config param; servers address them
+// using the peer name as the service name. If client certificates are
+// verified, clients are identified by their certificate identity instead and
+// the sender of their requests is always that identity. Servers are
+// addressed using their "host:port" address. Incoming requests are routed to
+// bound endpoints by their "service/endpoint" address.
+type WebSocketTransport struct {
+	logger      usrv.Logger
+	port        int
+	peer        string
+	certFile    string
+	certKeyFile string
+	msgChans    map[string]chan usrv.Message
+
+	// TLS settings for the server; used to verify client certificates
+	tlsConfig *tls.Config
+
+	// The dialer for outgoing connections and the URL scheme to use (ws or wss)
+	dialer *websocket.Dialer
+	scheme string
+
+	// Validates the origin of incoming connections
+	upgrader websocket.Upgrader
+
+	server *httpPkg.Server
+
+	// A mutex for synchronized access to the server instance and the bound endpoints
+	sync.Mutex
+
+	// A mutex for synchronized access to the outgoing connections; they are
+	// keyed by server address
+	connMutex sync.Mutex
+	conns     map[string]*wsConn
+
+	// A mutex for synchronized access to the incoming connections; they are
+	// keyed by peer name
+	peerMutex sync.Mutex
+	peers     map[string]*wsConn
+
+	// Cancellation channels for in-flight requests
+	pendingMutex sync.Mutex
+	pending      map[usrv.Message]chan struct{}
+}
+
+func NewWebSocket() *WebSocketTransport {
+	return &WebSocketTransport{
+		logger:   usrv.NullLogger,
+		msgChans: make(map[string]chan usrv.Message, 0),
+		dialer:   newWebSocketDialer(&net.Dialer{Timeout: defaultDialTimeout}, nil),
+		scheme:   "ws",
+		conns:    make(map[string]*wsConn, 0),
+		peers:    make(map[string]*wsConn, 0),
+		pending:  make(map[usrv.Message]chan struct{}, 0),
+	}
+}
+
+func (t *WebSocketTransport) SetLogger(logger usrv.Logger) {
+	t.logger = logger
+}
+
+// Configure the transport. The following params are supported:
+//   - port: the port to listen on for incoming connections
+//   - peer: the name used to identify this transport to the servers it connects to
+//   - allowedOrigins: a comma-separated list of origins that browser clients
+//     may connect from or "*" to allow any origin (default: same origin)
+//   - certFile, certKeyFile: serve TLS connections using this certificate
+//   - clientCAFile, clientAuth: verify client certificates (see NewMutualTlsConfig)
+//   - clientCertFile, clientCertKeyFile, rootCAFile: use TLS for outgoing
+//     connections, presenting a client certificate and/or verifying server
+//     certificates against a custom CA bundle
+//   - dialTimeout: the timeout for establishing connections (default: 1s)
+func (t *WebSocketTransport) Config(params map[string]string) error {
+	t.certFile = ""
+	t.certKeyFile = ""
+	t.tlsConfig = nil
+	t.scheme = "ws"
+	t.peer = params["peer"]
+	t.upgrader = websocket.Upgrader{
+		CheckOrigin: newOriginChecker(params["allowedOrigins"]),
+	}
+
+	portVal, portDefined := params["port"]
+	if portDefined {
+		port, err := strconv.Atoi(portVal)
+		if err != nil {
+			return err
+		}
+		t.port = port
+	}
+
+	certFile := params["certFile"]
+	certKeyFile := params["certKeyFile"]
+	if certFile != "" && certKeyFile != "" {
+		t.certFile = certFile
+		t.certKeyFile = certKeyFile
+		t.scheme = "wss"
+
+		tlsConfig, err := newServerTlsConfig(params)
+		if err != nil {
+			return err
+		}
+		t.tlsConfig = tlsConfig
+	}
+
+	clientTlsConfig, err := newClientTlsConfig(params)
+	if err != nil {
+		return err
+	}
+	if clientTlsConfig != nil {
+		t.scheme = "wss"
+	}
+	dialer, err := newDialer(params)
+	if err != nil {
+		return err
+	}
+	t.dialer = newWebSocketDialer(dialer, clientTlsConfig)
+
+	if portDefined {
+		t.logger.Info("Configuration changed", "port", t.port, "scheme", t.scheme)
+		return t.listen()
+	}
+
+	return nil
+}
+
+// Close the transport. The server and all open connections are closed and
+// all endpoints are unbound.
+func (t *WebSocketTransport) Close() error {
+	t.Lock()
+	if t.server != nil {
+		// Hijacked connections are not tracked by the server; they are
+		// closed below.
+		t.server.Close()
+		t.server = nil
+	}
+	t.msgChans = make(map[string]chan usrv.Message, 0)
+	t.Unlock()
+
+	t.connMutex.Lock()
+	for addr, conn := range t.conns {
+		conn.conn.Close()
+		delete(t.conns, addr)
+	}
+	t.connMutex.Unlock()
+
+	t.peerMutex.Lock()
+	for peer, conn := range t.peers {
+		conn.conn.Close()
+		delete(t.peers, peer)
+	}
+	t.peerMutex.Unlock()
+
+	return nil
+}
+
+// Bind service endpoint. Transports without a configured port do not accept
+// incoming connections; their endpoints only receive requests sent by the
+// servers they are connected to.
+func (t *WebSocketTransport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	if t.port != 0 {
+		err := t.listen()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	key := fmt.Sprintf("%s/%s", service, endpoint)
+	t.msgChans[key] = make(chan usrv.Message, 0)
+	return t.msgChans[key], nil
+}
+
+func (t *WebSocketTransport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	msg, ok := m.(*wsMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	if msg.isReply {
+		err := msg.conn.write(&wsEnvelope{
+			Type:          wsReply,
+			CorrelationId: msg.correlationId,
+			From:          msg.from,
+			To:            msg.to,
+			Property:      msg.property,
+			Content:       msg.content,
+			Error:         errorString(msg.err),
+		})
+		if err != nil {
+			t.logger.Error(
+				"Failed to send reply",
+				"from", msg.from,
+				"to", msg.to,
+				"err", err.Error(),
+			)
+		}
+		return nil
+	}
+
+	cancelChan := make(chan struct{}, 0)
+	t.pendingMutex.Lock()
+	t.pending[m] = cancelChan
+	t.pendingMutex.Unlock()
+
+	resChan := make(chan usrv.Message, 1)
+	go func() {
+		resMsg := &wsMessage{
+			from:          msg.to,
+			to:            msg.from,
+			property:      make(usrv.Property, 0),
+			correlationId: msg.correlationId,
+		}
+
+		defer func() {
+			t.pendingMutex.Lock()
+			delete(t.pending, m)
+			t.pendingMutex.Unlock()
+
+			resChan <- resMsg
+			close(resChan)
+		}()
+
+		var timeoutChan <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
+		}
+
+		peer, _ := splitStreamAddress(msg.to)
+		conn, err := t.conn(peer)
+		var replyChan <-chan *wsEnvelope
+		if err == nil {
+			replyChan, err = conn.roundTrip(&wsEnvelope{
+				Type:          wsRequest,
+				CorrelationId: msg.correlationId,
+				From:          msg.from,
+				To:            msg.to,
+				Property:      msg.property,
+				Content:       msg.content,
+			})
+		}
+		if err != nil {
+			t.logger.Error(
+				"WebSocket request failed",
+				"from", msg.from,
+				"to", msg.to,
+				"err", err.Error(),
+			)
+			resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+			return
+		}
+
+		select {
+		case env, ok := <-replyChan:
+			if !ok {
+				resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+				return
+			}
+			if env.Property != nil {
+				resMsg.property = env.Property
+			}
+			resMsg.SetContent(env.Content, frameError(env.Error))
+		case <-timeoutChan:
+			conn.forget(msg.correlationId)
+			resMsg.SetContent(nil, usrv.ErrTimeout)
+		case <-cancelChan:
+			conn.forget(msg.correlationId)
+			resMsg.SetContent(nil, usrv.ErrCancelled)
+		}
+	}()
+
+	return resChan
+}
+
+// Cancel an in-flight request.
+func (t *WebSocketTransport) Cancel(m usrv.Message) {
+	t.pendingMutex.Lock()
+	defer t.pendingMutex.Unlock()
+
+	if cancelChan, found := t.pending[m]; found {
+		close(cancelChan)
+		delete(t.pending, m)
+	}
+}
+
+// Create a message to be delivered to a target endpoint. The target service
+// is either a "host:port" server address or the name of a connected peer.
+func (t *WebSocketTransport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	return &wsMessage{
+		from:          from,
+		to:            fmt.Sprintf("%s/%s", toService, toEndpoint),
+		property:      make(usrv.Property, 0),
+		correlationId: uuid.New(),
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *WebSocketTransport) ReplyTo(msg usrv.Message) usrv.Message {
+	reqMsg, ok := msg.(*wsMessage)
+	if !ok {
+		panic("Unsupported message type")
+	}
+
+	return &wsMessage{
+		from:          reqMsg.to,
+		to:            reqMsg.from,
+		property:      make(usrv.Property, 0),
+		correlationId: reqMsg.correlationId,
+		isReply:       true,
+		conn:          reqMsg.conn,
+	}
+}
+
+// Get the connection to a peer. If no peer with this name is connected, the
+// peer is treated as a server address and a new connection is dialed.
+func (t *WebSocketTransport) conn(peer string) (*wsConn, error) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if conn, found := t.conns[peer]; found {
+		if !conn.isClosed() {
+			return conn, nil
+		}
+		delete(t.conns, peer)
+	}
+	t.peerMutex.Lock()
+	conn, found := t.peers[peer]
+	t.peerMutex.Unlock()
+	if found && !conn.isClosed() {
+		return conn, nil
+	}
+
+	target := url.URL{Scheme: t.scheme, Host: peer, Path: "/"}
+	if t.peer != "" {
+		target.RawQuery = url.Values{"peer": {t.peer}}.Encode()
+	}
+	wsc, _, err := t.dialer.Dial(target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = newWsConn(peer, wsc)
+	t.conns[peer] = conn
+	go t.readLoop(conn)
+	return conn, nil
+}
+
+// Wrap a websocket connection to a peer.
+func newWsConn(peer string, wsc *websocket.Conn) *wsConn {
+	wsc.SetReadLimit(defaultMaxFrameSize)
+	return &wsConn{
+		conn:    wsc,
+		peer:    peer,
+		pending: make(map[string]chan *wsEnvelope, 0),
+		done:    make(chan struct{}, 0),
+	}
+}
+
+// Check whether an incoming connection may be registered under a peer name.
+// Names that are already in use by a live connection are rejected. This
+// method must be called while holding the peer lock.
+func (t *WebSocketTransport) peerAvailable(peer string) bool {
+	conn, found := t.peers[peer]
+	return !found || conn.isClosed()
+}
+
+// Process incoming messages until the connection fails. Replies are
+// dispatched to the matching in-flight requests and requests are delivered
+// to the bound endpoints. Any requests still in flight when the connection
+// fails are aborted.
+func (t *WebSocketTransport) readLoop(conn *wsConn) {
+	for {
+		var env wsEnvelope
+		if err := conn.conn.ReadJSON(&env); err != nil {
+			break
+		}
+
+		switch env.Type {
+		case wsReply:
+			conn.pendingMutex.Lock()
+			replyChan, found := conn.pending[env.CorrelationId]
+			delete(conn.pending, env.CorrelationId)
+			conn.pendingMutex.Unlock()
+
+			if found {
+				replyChan <- &env
+			}
+		case wsRequest:
+			t.dispatch(conn, &env)
+		}
+	}
+
+	conn.conn.Close()
+
+	if conn.inbound {
+		t.peerMutex.Lock()
+		if t.peers[conn.peer] == conn {
+			delete(t.peers, conn.peer)
+		}
+		t.peerMutex.Unlock()
+	} else {
+		t.connMutex.Lock()
+		if t.conns[conn.peer] == conn {
+			delete(t.conns, conn.peer)
+		}
+		t.connMutex.Unlock()
+	}
+
+	conn.pendingMutex.Lock()
+	defer conn.pendingMutex.Unlock()
+	conn.closed = true
+	close(conn.done)
+	for correlationId, replyChan := range conn.pending {
+		close(replyChan)
+		delete(conn.pending, correlationId)
+	}
+}
+
+// Deliver an incoming request to the endpoint it is addressed to.
+func (t *WebSocketTransport) dispatch(conn *wsConn, env *wsEnvelope) {
+	reqMsg := &wsMessage{
+		from:          env.From,
+		to:            env.To,
+		property:      env.Property,
+		correlationId: env.CorrelationId,
+		content:       env.Content,
+		conn:          conn,
+	}
+	if reqMsg.property == nil {
+		reqMsg.property = make(usrv.Property, 0)
+	}
+	if conn.authenticated {
+		reqMsg.from = conn.identity
+	}
+
+	t.Lock()
+	msgChan, found := t.msgChans[env.To]
+	t.Unlock()
+
+	if !found {
+		resMsg := t.ReplyTo(reqMsg)
+		resMsg.SetContent(nil, usrv.ErrServiceUnavailable)
+		t.Send(resMsg, 0, false)
+		return
+	}
+
+	// Deliver asynchronously so that slow endpoints do not stall other
+	// messages multiplexed over the same connection.
+	go func() {
+		select {
+		case msgChan <- reqMsg:
+		case <-conn.done:
+		}
+	}()
+}
+
+// Upgrade an incoming HTTP request to a WebSocket connection. If client
+// certificates are verified, clients presenting a verified certificate are
+// registered under the certificate identity. Otherwise, clients may identify
+// themselves by specifying a peer name in the "peer" query param. All other
+// connections are registered under the remote address. Peer names may not
+// contain ":" or "/" so that they cannot shadow server addresses, and
+// connections for peer names that are already connected are rejected.
+func (t *WebSocketTransport) handleUpgrade(w httpPkg.ResponseWriter, r *httpPkg.Request) {
+	authenticated := t.tlsConfig != nil
+	identity := peerIdentity(r.TLS)
+	peer := identity
+	if peer == "" && !authenticated {
+		peer = r.URL.Query().Get("peer")
+		if strings.ContainsAny(peer, ":/") {
+			httpPkg.Error(w, "Invalid peer name", httpPkg.StatusBadRequest)
+			return
+		}
+	}
+	if peer == "" {
+		peer = r.RemoteAddr
+	}
+
+	t.peerMutex.Lock()
+	available := t.peerAvailable(peer)
+	t.peerMutex.Unlock()
+	if !available {
+		httpPkg.Error(w, "Peer already connected", httpPkg.StatusConflict)
+		return
+	}
+
+	wsc, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		return
+	}
+
+	conn := newWsConn(peer, wsc)
+	conn.inbound = true
+	conn.authenticated = authenticated
+	conn.identity = identity
+
+	// Another connection for the same peer may have been registered while
+	// the connection was being upgraded
+	t.peerMutex.Lock()
+	available = t.peerAvailable(peer)
+	if available {
+		t.peers[peer] = conn
+	}
+	t.peerMutex.Unlock()
+	if !available {
+		wsc.Close()
+		return
+	}
+
+	t.readLoop(conn)
+}
+
+// Ensure that the transport is listening for incoming connections.
+func (t *WebSocketTransport) listen() error {
+	t.Lock()
+	defer t.Unlock()
+
+	// Already listening
+	if t.server != nil {
+		return nil
+	}
+
+	addr := fmt.Sprintf(":%d", t.port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if t.certFile != "" && t.certKeyFile != "" {
+		listener, err = newTlsListener(listener, t.certFile, t.certKeyFile, t.tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	server := &httpPkg.Server{
+		Addr:    addr,
+		Handler: httpPkg.HandlerFunc(t.handleUpgrade),
+	}
+	t.server = server
+
+	go func() {
+		err := server.Serve(listener)
+		if err != httpPkg.ErrServerClosed {
+			t.logger.Error("WebSocket server exited", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// Create a dialer for outgoing connections.
+func newWebSocketDialer(dialer *net.Dialer, tlsConfig *tls.Config) *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial:          dialer.Dial,
+		HandshakeTimeout: dialer.Timeout,
+		TLSClientConfig:  tlsConfig,
+	}
+}
+
+// Create an origin check for incoming connections. If allowedOrigins is
+// empty, only same-origin requests and requests without an Origin header are
+// accepted.
+func newOriginChecker(allowedOrigins string) func(r *httpPkg.Request) bool {
+	if allowedOrigins == "" {
+		return nil
+	}
+
+	allowed := make(map[string]bool, 0)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		allowed[strings.TrimSpace(origin)] = true
+	}
+
+	return func(r *httpPkg.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed["*"] || allowed[origin]
+	}
+}
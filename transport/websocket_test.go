@@ -0,0 +1,384 @@
+package transport
+
+import (
+	httpPkg "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+	"github.com/achilleasa/usrv/usrvtest"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	usrvtest.RunTransportSuite(t, "localhost:8093", func() usrv.Transport {
+		tr := NewWebSocket()
+		tr.Config(NewWebSocketConfig(8093))
+		return tr
+	})
+}
+
+func TestWebSocketTransportServerInitiatedRequests(t *testing.T) {
+	srvTr := NewWebSocket()
+	if err := srvTr.Config(NewWebSocketConfig(8094)); err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	srv := usrv.NewServer("localhost:8094", srvTr)
+	srv.Handle("hello", func(req, res usrv.Message) {
+		res.SetContent([]byte("hello "+req.From()), nil)
+	})
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// The client binds an endpoint without listening for connections
+	clientTr := NewWebSocket()
+	if err := clientTr.Config(NewWebSocketClientConfig("browser-1")); err != nil {
+		t.Fatal(err)
+	}
+	defer clientTr.Close()
+
+	clientSrv := usrv.NewServer("browser-1", clientTr)
+	clientSrv.Handle("notify", func(req, res usrv.Message) {
+		content, _ := req.Content()
+		res.SetContent(append([]byte("ack:"), content...), nil)
+	})
+	if err := clientSrv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer clientSrv.Close()
+
+	// Connect to the server
+	client := usrv.NewClient("localhost:8094", clientTr)
+	content, err := (<-client.Send(client.NewMessage("browser-1", "hello"), time.Second)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "hello browser-1"; string(content) != exp {
+		t.Fatalf("Expected reply %q; got %q", exp, string(content))
+	}
+
+	// Send a request from the server to the connected client
+	notifier := usrv.NewClient("browser-1", srvTr)
+	reqMsg := notifier.NewMessage("localhost:8094", "notify")
+	reqMsg.SetContent([]byte("update"), nil)
+	content, err = (<-notifier.Send(reqMsg, time.Second)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "ack:update"; string(content) != exp {
+		t.Fatalf("Expected reply %q; got %q", exp, string(content))
+	}
+}
+
+func TestWebSocketTransportJsonEnvelope(t *testing.T) {
+	tr := NewWebSocket()
+	if err := tr.Config(NewWebSocketConfig(8095)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	reqChan, err := tr.Bind("localhost:8095", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			content, _ := reqMsg.Content()
+			resMsg := tr.ReplyTo(reqMsg)
+			resMsg.Property().Set("foo", reqMsg.Property().Get("foo"))
+			resMsg.SetContent(content, nil)
+			tr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Connect using a raw websocket connection like a browser client would
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:8095/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := map[string]interface{}{
+		"type":     "request",
+		"id":       "1",
+		"from":     "browser",
+		"to":       "localhost:8095/echo",
+		"property": map[string]string{"foo": "bar"},
+		"content":  "SGVsbG8=", // base64("Hello")
+	}
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+
+	var res wsEnvelope
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != wsReply || res.CorrelationId != "1" || string(res.Content) != "Hello" || res.Property.Get("foo") != "bar" {
+		t.Fatalf("Unexpected reply envelope %+v", res)
+	}
+}
+
+func TestWebSocketTransportAllowedOrigins(t *testing.T) {
+	tr := NewWebSocket()
+	err := tr.Config(WebSocketConfig{
+		"port":           "8096",
+		"allowedOrigins": "https://app.example",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	spec := []struct {
+		origin   string
+		expError bool
+	}{
+		{"https://app.example", false},
+		{"https://evil.example", true},
+	}
+
+	for idx, s := range spec {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:8096/", httpPkg.Header{"Origin": {s.origin}})
+		if s.expError != (err != nil) {
+			t.Fatalf("[spec %d] Expected error to be %t; got %v", idx, s.expError, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestWebSocketTransportPeerRegistration(t *testing.T) {
+	tr := NewWebSocket()
+	if err := tr.Config(NewWebSocketConfig(8110)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:8110/?peer=browser-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Peer names that are already connected or that could shadow a server
+	// address must be rejected
+	for _, peer := range []string{"browser-1", "localhost:8110"} {
+		spoofed, res, err := websocket.DefaultDialer.Dial("ws://localhost:8110/?peer="+peer, nil)
+		if err == nil {
+			spoofed.Close()
+			t.Fatalf("[peer %s] Expected connection to be rejected", peer)
+		}
+		if res == nil || res.StatusCode == httpPkg.StatusSwitchingProtocols {
+			t.Fatalf("[peer %s] Expected an HTTP error response; got %v", peer, res)
+		}
+	}
+
+	// Requests to the peer should still be delivered to the original connection
+	go func() {
+		var req wsEnvelope
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		conn.WriteJSON(&wsEnvelope{
+			Type:          wsReply,
+			CorrelationId: req.CorrelationId,
+			Content:       []byte("original"),
+		})
+	}()
+
+	reqMsg := tr.MessageTo("localhost:8110", "browser-1", "notify")
+	content, err := (<-tr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "original" {
+		t.Fatalf("Expected request to be delivered to the original connection; got %q", string(content))
+	}
+}
+
+func TestWebSocketTransportMutualTls(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	srvTr := NewWebSocket()
+	err := srvTr.Config(NewMutualTlsConfig(
+		8111,
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8111", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// The client is registered under its certificate identity
+	clientTr := NewWebSocket()
+	err = clientTr.Config(WebSocketConfig{
+		"peer":              "browser-1",
+		"clientCertFile":    filepath.Join(dir, "client.pem"),
+		"clientCertKeyFile": filepath.Join(dir, "client-key.pem"),
+		"rootCAFile":        filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientTr.Close()
+
+	notifyChan, err := clientTr.Bind("api.example", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range notifyChan {
+			resMsg := clientTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte("ack"), nil)
+			clientTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	reqMsg := clientTr.MessageTo("spoofed", "localhost:8111", "ep1")
+	content, err := (<-clientTr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "api.example"; string(content) != exp {
+		t.Fatalf("Expected sender to be the verified certificate identity %s; got %s", exp, string(content))
+	}
+
+	reqMsg = srvTr.MessageTo("localhost:8111", "api.example", "notify")
+	content, err = (<-srvTr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "ack" {
+		t.Fatalf("Expected reply %q; got %q", "ack", string(content))
+	}
+}
+
+func TestWebSocketTransportOptionalClientAuth(t *testing.T) {
+	dir := generateMutualTlsCerts(t)
+	defer os.RemoveAll(dir)
+
+	config := NewMutualTlsConfig(
+		8114,
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+	)
+	config["clientAuth"] = "optional"
+
+	srvTr := NewWebSocket()
+	if err := srvTr.Config(config); err != nil {
+		t.Fatal(err)
+	}
+	defer srvTr.Close()
+
+	reqChan, err := srvTr.Bind("localhost:8114", "ep1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range reqChan {
+			resMsg := srvTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte(reqMsg.From()), nil)
+			srvTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	// Clients without a certificate can neither choose their sender nor
+	// register a peer name
+	anonTr := NewWebSocket()
+	err = anonTr.Config(WebSocketConfig{
+		"peer":       "browser-1",
+		"rootCAFile": filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anonTr.Close()
+
+	notifyChan, err := anonTr.Bind("browser-1", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for reqMsg := range notifyChan {
+			resMsg := anonTr.ReplyTo(reqMsg)
+			resMsg.SetContent([]byte("ack"), nil)
+			anonTr.Send(resMsg, 0, false)
+		}
+	}()
+
+	reqMsg := anonTr.MessageTo("spoofed", "localhost:8114", "ep1")
+	content, err := (<-anonTr.Send(reqMsg, time.Second, true)).Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("Expected sender of unverified client to be empty; got %s", string(content))
+	}
+
+	srvTr.peerMutex.Lock()
+	_, registered := srvTr.peers["browser-1"]
+	srvTr.peerMutex.Unlock()
+	if registered {
+		t.Fatal("Expected unverified client not to be registered under its self-declared peer name")
+	}
+}
+
+func TestWebSocketTransportBindKeys(t *testing.T) {
+	tr := NewWebSocket()
+	if err := tr.Config(NewWebSocketConfig(8112)); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Endpoints with the same name bound by different services must not
+	// replace each other
+	for _, service := range []string{"localhost:8112", "127.0.0.1:8112"} {
+		reqChan, err := tr.Bind(service, "ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(service string) {
+			for reqMsg := range reqChan {
+				resMsg := tr.ReplyTo(reqMsg)
+				resMsg.SetContent([]byte(service), nil)
+				tr.Send(resMsg, 0, false)
+			}
+		}(service)
+	}
+
+	for _, service := range []string{"localhost:8112", "127.0.0.1:8112"} {
+		reqMsg := tr.MessageTo("test", service, "ping")
+		content, err := (<-tr.Send(reqMsg, time.Second, true)).Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != service {
+			t.Fatalf("Expected request to be served by %s; got %s", service, string(content))
+		}
+	}
+}
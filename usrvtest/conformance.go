@@ -0,0 +1,291 @@
+package usrvtest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// Transport implementations can be verified against the conformance suite
+// by providing a factory that returns a new, configured transport instance.
+type TransportFactory func() usrv.Transport
+
+// Run the transport conformance suite. Each test case creates a new transport
+// using factory, binds endpoints to service and closes the transport when it
+// completes. The service name must be addressable by the transport (e.g.
+// "localhost:8080" for the http transport).
+//
+// The suite verifies that:
+//   - requests are delivered to bound endpoints and replies are routed back
+//   - message properties are propagated in both directions
+//   - reply errors are propagated to the sender
+//   - requests without a reply fail with usrv.ErrTimeout once the timeout expires
+//   - requests to unknown endpoints fail with usrv.ErrServiceUnavailable
+//   - concurrent requests receive the reply matching their correlation id
+//   - in-flight requests can be aborted if the transport implements usrv.Canceler
+//   - Close can be invoked multiple times and unbinds all endpoints
+func RunTransportSuite(t *testing.T, service string, factory TransportFactory) {
+	suite := []struct {
+		name string
+		test func(*testing.T, string, usrv.Transport)
+	}{
+		{"SendReply", testTransportSendReply},
+		{"Properties", testTransportProperties},
+		{"Error", testTransportError},
+		{"Timeout", testTransportTimeout},
+		{"UnknownEndpoint", testTransportUnknownEndpoint},
+		{"Concurrency", testTransportConcurrency},
+		{"Cancel", testTransportCancel},
+		{"Close", testTransportClose},
+	}
+
+	for _, s := range suite {
+		test := s.test
+		t.Run(s.name, func(t *testing.T) {
+			transport := factory()
+			defer transport.Close()
+			test(t, service, transport)
+		})
+	}
+}
+
+// Bind an endpoint and reply to incoming requests using handler. The returned
+// function blocks until the handler has processed count requests.
+func serveRequests(t *testing.T, transport usrv.Transport, service, endpoint string, count int, handler usrv.Handler) func() {
+	reqChan, err := transport.Bind(service, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer wg.Done()
+			req := <-reqChan
+			res := transport.ReplyTo(req)
+			handler(req, res)
+			transport.Send(res, 0, false)
+		}()
+	}
+
+	return wg.Wait
+}
+
+// Receive a reply or fail the test if none arrives within a reasonable time.
+func awaitReply(t *testing.T, resChan <-chan usrv.Message) usrv.Message {
+	select {
+	case res := <-resChan:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for reply")
+	}
+	return nil
+}
+
+func testTransportSendReply(t *testing.T, service string, transport usrv.Transport) {
+	wait := serveRequests(t, transport, service, "echo", 1, func(req, res usrv.Message) {
+		if req.From() != "client" {
+			t.Errorf("Expected request sender to be 'client'; got '%s'", req.From())
+		}
+		content, _ := req.Content()
+		res.SetContent(append([]byte("echo:"), content...), nil)
+	})
+
+	req := transport.MessageTo("client", service, "echo")
+	req.SetContent([]byte("Hello"), nil)
+	res := awaitReply(t, transport.Send(req, 0, true))
+
+	content, err := res.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte("echo:Hello"); !bytes.Equal(exp, content) {
+		t.Fatalf("Expected response to be '%s'; got '%s'", string(exp), string(content))
+	}
+	if req.CorrelationId() != res.CorrelationId() {
+		t.Fatalf("Expected res msg correlation id to be %s; got %s", req.CorrelationId(), res.CorrelationId())
+	}
+	wait()
+}
+
+func testTransportProperties(t *testing.T, service string, transport usrv.Transport) {
+	wait := serveRequests(t, transport, service, "props", 1, func(req, res usrv.Message) {
+		if propVal := req.Property().Get("foo"); propVal != "bar" {
+			t.Errorf("Expected request property 'foo' to have value 'bar'; got '%s'", propVal)
+		}
+		res.Property().Set("baz", req.Property().Get("foo"))
+		res.SetContent([]byte("OK"), nil)
+	})
+
+	req := transport.MessageTo("client", service, "props")
+	req.Property().Set("foo", "bar")
+	res := awaitReply(t, transport.Send(req, 0, true))
+
+	if _, err := res.Content(); err != nil {
+		t.Fatal(err)
+	}
+	if propVal := res.Property().Get("baz"); propVal != "bar" {
+		t.Fatalf("Expected response property 'baz' to have value 'bar'; got '%s'", propVal)
+	}
+	wait()
+}
+
+func testTransportError(t *testing.T, service string, transport usrv.Transport) {
+	expErr := fmt.Errorf("An error")
+	wait := serveRequests(t, transport, service, "fail", 1, func(req, res usrv.Message) {
+		res.SetContent(nil, expErr)
+	})
+
+	req := transport.MessageTo("client", service, "fail")
+	res := awaitReply(t, transport.Send(req, 0, true))
+
+	content, err := res.Content()
+	if err == nil || err.Error() != expErr.Error() {
+		t.Fatalf("Expected to get error %v; got %v", expErr, err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("Expected content to be empty; got %v", content)
+	}
+	wait()
+}
+
+func testTransportTimeout(t *testing.T, service string, transport usrv.Transport) {
+	// Reply after the sender has given up; the late reply must not block
+	timedOut := make(chan struct{})
+	wait := serveRequests(t, transport, service, "slow", 1, func(req, res usrv.Message) {
+		<-timedOut
+		res.SetContent([]byte("late"), nil)
+	})
+
+	req := transport.MessageTo("client", service, "slow")
+	res := awaitReply(t, transport.Send(req, 10*time.Millisecond, true))
+	close(timedOut)
+
+	content, err := res.Content()
+	if err != usrv.ErrTimeout {
+		t.Fatalf("Expected to get ErrTimeout; got %v", err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("Expected content to be empty; got %v", content)
+	}
+
+	waitChan := make(chan struct{})
+	go func() {
+		wait()
+		close(waitChan)
+	}()
+	select {
+	case <-waitChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected late reply not to block")
+	}
+}
+
+func testTransportUnknownEndpoint(t *testing.T, service string, transport usrv.Transport) {
+	// Bind at least one endpoint so that transports can begin listening
+	if _, err := transport.Bind(service, "known"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := transport.MessageTo("client", service, "unknown")
+	res := awaitReply(t, transport.Send(req, 0, true))
+
+	content, err := res.Content()
+	if err != usrv.ErrServiceUnavailable {
+		t.Fatalf("Expected to get ErrServiceUnavailable; got %v", err)
+	}
+	if len(content) != 0 {
+		t.Fatalf("Expected content to be empty; got %v", content)
+	}
+}
+
+func testTransportConcurrency(t *testing.T, service string, transport usrv.Transport) {
+	numRequests := 50
+	wait := serveRequests(t, transport, service, "echo", numRequests, func(req, res usrv.Message) {
+		content, _ := req.Content()
+		res.SetContent(content, nil)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(numRequests)
+	for i := 0; i < numRequests; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			req := transport.MessageTo("client", service, "echo")
+			exp := []byte(fmt.Sprintf("request %d", i))
+			req.SetContent(exp, nil)
+
+			var res usrv.Message
+			select {
+			case res = <-transport.Send(req, 0, true):
+			case <-time.After(5 * time.Second):
+				t.Errorf("[req %d] Timed out waiting for reply", i)
+				return
+			}
+
+			content, err := res.Content()
+			if err != nil {
+				t.Errorf("[req %d] Unexpected error: %v", i, err)
+			} else if !bytes.Equal(exp, content) {
+				t.Errorf("[req %d] Expected response to be '%s'; got '%s'", i, string(exp), string(content))
+			}
+			if req.CorrelationId() != res.CorrelationId() {
+				t.Errorf("[req %d] Expected res msg correlation id to be %s; got %s", i, req.CorrelationId(), res.CorrelationId())
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	wait()
+}
+
+func testTransportCancel(t *testing.T, service string, transport usrv.Transport) {
+	canceler, ok := transport.(usrv.Canceler)
+	if !ok {
+		t.Skip("Transport does not implement usrv.Canceler")
+	}
+
+	received := make(chan struct{})
+	cancelled := make(chan struct{})
+	wait := serveRequests(t, transport, service, "slow", 1, func(req, res usrv.Message) {
+		close(received)
+		<-cancelled
+	})
+
+	req := transport.MessageTo("client", service, "slow")
+	resChan := transport.Send(req, 0, true)
+	<-received
+	canceler.Cancel(req)
+
+	res := awaitReply(t, resChan)
+	close(cancelled)
+	wait()
+
+	if _, err := res.Content(); err != usrv.ErrCancelled {
+		t.Fatalf("Expected to get ErrCancelled; got %v", err)
+	}
+}
+
+func testTransportClose(t *testing.T, service string, transport usrv.Transport) {
+	if _, err := transport.Bind(service, "ep"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := transport.Close(); err != nil {
+			t.Fatalf("[close %d] Unexpected error: %v", i, err)
+		}
+	}
+
+	req := transport.MessageTo("client", service, "ep")
+	res := awaitReply(t, transport.Send(req, time.Second, true))
+	if _, err := res.Content(); err == nil {
+		t.Fatal("Expected requests to a closed transport to fail")
+	}
+}
@@ -34,7 +34,7 @@ func TestLogger(t *testing.T) {
 		}
 		for aidx := 0; aidx < len(args)/2; aidx += 2 {
 			if entry.Context[args[aidx].(string)] != args[aidx+1] {
-				t.Fatalf("[entry %d] Expected context entry with key '%s' to have value '%v' got '%v'", args[aidx], args[aidx+1], entry.Context[args[aidx].(string)])
+				t.Fatalf("[entry %d] Expected context entry with key '%s' to have value '%v' got '%v'", idx, args[aidx], args[aidx+1], entry.Context[args[aidx].(string)])
 			}
 		}
 	}
@@ -1,6 +1,9 @@
 package usrvtest
 
-import "github.com/achilleasa/usrv"
+import (
+	"github.com/achilleasa/usrv"
+	"golang.org/x/net/context"
+)
 
 type Message struct {
 	// From
@@ -20,6 +23,9 @@ type Message struct {
 
 	// Error
 	Err error
+
+	// Request context
+	Ctx context.Context
 }
 
 func (m *Message) From() string                 { return m.F }
@@ -28,3 +34,4 @@ func (m *Message) Property() usrv.Property      { return m.P }
 func (m *Message) CorrelationId() string        { return m.C }
 func (m *Message) Content() ([]byte, error)     { return m.Cont, m.Err }
 func (m *Message) SetContent(c []byte, e error) { m.Cont, m.Err = c, e }
+func (m *Message) Context() context.Context     { return m.Ctx }
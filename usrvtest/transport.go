@@ -0,0 +1,250 @@
+package usrvtest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// A usrv.Transport implementation for client-side unit tests. The transport
+// records every message passed to Send and replies using the canned replies
+// registered for each destination. Messages are addressed using the
+// "service.endpoint" format. Requests to destinations without a registered
+// reply fail with usrv.ErrServiceUnavailable.
+type Transport struct {
+	// A mutex for synchronized access to the transport state
+	sync.Mutex
+
+	handlers map[string]usrv.Handler
+	sent     []*Message
+	nextId   int
+}
+
+// Create a new recording transport.
+func NewTransport() *Transport {
+	return &Transport{
+		handlers: make(map[string]usrv.Handler, 0),
+		sent:     make([]*Message, 0),
+	}
+}
+
+// Reply to requests sent to the to destination ("service.endpoint") with
+// the supplied content and error.
+func (t *Transport) Reply(to string, content []byte, err error) {
+	t.HandleFunc(to, func(req, res usrv.Message) {
+		res.SetContent(content, err)
+	})
+}
+
+// Reply to requests sent to the to destination ("service.endpoint") by
+// invoking handler. The handler may block to simulate slow replies; requests
+// with a timeout fail with usrv.ErrTimeout if the handler does not return in time.
+func (t *Transport) HandleFunc(to string, handler usrv.Handler) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.handlers[to] = handler
+}
+
+// Get a copy of the messages passed to Send in the order they were sent.
+func (t *Transport) Sent() []*Message {
+	t.Lock()
+	defer t.Unlock()
+
+	sent := make([]*Message, len(t.sent))
+	copy(sent, t.sent)
+	return sent
+}
+
+// Get a copy of the messages sent to the to destination in the order they were sent.
+func (t *Transport) SentTo(to string) []*Message {
+	t.Lock()
+	defer t.Unlock()
+
+	sent := make([]*Message, 0)
+	for _, msg := range t.sent {
+		if msg.T == to {
+			sent = append(sent, msg)
+		}
+	}
+	return sent
+}
+
+// Clear the recorded messages. Registered replies are preserved.
+func (t *Transport) Reset() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.sent = make([]*Message, 0)
+}
+
+// Assert that exactly times messages were sent to the to destination.
+func (t *Transport) AssertCalled(tb testing.TB, to string, times int) bool {
+	tb.Helper()
+
+	if count := len(t.SentTo(to)); count != times {
+		tb.Errorf("Expected %d message(s) to be sent to '%s'; got %d", times, to, count)
+		return false
+	}
+	return true
+}
+
+// Assert that at least one message sent to the to destination contains all
+// of the supplied properties.
+func (t *Transport) AssertCalledWith(tb testing.TB, to string, property usrv.Property) bool {
+	tb.Helper()
+
+	sent := t.SentTo(to)
+	for _, msg := range sent {
+		if hasProperties(msg, property) {
+			return true
+		}
+	}
+
+	tb.Errorf("Expected a message with properties %v to be sent to '%s'; got %d message(s) without a match", property, to, len(sent))
+	return false
+}
+
+// Assert that messages were sent to the supplied destinations in the given
+// order. Messages to other destinations may be interleaved with the
+// expected sequence.
+func (t *Transport) AssertCalledInOrder(tb testing.TB, to ...string) bool {
+	tb.Helper()
+
+	sent := t.Sent()
+	destinations := make([]string, len(sent))
+	for idx, msg := range sent {
+		destinations[idx] = msg.T
+	}
+
+	next := 0
+	for _, dest := range destinations {
+		if next < len(to) && dest == to[next] {
+			next++
+		}
+	}
+
+	if next != len(to) {
+		tb.Errorf("Expected messages to be sent in order [%s]; got [%s]", strings.Join(to, ", "), strings.Join(destinations, ", "))
+		return false
+	}
+	return true
+}
+
+// Check if a message contains all of the supplied properties.
+func hasProperties(msg *Message, property usrv.Property) bool {
+	for k, v := range property {
+		if msg.P.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Transport) SetLogger(logger usrv.Logger) {
+}
+
+func (t *Transport) Config(params map[string]string) error {
+	return nil
+}
+
+func (t *Transport) Close() error {
+	return nil
+}
+
+// Bind returns a channel that never emits any messages; the transport only
+// supports the client side of request/reply exchanges.
+func (t *Transport) Bind(service string, endpoint string) (<-chan usrv.Message, error) {
+	return make(chan usrv.Message, 0), nil
+}
+
+// Record a message and generate a reply using the handler registered for its
+// destination. Replies sent by servers are ignored.
+func (t *Transport) Send(m usrv.Message, timeout time.Duration, expectReply bool) <-chan usrv.Message {
+	content, err := m.Content()
+	req := &Message{
+		F:    m.From(),
+		T:    m.To(),
+		C:    m.CorrelationId(),
+		P:    make(usrv.Property, 0),
+		Cont: append([]byte(nil), content...),
+		Err:  err,
+	}
+	for k, v := range m.Property() {
+		req.P[k] = v
+	}
+
+	t.Lock()
+	t.sent = append(t.sent, req)
+	handler, found := t.handlers[req.T]
+	t.Unlock()
+
+	if !expectReply {
+		return nil
+	}
+
+	resChan := make(chan usrv.Message, 1)
+	if !found {
+		res := t.ReplyTo(req)
+		res.SetContent(nil, usrv.ErrServiceUnavailable)
+		resChan <- res
+		close(resChan)
+		return resChan
+	}
+
+	go func() {
+		defer close(resChan)
+
+		doneChan := make(chan usrv.Message, 1)
+		go func() {
+			res := t.ReplyTo(req)
+			handler(req, res)
+			doneChan <- res
+		}()
+
+		var timeoutChan <-chan time.Time
+		if timeout > 0 {
+			timeoutChan = time.After(timeout)
+		}
+
+		select {
+		case res := <-doneChan:
+			resChan <- res
+		case <-timeoutChan:
+			res := t.ReplyTo(req)
+			res.SetContent(nil, usrv.ErrTimeout)
+			resChan <- res
+		}
+	}()
+
+	return resChan
+}
+
+// Create a message to be delivered to a target endpoint
+func (t *Transport) MessageTo(from string, toService string, toEndpoint string) usrv.Message {
+	t.Lock()
+	t.nextId++
+	correlationId := fmt.Sprintf("%d", t.nextId)
+	t.Unlock()
+
+	return &Message{
+		F: from,
+		T: fmt.Sprintf("%s.%s", toService, toEndpoint),
+		C: correlationId,
+		P: make(usrv.Property, 0),
+	}
+}
+
+// Create a message that serves as a reply to an incoming message
+func (t *Transport) ReplyTo(msg usrv.Message) usrv.Message {
+	return &Message{
+		F: msg.To(),
+		T: msg.From(),
+		C: msg.CorrelationId(),
+		P: make(usrv.Property, 0),
+	}
+}
@@ -0,0 +1,112 @@
+package usrvtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/achilleasa/usrv"
+)
+
+// A testing.TB implementation that records assertion failures instead of
+// failing the test.
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func TestTransportCannedReplies(t *testing.T) {
+	expErr := fmt.Errorf("Error")
+
+	transport := NewTransport()
+	transport.Reply("service.ok", []byte("OK"), nil)
+	transport.Reply("service.fail", nil, expErr)
+	transport.HandleFunc("service.slow", func(req, res usrv.Message) {
+		<-time.After(100 * time.Millisecond)
+	})
+
+	client := usrv.NewClient("service", transport)
+
+	spec := []struct {
+		endpoint   string
+		timeout    time.Duration
+		expContent string
+		expErr     error
+	}{
+		{"ok", 0, "OK", nil},
+		{"fail", 0, "", expErr},
+		{"slow", 10 * time.Millisecond, "", usrv.ErrTimeout},
+		{"unknown", 0, "", usrv.ErrServiceUnavailable},
+	}
+
+	for idx, s := range spec {
+		msg := client.NewMessage("client", s.endpoint)
+		res := <-client.Send(msg, s.timeout)
+
+		content, err := res.Content()
+		if string(content) != s.expContent {
+			t.Fatalf("[spec %d] Expected content '%s'; got '%s'", idx, s.expContent, string(content))
+		}
+		if err != s.expErr {
+			t.Fatalf("[spec %d] Expected error %v; got %v", idx, s.expErr, err)
+		}
+		if res.CorrelationId() != msg.CorrelationId() {
+			t.Fatalf("[spec %d] Expected reply correlation id '%s'; got '%s'", idx, msg.CorrelationId(), res.CorrelationId())
+		}
+	}
+
+	if count := len(transport.Sent()); count != len(spec) {
+		t.Fatalf("Expected %d messages to be recorded; got %d", len(spec), count)
+	}
+}
+
+func TestTransportRecording(t *testing.T) {
+	transport := NewTransport()
+	client := usrv.NewClient("service", transport)
+
+	msg := client.NewMessage("client", "ep1")
+	msg.Property().Set("tenant", "acme")
+	msg.SetContent([]byte("payload"), nil)
+	<-client.Send(msg, 0)
+
+	// Mutating the message after sending it should not affect the recording
+	msg.Property().Set("tenant", "other")
+	msg.SetContent([]byte("modified"), nil)
+
+	<-client.Send(client.NewMessage("client", "ep2"), 0)
+	<-client.Send(client.NewMessage("client", "ep1"), 0)
+
+	sent := transport.SentTo("service.ep1")
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 messages to be sent to 'service.ep1'; got %d", len(sent))
+	}
+	if sent[0].P.Get("tenant") != "acme" || string(sent[0].Cont) != "payload" {
+		t.Fatalf("Expected recorded message to be a snapshot of the sent message; got %v %s", sent[0].P, string(sent[0].Cont))
+	}
+
+	if !transport.AssertCalled(t, "service.ep1", 2) ||
+		!transport.AssertCalledWith(t, "service.ep1", usrv.Property{"tenant": "acme"}) ||
+		!transport.AssertCalledInOrder(t, "service.ep1", "service.ep2", "service.ep1") ||
+		!transport.AssertCalledInOrder(t, "service.ep2", "service.ep1") {
+		t.Fatal("Expected assertions to pass")
+	}
+
+	rt := &recordingT{TB: t}
+	transport.AssertCalled(rt, "service.ep2", 2)
+	transport.AssertCalledWith(rt, "service.ep1", usrv.Property{"tenant": "other"})
+	transport.AssertCalledInOrder(rt, "service.ep2", "service.ep2")
+	if len(rt.failures) != 3 {
+		t.Fatalf("Expected 3 assertion failures; got %d: %v", len(rt.failures), rt.failures)
+	}
+
+	transport.Reset()
+	if count := len(transport.Sent()); count != 0 {
+		t.Fatalf("Expected recorded messages to be cleared; got %d", count)
+	}
+}